@@ -0,0 +1,49 @@
+-- constant folded
+assert(0xF0 & 0x3C == 0x30)
+assert(0xF0 | 0x0F == 0xFF)
+assert(0xF0 ~ 0xFF == 0x0F)
+assert(~0 == -1)
+assert(1 << 4 == 16)
+assert(256 >> 4 == 16)
+assert(7 // 2 == 3)
+assert(-7 // 2 == -4)
+
+-- computed at run time
+local a, b, n = 0xF0, 0x3C, 4
+assert(a & b == 0x30 and a | b == 0xFC and a ~ b == 0xCC)
+assert(~a == -0xF1)
+assert(1 << n == 16 and 256 >> n == 16)
+assert(1 << -n == 0 and 256 >> -n == 4096)
+assert(1 << 64 == 0 and -1 >> 64 == 0)
+assert(-1 >> 60 == 15)
+assert(7.5 // n == 1 and -n // 3 == -2)
+assert(1 // 0 == 1 / 0)
+
+-- precedence: comparison < | < ~ < & < shift < .. < + < * // < unary
+assert(1 | 2 ~ 3 & 4 << 1 == 3)
+assert((1 | 6) == 7 and 1 | 6 == 7)
+assert(1 << 1 + 1 == 4)
+assert(2 * 7 // 2 == 7)
+assert(~1 + 1 == -1)
+assert("1" .. 2 << 1 == 24)
+
+-- strings and integral floats are converted
+assert("3" & 1 == 1 and 2.0 | 1 == 3 and ~"0" == -1)
+
+local ok, msg = pcall(function() return a & 1.5 end)
+assert(not ok and string.find(msg, "number has no integer representation"))
+local ok, msg = pcall(function() return a | {} end)
+assert(not ok and string.find(msg, "cannot perform bor operation between number and table"))
+local ok, msg = pcall(function() return ~{} end)
+assert(not ok and string.find(msg, "__bnot undefined"))
+
+-- metamethods
+local mt = {}
+for _, event in ipairs({"idiv", "band", "bor", "bxor", "shl", "shr"}) do
+  mt["__" .. event] = function(x, y) return event end
+end
+mt.__bnot = function(x) return "bnot" end
+local obj = setmetatable({}, mt)
+assert(obj // 1 == "idiv" and 1 & obj == "band" and obj | 1 == "bor")
+assert(obj ~ 1 == "bxor" and obj << 1 == "shl" and obj >> 1 == "shr")
+assert(~obj == "bnot")
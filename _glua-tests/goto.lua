@@ -0,0 +1,96 @@
+-- continue
+local odd = {}
+for i = 1, 10 do
+  if i % 2 == 0 then goto continue end
+  odd[#odd + 1] = i
+  ::continue::
+end
+assert(table.concat(odd, ",") == "1,3,5,7,9")
+
+-- the end of a block is out of the scope of its locals
+local n = 0
+while n < 3 do
+  n = n + 1
+  if n == 2 then goto continue end
+  local x = n
+  ::continue::
+end
+assert(n == 3)
+
+-- backward jumps
+local i = 1
+::top::
+i = i + 1
+if i < 5 then goto top end
+assert(i == 5)
+
+-- breaking out of nested loops
+local found
+for a = 1, 3 do
+  for b = 1, 3 do
+    if a * b == 6 then
+      found = a .. "x" .. b
+      goto done
+    end
+  end
+end
+::done::
+assert(found == "2x3")
+
+-- each iteration closes the upvalues of its locals
+local fns = {}
+do
+  local k = 1
+  ::again::
+  local v = k * 10
+  fns[k] = function() return v end
+  k = k + 1
+  if k <= 3 then goto again end
+end
+assert(fns[1]() == 10 and fns[2]() == 20 and fns[3]() == 30)
+
+fns = {}
+for k = 1, 3 do
+  local v = k
+  fns[k] = function() return v end
+  if k < 3 then goto next end
+  v = -v
+  ::next::
+end
+assert(fns[1]() == 1 and fns[2]() == 2 and fns[3]() == -3)
+
+-- a label in a nested block is not visible
+local ok, msg = loadstring([[
+  goto inner
+  do ::inner:: end
+]])
+assert(not ok and string.find(msg, "no visible label 'inner' for <goto> at line 1"))
+
+local ok, msg = loadstring([[
+  local f = function() goto out end
+  ::out::
+]])
+assert(not ok and string.find(msg, "no visible label 'out'"))
+
+local ok, msg = loadstring([[
+  ::twice::
+  ::twice::
+]])
+assert(not ok and string.find(msg, "label 'twice' already defined on line 1"))
+
+local ok, msg = loadstring([[
+  goto skip
+  local x = 1
+  ::skip::
+  print(x)
+]])
+assert(not ok and string.find(msg, "<goto skip> at line 1 jumps into the scope of local 'x'"))
+
+local ok, msg = loadstring([[
+  repeat
+    goto cont
+    local x = 1
+    ::cont::
+  until x
+]])
+assert(not ok and string.find(msg, "jumps into the scope of local 'x'"))
@@ -19,7 +19,10 @@ func (ls *LState) CheckAny(n int) LValue {
 
 func (ls *LState) CheckInt(n int) int {
 	v := ls.Get(n)
-	if intv, ok := v.(LNumber); ok {
+	switch intv := v.(type) {
+	case LNumber:
+		return int(intv)
+	case LInteger:
 		return int(intv)
 	}
 	ls.TypeError(n, LTNumber)
@@ -28,7 +31,10 @@ func (ls *LState) CheckInt(n int) int {
 
 func (ls *LState) CheckInt64(n int) int64 {
 	v := ls.Get(n)
-	if intv, ok := v.(LNumber); ok {
+	switch intv := v.(type) {
+	case LNumber:
+		return int64(intv)
+	case LInteger:
 		return int64(intv)
 	}
 	ls.TypeError(n, LTNumber)
@@ -37,8 +43,8 @@ func (ls *LState) CheckInt64(n int) int64 {
 
 func (ls *LState) CheckNumber(n int) LNumber {
 	v := ls.Get(n)
-	if lv, ok := v.(LNumber); ok {
-		return lv
+	if lv, ok := v.assertFloat64(); ok {
+		return LNumber(lv)
 	}
 	ls.TypeError(n, LTNumber)
 	return 0
@@ -139,7 +145,10 @@ func (ls *LState) OptInt(n int, d int) int {
 	if v == LNil {
 		return d
 	}
-	if intv, ok := v.(LNumber); ok {
+	switch intv := v.(type) {
+	case LNumber:
+		return int(intv)
+	case LInteger:
 		return int(intv)
 	}
 	ls.TypeError(n, LTNumber)
@@ -151,7 +160,10 @@ func (ls *LState) OptInt64(n int, d int64) int64 {
 	if v == LNil {
 		return d
 	}
-	if intv, ok := v.(LNumber); ok {
+	switch intv := v.(type) {
+	case LNumber:
+		return int64(intv)
+	case LInteger:
 		return int64(intv)
 	}
 	ls.TypeError(n, LTNumber)
@@ -163,8 +175,8 @@ func (ls *LState) OptNumber(n int, d LNumber) LNumber {
 	if v == LNil {
 		return d
 	}
-	if lv, ok := v.(LNumber); ok {
-		return lv
+	if lv, ok := v.assertFloat64(); ok {
+		return LNumber(lv)
 	}
 	ls.TypeError(n, LTNumber)
 	return 0
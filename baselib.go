@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"runtime"
 	"strconv"
 	"strings"
 )
@@ -64,8 +63,16 @@ func baseAssert(L *LState) int {
 }
 
 func baseCollectGarbage(L *LState) int {
-	runtime.GC()
-	return 0
+	switch L.OptString(1, "collect") {
+	case "count":
+		L.Push(LNumber(float64(L.MemoryUsage()) / 1024))
+		return 1
+	default:
+		L.collectMemory()
+		L.G.awaitFinalizers()
+		L.runFinalizers()
+		return 0
+	}
 }
 
 func baseDoFile(L *LState) int {
@@ -105,8 +112,8 @@ func baseGetFEnv(L *LState) int {
 		return 1
 	}
 
-	if number, ok := value.(LNumber); ok {
-		level := int(float64(number))
+	if number, ok := value.assertFloat64(); ok {
+		level := int(number)
 		if level <= 0 {
 			L.Push(L.Env)
 		} else {
@@ -260,7 +267,32 @@ func basePairs(L *LState) int {
 func basePCall(L *LState) int {
 	L.CheckFunction(1)
 	nargs := L.GetTop() - 1
-	if err := L.PCall(nargs, MultRet, nil); err != nil {
+	return pcallResults(L, L.PCall(nargs, MultRet, nil), 0)
+}
+
+// continuePCall finishes pcall paused in the function it called, see
+// Continue.
+func continuePCall(L *LState, i int) int {
+	return continueProtected(L, i, nil)
+}
+
+// continueXPCall finishes xpcall paused in the function it called.
+func continueXPCall(L *LState, i int) int {
+	return continueProtected(L, i, L.CheckFunction(2))
+}
+
+// continueProtected continues the function called by pcall or xpcall in
+// frame i, which is the frame above it, and returns their results.
+func continueProtected(L *LState, i int, errfunc *LFunction) int {
+	base := L.stack.At(i + 1).Base
+	err := L.pcall(i+1, base, errfunc, func() { L.continueFrames(i + 1) })
+	return pcallResults(L, err, base-L.currentFrame.LocalBase)
+}
+
+// pcallResults returns the results of pcall and xpcall, whose function was
+// called above their first top arguments.
+func pcallResults(L *LState, err error, top int) int {
+	if err != nil {
 		L.Push(LFalse)
 		if aerr, ok := err.(*ApiError); ok {
 			L.Push(aerr.Object)
@@ -268,10 +300,9 @@ func basePCall(L *LState) int {
 			L.Push(LString(err.Error()))
 		}
 		return 2
-	} else {
-		L.Insert(LTrue, 1)
-		return L.GetTop()
 	}
+	L.Insert(LTrue, top+1)
+	return L.GetTop() - top
 }
 
 func basePrint(L *LState) int {
@@ -313,9 +344,9 @@ func baseRawSet(L *LState) int {
 func baseSelect(L *LState) int {
 	L.CheckTypes(1, LTNumber, LTString)
 	switch lv := L.Get(1).(type) {
-	case LNumber:
-		idx := int(lv)
-		num := L.reg.Top() - L.indexToReg(int(lv)) - 1
+	case LNumber, LInteger:
+		idx := L.CheckInt(1)
+		num := L.reg.Top() - L.indexToReg(idx) - 1
 		if idx < 0 {
 			num++
 		}
@@ -349,8 +380,8 @@ func baseSetFEnv(L *LState) int {
 		}
 	}
 
-	if number, ok := value.(LNumber); ok {
-		level := int(float64(number))
+	if number, ok := value.assertFloat64(); ok {
+		level := int(number)
 		if level <= 0 {
 			L.Env = env
 			return 0
@@ -395,7 +426,7 @@ func baseToNumber(L *LState) int {
 	noBase := L.Get(2) == LNil
 
 	switch lv := L.CheckAny(1).(type) {
-	case LNumber:
+	case LNumber, LInteger:
 		L.Push(lv)
 	case LString:
 		str := strings.Trim(string(lv), " \n\t")
@@ -411,6 +442,8 @@ func baseToNumber(L *LState) int {
 			}
 			if v, err := strconv.ParseInt(str, base, LNumberBit); err != nil {
 				L.Push(LNil)
+			} else if L.Options.Integers {
+				L.Push(LInteger(v))
 			} else {
 				L.Push(LNumber(v))
 			}
@@ -452,18 +485,7 @@ func baseXPCall(L *LState) int {
 
 	top := L.GetTop()
 	L.Push(fn)
-	if err := L.PCall(0, MultRet, errfunc); err != nil {
-		L.Push(LFalse)
-		if aerr, ok := err.(*ApiError); ok {
-			L.Push(aerr.Object)
-		} else {
-			L.Push(LString(err.Error()))
-		}
-		return 2
-	} else {
-		L.Insert(LTrue, top+1)
-		return L.GetTop() - top
-	}
+	return pcallResults(L, L.PCall(0, MultRet, errfunc), top)
 }
 
 /* }}} */
@@ -574,8 +596,12 @@ func baseNewProxy(L *LState) int {
 	L.SetTop(1)
 	if L.Get(1) == LTrue {
 		L.SetMetatable(ud, L.NewTable())
+		L.G.addFinalizer(ud)
 	} else if d, ok := L.Get(1).(*LUserData); ok {
 		L.SetMetatable(ud, L.GetMetatable(d))
+		if d.hasFinalizer {
+			L.G.addFinalizer(ud)
+		}
 	}
 	L.Push(ud)
 	return 1
@@ -0,0 +1,60 @@
+package lua
+
+// pauseGrace is the number of instructions a state paused by
+// Options.PauseOnInstructionLimit may run past its limit to reach a point it
+// can be paused at, e.g. to leave Lua code called by table.sort.
+const pauseGrace = 10000
+
+// instructionBudget limits the instructions executed by the threads of a
+// state.
+type instructionBudget struct {
+	remaining int
+	pause     bool
+	overrun   int // instructions run past the limit waiting for a pause point
+}
+
+// step is called for every instruction, after the Pc of cf was advanced
+// past it.
+func (b *instructionBudget) step(L *LState, cf *callFrame) {
+	if b.remaining > 0 {
+		b.remaining--
+		return
+	}
+	if !b.pause || b.overrun >= pauseGrace {
+		L.raiseBudgetError()
+	}
+	b.overrun++
+	if isPausePoint(L) {
+		cf.Pc-- // the instruction runs on Continue
+		panic(newApiErrorS(ApiErrorPaused, "paused: instruction budget exhausted"))
+	}
+}
+
+// raiseBudgetError raises the error of an exhausted budget. It can be caught
+// by pcall, but every further instruction raises it again.
+func (ls *LState) raiseBudgetError() {
+	if !ls.hasErrorFunc {
+		ls.closeAllUpvalues()
+	}
+	panic(newApiErrorS(ApiErrorBudget, "instruction budget exhausted"))
+}
+
+// SetInstructionBudget limits the state and its threads to n more
+// instructions, see Options.InstructionLimit. 0 removes the limit.
+func (ls *LState) SetInstructionBudget(n int) {
+	if n > 0 {
+		ls.G.budget = &instructionBudget{remaining: n, pause: ls.Options.PauseOnInstructionLimit}
+	} else {
+		ls.G.budget = nil
+	}
+	ls.setMainLoop()
+}
+
+// InstructionBudget returns the number of instructions the state may still
+// execute, or false if it is not limited.
+func (ls *LState) InstructionBudget() (int, bool) {
+	if ls.G.budget == nil {
+		return 0, false
+	}
+	return ls.G.budget.remaining, true
+}
@@ -0,0 +1,149 @@
+package lua
+
+import (
+	"testing"
+)
+
+func TestInstructionLimit(t *testing.T) {
+	L := NewState(Options{InstructionLimit: 1000})
+	defer L.Close()
+	errorIfNotApiError(t, L.DoString(`while true do end`), ApiErrorBudget)
+	if n, ok := L.InstructionBudget(); !ok || n != 0 {
+		t.Errorf("budget must be exhausted, but got %v, %v", n, ok)
+	}
+
+	L.SetInstructionBudget(1000)
+	err := L.DoString(`
+    local ok, msg = pcall(function() while true do end end)
+    caught = msg
+    while true do end
+    `)
+	errorIfNotApiError(t, err, ApiErrorBudget)
+	errorIfNotEqual(t, LNil, L.GetGlobal("caught")) // the assignment raised it again
+
+	L.SetInstructionBudget(0)
+	errorIfScriptFail(t, L, `co = coroutine.create(function() while true do end end)`)
+	L.SetInstructionBudget(1000)
+	errorIfNotApiError(t, L.DoString(`coroutine.resume(co)`), ApiErrorBudget)
+}
+
+func TestInstructionLimitPause(t *testing.T) {
+	L := NewState(Options{InstructionLimit: 50, PauseOnInstructionLimit: true})
+	defer L.Close()
+	script := `
+    total = 0
+    for i = 1, 100 do total = total + i end
+    `
+	errorIfNotApiError(t, L.DoString(script), ApiErrorPaused)
+	L2, err := testLoad(testDump(L))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer L2.Close()
+
+	pauses := 1
+	for ; pauses < 100; pauses++ {
+		L.SetInstructionBudget(50)
+		if err = L.Continue(); err == nil {
+			break
+		}
+		errorIfNotApiError(t, err, ApiErrorPaused)
+	}
+	errorIfNotEqual(t, LNumber(5050), L.GetGlobal("total"))
+	if pauses < 5 {
+		t.Errorf("state must pause every 50 instructions, but paused %v times", pauses)
+	}
+
+	if err := L2.Continue(); err != nil {
+		t.Fatal(err)
+	}
+	errorIfNotEqual(t, LNumber(5050), L2.GetGlobal("total"))
+}
+
+func TestInstructionLimitPauseCalls(t *testing.T) {
+	for _, c := range []struct {
+		script string
+		result string
+	}{
+		{`
+        ok, total = pcall(function(n)
+          local s = 0
+          for i = 1, n do s = s + i end
+          return s
+        end, 100)
+        result = tostring(ok) .. " " .. total
+        `, "true 5050"},
+		{`
+        ok, msg = xpcall(function()
+          local s = 0
+          for i = 1, 100 do s = s + i end
+          error("sum " .. s, 0)
+        end, function(e) return "handled " .. e end)
+        result = tostring(ok) .. " " .. msg
+        `, "false handled sum 5050"},
+		{`
+        co = coroutine.create(function(n)
+          local s = 0
+          for i = 1, n do
+            s = s + i
+            if i % 25 == 0 then coroutine.yield(s) end
+          end
+          return "end"
+        end)
+        local t = {}
+        repeat
+          local ok, v = coroutine.resume(co, 100)
+          t[#t+1] = tostring(v)
+        until coroutine.status(co) == "dead"
+        result = table.concat(t, " ")
+        `, "325 1275 2850 5050 end"},
+		{`
+        f = coroutine.wrap(function()
+          local ok, s = pcall(function()
+            local s = 0
+            for i = 1, 100 do s = s + i end
+            return s
+          end)
+          coroutine.yield(s)
+          error("after", 0)
+        end)
+        local s = f()
+        local ok, msg = pcall(f)
+        result = s .. " " .. tostring(ok) .. " " .. msg
+        `, "5050 false after"},
+	} {
+		L := NewState(Options{InstructionLimit: 50, PauseOnInstructionLimit: true})
+		errorIfNotApiError(t, L.DoString(c.script), ApiErrorPaused)
+		L2, err := testLoad(testDump(L))
+		if err != nil {
+			t.Fatal(err)
+		}
+		L2.Options.PauseOnInstructionLimit = true // limits are not dumped
+		for _, L := range []*LState{L, L2} {
+			pauses := 1
+			for ; pauses < 1000; pauses++ {
+				L.SetInstructionBudget(50)
+				if err = L.Continue(); err == nil {
+					break
+				}
+				errorIfNotApiError(t, err, ApiErrorPaused)
+			}
+			errorIfNotEqual(t, LString(c.result), L.GetGlobal("result"))
+			if pauses < 3 {
+				t.Errorf("state must pause every 50 instructions, but paused %v times", pauses)
+			}
+			L.Close()
+		}
+	}
+}
+
+func TestInstructionLimitPauseGrace(t *testing.T) {
+	for _, script := range []string{
+		`table.sort({3, 2, 1}, function(a, b) while true do end end)`,
+		`string.gsub("abc", "%w", function(c) while true do end end)`,
+	} {
+		L := NewState(Options{InstructionLimit: 50, PauseOnInstructionLimit: true})
+		errorIfNotApiError(t, L.DoString(script), ApiErrorBudget)
+		L.Close()
+	}
+}
@@ -79,13 +79,21 @@ func channelSelect(L *LState) int {
 		cases[i] = cas
 	}
 
-	pos, recv, rok := reflect.Select(cases)
-	lv := LNil
-	if recv.Kind() != 0 {
-		lv, _ = recv.Interface().(LValue)
-		if lv == nil {
-			lv = LNil
+	// the chosen case is nondeterministic, its function is not
+	chosen := L.journaled("channel.select", func() []LValue {
+		pos, recv, rok := reflect.Select(cases)
+		lv := LNil
+		if recv.Kind() != 0 {
+			lv, _ = recv.Interface().(LValue)
+			if lv == nil {
+				lv = LNil
+			}
 		}
+		return []LValue{LNumber(pos), lv, LBool(rok)}
+	})
+	pos, lv, rok := int(chosen[0].(LNumber)), chosen[1], chosen[2] == LTrue
+	if pos < 0 || pos >= top {
+		L.RaiseError("journal: replay diverged, channel.select has no case %v", pos+1)
 	}
 	tbl := L.Get(pos + 1).(*LTable)
 	last := tbl.RawGetInt(tbl.Len())
@@ -0,0 +1,233 @@
+package lua
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/gladkikhartem/gopher-lua/dump"
+)
+
+// CheckpointPolicy makes the VM take snapshots of a state while it runs, so
+// a long-running script can be restored by LoadDump and resumed by Continue
+// after a crash.
+//
+// Checkpoints are taken at safe points only: between two instructions of the
+// main thread, when no Go function is in progress on its call stack.
+// A checkpoint that becomes due elsewhere, such as inside a coroutine or in
+// Lua code called by a Go function, is taken at the next safe point.
+type CheckpointPolicy struct {
+	// Instructions takes a checkpoint every Instructions instructions
+	// executed by any thread of the state. 0 disables it.
+	Instructions int
+	// Yield takes a checkpoint after every coroutine yield.
+	Yield bool
+	// Calls takes a checkpoint after every call of these Go functions from
+	// Lua code, so a restored state does not repeat the calls.
+	Calls []LGFunction
+	// DumpOptions are used to take the snapshots.
+	DumpOptions DumpOptions
+	// Hook receives the snapshots. It is called by the VM, so it must not
+	// run code of the state.
+	Hook func(L *LState, d dump.Data)
+}
+
+type checkpointer struct {
+	policy *CheckpointPolicy
+	// dump is LState.Dump; a direct call would make an initialization
+	// cycle through the standard library tables
+	dump   func(L *LState, opts ...DumpOptions) dump.Data
+	calls  map[uintptr]bool
+	count  int
+	due    bool
+	taking bool
+}
+
+func newCheckpointer(policy *CheckpointPolicy) *checkpointer {
+	cp := &checkpointer{policy: policy, dump: (*LState).Dump, calls: make(map[uintptr]bool)}
+	for _, fn := range policy.Calls {
+		cp.calls[reflect.ValueOf(fn).Pointer()] = true
+	}
+	return cp
+}
+
+// step is called before every instruction.
+func (cp *checkpointer) step(L *LState) {
+	if cp.policy.Instructions > 0 {
+		cp.count++
+		if cp.count >= cp.policy.Instructions {
+			cp.count = 0
+			cp.due = true
+		}
+	}
+	if cp.due && !cp.taking && isSafePoint(L) {
+		cp.due = false
+		cp.take(L)
+	}
+}
+
+func (cp *checkpointer) take(L *LState) {
+	cp.taking = true
+	defer func() { cp.taking = false }()
+	d := cp.dump(L, cp.policy.DumpOptions)
+	if cp.policy.Hook != nil {
+		cp.policy.Hook(L, d)
+	}
+}
+
+// call is called before OP_CALL and OP_TAILCALL.
+func (cp *checkpointer) call(L *LState, inst uint32) {
+	if len(cp.calls) == 0 {
+		return
+	}
+	fn, ok := L.reg.Get(L.currentFrame.LocalBase + opGetArgA(inst)).(*LFunction)
+	if ok && fn.IsG && cp.calls[reflect.ValueOf(fn.GFunction).Pointer()] {
+		cp.due = true
+	}
+}
+
+// yield is called after a thread yielded to its parent.
+func (cp *checkpointer) yield() {
+	if cp.policy.Yield {
+		cp.due = true
+	}
+}
+
+// isSafePoint reports whether a snapshot of L can be resumed by Continue.
+func isSafePoint(L *LState) bool {
+	if L != L.G.MainThread || L != L.G.CurrentThread {
+		return false
+	}
+	for i := 0; i < L.stack.Sp(); i++ {
+		if L.stack.At(i).Fn.IsG {
+			return false
+		}
+	}
+	return true
+}
+
+// resumables maps the Go functions that can be paused in the Lua code they
+// call to the functions finishing their frame i, whose frames above were
+// continued or have still to be. It is filled by init to avoid an
+// initialization cycle through the standard library tables.
+var resumables map[uintptr]func(L *LState, i int) int
+
+func init() {
+	resumables = map[uintptr]func(L *LState, i int) int{
+		reflect.ValueOf(basePCall).Pointer():  continuePCall,
+		reflect.ValueOf(baseXPCall).Pointer(): continueXPCall,
+		reflect.ValueOf(coResume).Pointer():   continueResume,
+		reflect.ValueOf(wrapaux).Pointer():    continueResume,
+	}
+}
+
+// resumable returns the function finishing a frame of fn paused in the Lua
+// code it called, or nil if fn is a Lua function or cannot be paused.
+func resumable(fn *LFunction) func(L *LState, i int) int {
+	if !fn.IsG {
+		return nil
+	}
+	return resumables[reflect.ValueOf(fn.GFunction).Pointer()]
+}
+
+// isPausePoint reports whether L can be paused by
+// Options.PauseOnInstructionLimit: L runs on behalf of the main thread,
+// through resumed coroutines, and the Go functions it is called by are
+// resumable.
+func isPausePoint(L *LState) bool {
+	if L != L.G.CurrentThread {
+		return false
+	}
+	for th := L; ; th = th.Parent {
+		for i := 0; i < th.stack.Sp(); i++ {
+			if fn := th.stack.At(i).Fn; fn.IsG && resumable(fn) == nil {
+				return false
+			}
+		}
+		if th.Parent == nil {
+			return th == L.G.MainThread
+		}
+		if top := th.Parent.stack.Last(); top == nil || !isResume(top.Fn) {
+			return false // resumed by LState.Resume
+		}
+	}
+}
+
+// isResume reports whether fn is coroutine.resume or a function of
+// coroutine.wrap.
+func isResume(fn *LFunction) bool {
+	if !fn.IsG {
+		return false
+	}
+	p := reflect.ValueOf(fn.GFunction).Pointer()
+	return p == reflect.ValueOf(coResume).Pointer() || p == reflect.ValueOf(wrapaux).Pointer()
+}
+
+// continueFrames runs the frames of the call stack from frame base up, which
+// were interrupted, until frame base returns.
+func (ls *LState) continueFrames(base int) {
+	for i := base; i < ls.stack.Sp(); i++ {
+		frame := ls.stack.At(i)
+		if !frame.Fn.IsG {
+			continue
+		}
+		cont := resumable(frame.Fn)
+		if cont == nil {
+			ls.RaiseError("can not continue a call of a Go function")
+		}
+		ls.currentFrame = frame
+		n := cont(ls, i)
+		if ls.hook != nil && n >= 0 {
+			ls.hook.returnG(ls)
+		}
+		tailcall := i > 0 && frame.ReturnBase < ls.stack.At(i-1).LocalBase
+		if returnGFunction(ls, frame, tailcall, n) || ls.stack.Sp() <= base {
+			return
+		}
+		break
+	}
+	if ls.stack.Sp() > base {
+		runMainLoop(ls, ls.stack.At(base))
+	}
+}
+
+// Continue runs a state restored from a checkpoint, or paused by
+// Options.PauseOnInstructionLimit, until the call that was interrupted
+// returns. A state whose call stack is empty is left as it is. A coroutine
+// of the state continues its main thread.
+func (ls *LState) Continue() (err error) {
+	if mt := ls.G.MainThread; mt != nil && mt != ls {
+		return mt.Continue()
+	}
+	if ls.stack.IsEmpty() {
+		return nil
+	}
+	oldpanic := ls.Panic
+	ls.Panic = panicWithoutTraceback
+	defer func() {
+		ls.Panic = oldpanic
+		if rcv := recover(); rcv != nil {
+			if aerr, ok := rcv.(*ApiError); ok && aerr.Type == ApiErrorPaused {
+				err = aerr // the call stack is kept for the next Continue
+				return
+			}
+			if aerr, ok := rcv.(*ApiError); ok {
+				err = aerr
+			} else {
+				err = newApiErrorS(ApiErrorPanic, fmt.Sprint(rcv))
+			}
+			if len(err.(*ApiError).StackTrace) == 0 {
+				err.(*ApiError).StackTrace = ls.stackTrace(0)
+			}
+			ls.stack.SetSp(0)
+			ls.currentFrame = nil
+		}
+	}()
+	ls.G.CurrentThread = ls
+	ls.continueFrames(0)
+	if !ls.stack.IsEmpty() {
+		ls.stack.SetSp(0)
+		ls.currentFrame = nil
+		return newApiErrorS(ApiErrorRun, "can not continue a call of a Go function")
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package lua
+
+import (
+	"testing"
+
+	"github.com/gladkikhartem/gopher-lua/dump"
+)
+
+func TestCheckpointCalls(t *testing.T) {
+	var calls []int
+	crash := true
+	step := func(L *LState) int {
+		i := L.CheckInt(1)
+		if crash && i == 50 {
+			L.RaiseError("crash")
+		}
+		calls = append(calls, i)
+		return 0
+	}
+	reg := NewGFunctionRegistry()
+	reg.Register("step", step)
+	var last dump.Data
+	policy := &CheckpointPolicy{
+		Calls:       []LGFunction{step},
+		DumpOptions: DumpOptions{GFunctions: reg},
+		Hook:        func(L *LState, d dump.Data) { last = d },
+	}
+
+	L := NewState(Options{Checkpoint: policy})
+	defer L.Close()
+	L.SetGlobal("step", L.NewFunction(step))
+	errorIfScriptNotFail(t, L, `
+    total = 0
+    for i = 1, 100 do
+      total = total + i
+      step(i)
+    end
+    `, "crash")
+	errorIfNotEqual(t, 49, len(calls))
+
+	crash = false
+	calls = nil
+	L2, err := LoadDump(last, LoadOptions{GFunctions: reg, Checkpoint: policy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer L2.Close()
+	if err := L2.Continue(); err != nil {
+		t.Fatal(err)
+	}
+	errorIfNotEqual(t, LNumber(5050), L2.GetGlobal("total"))
+	errorIfNotEqual(t, 51, len(calls))
+	errorIfNotEqual(t, 50, calls[0])
+	errorIfNotEqual(t, 5050.0, last.Tables[last.G.Global].Strdict["total"].Number)
+}
+
+func TestCheckpointInstructionsAndYields(t *testing.T) {
+	n := 0
+	L := NewState(Options{Checkpoint: &CheckpointPolicy{
+		Instructions: 100,
+		Hook:         func(L *LState, d dump.Data) { n++ },
+	}})
+	defer L.Close()
+	errorIfScriptFail(t, L, `for i = 1, 1000 do local x = i * 2 end`)
+	if n < 10 {
+		t.Errorf("too few checkpoints: %v", n)
+	}
+
+	var snapshots []dump.Data
+	L = NewState(Options{Checkpoint: &CheckpointPolicy{
+		Yield: true,
+		Hook:  func(L *LState, d dump.Data) { snapshots = append(snapshots, d) },
+	}})
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+    gen = coroutine.wrap(function() for i = 1, 3 do coroutine.yield(i) end end)
+    sum = 0
+    for i = 1, 3 do sum = sum + gen() end
+    `)
+	errorIfNotEqual(t, 3, len(snapshots))
+	L2, err := LoadDump(snapshots[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer L2.Close()
+	if err := L2.Continue(); err != nil {
+		t.Fatal(err)
+	}
+	errorIfNotEqual(t, LNumber(6), L2.GetGlobal("sum"))
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/gladkikhartem/gopher-lua/dump"
+)
+
+// dumpMain implements "glua dump": it prints the threads, globals and sizes
+// of a stored snapshot without running it.
+func dumpMain(args []string) int {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	var opt_top int
+	fs.IntVar(&opt_top, "top", 10, "")
+	fs.Usage = func() {
+		fmt.Print(`Usage: glua dump [options] snapshot.
+Prints the call stacks, locals and globals of a snapshot written by
+dump.Encode or as JSON, without running it.
+Available options are:
+  -top n   list the n largest tables (default: 10)
+`)
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 1
+	}
+	b, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	var d dump.Data
+	if dump.IsBinary(b) {
+		d, err = dump.Decode(bytes.NewReader(b))
+	} else {
+		err = json.Unmarshal(b, &d)
+	}
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	for _, err := range dump.Validate(d) {
+		fmt.Println("warning:", err.Error())
+	}
+	if err := dump.Inspect(os.Stdout, d, opt_top); err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	return 0
+}
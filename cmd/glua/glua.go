@@ -15,6 +15,9 @@ func main() {
 }
 
 func mainAux() int {
+	if len(os.Args) > 1 && os.Args[1] == "dump" {
+		return dumpMain(os.Args[2:])
+	}
 	var opt_e, opt_l, opt_p string
 	var opt_i, opt_v, opt_dt, opt_dc bool
 	var opt_m int
@@ -28,6 +31,7 @@ func mainAux() int {
 	flag.BoolVar(&opt_dc, "dc", false, "")
 	flag.Usage = func() {
 		fmt.Println(`Usage: glua [options] [script [args]].
+       glua dump [options] snapshot.
 Available options are:
   -e stat  execute string 'stat'
   -l name  require library 'name'
@@ -112,17 +112,23 @@ func isVarArgReturnExpr(expr ast.Expr) bool {
 	return false
 }
 
-func lnumberValue(expr ast.Expr) (LNumber, bool) {
+func lnumberValue(context *funcContext, expr ast.Expr) (LValue, bool) {
 	if ex, ok := expr.(*ast.NumberExpr); ok {
-		lv, err := parseNumber(ex.Value)
-		if err != nil {
-			lv = LNumber(math.NaN())
-		}
-		return lv, true
+		return numberConstant(context, ex), true
 	} else if ex, ok := expr.(*constLValueExpr); ok {
-		return ex.Value.(LNumber), true
+		return ex.Value, true
 	}
-	return 0, false
+	return LNil, false
+}
+
+// numberConstant returns the value of a numeral, an integer if it is an
+// integer numeral and the chunk is compiled with integers.
+func numberConstant(context *funcContext, ex *ast.NumberExpr) LValue {
+	lv, err := parseLuaNumber(ex.Value, context.integers)
+	if err != nil {
+		lv = LNumber(math.NaN())
+	}
+	return lv
 }
 
 /* utilities }}} */
@@ -318,10 +324,11 @@ type codeBlock struct {
 	RefUpvalue bool
 	LineStart  int
 	LastLine   int
+	Labels     map[string]*gotoLabel
 }
 
 func newCodeBlock(localvars *varNamePool, blabel int, parent *codeBlock, pos ast.PositionHolder) *codeBlock {
-	bl := &codeBlock{localvars, blabel, parent, false, 0, 0}
+	bl := &codeBlock{localvars, blabel, parent, false, 0, 0, nil}
 	if pos != nil {
 		bl.LineStart = pos.Line()
 		bl.LastLine = pos.LastLine()
@@ -339,6 +346,26 @@ type funcContext struct {
 	regTop   int
 	labelId  int
 	labelPc  map[int]int
+	Gotos    []*pendingGoto
+	integers bool // integer numerals are integers, see Options.Integers
+}
+
+// gotoLabel is a label statement of a block.
+type gotoLabel struct {
+	Label int
+	Level int // number of active local variables at the label
+	Line  int
+}
+
+// pendingGoto is a goto statement whose label has not been compiled yet. It
+// moves to the enclosing block when its block is left.
+type pendingGoto struct {
+	Name  string
+	Label int
+	Level int
+	Line  int
+	Block *codeBlock
+	Close bool // the goto leaves a block with local variables referenced as upvalues
 }
 
 func newFuncContext(sourcename string, parent *funcContext) *funcContext {
@@ -353,6 +380,9 @@ func newFuncContext(sourcename string, parent *funcContext) *funcContext {
 		labelPc:  map[int]int{},
 	}
 	fc.Blocks = []*codeBlock{fc.Block}
+	if parent != nil {
+		fc.integers = parent.integers
+	}
 	return fc
 }
 
@@ -431,6 +461,13 @@ func (fc *funcContext) CloseUpvalues() int {
 func (fc *funcContext) LeaveBlock() int {
 	closed := fc.CloseUpvalues()
 	fc.EndScope()
+	for _, gt := range fc.Gotos {
+		if gt.Block == fc.Block {
+			gt.Block = fc.Block.Parent
+			gt.Level = fc.Block.LocalVars.offset
+			gt.Close = gt.Close || fc.Block.RefUpvalue
+		}
+	}
 	fc.Block = fc.Block.Parent
 	fc.SetRegTop(fc.Block.LocalVars.LastIndex())
 	return closed
@@ -456,11 +493,27 @@ func (fc *funcContext) RegTop() int {
 /* FuncContext }}} */
 
 func compileChunk(context *funcContext, chunk []ast.Stmt) { // {{{
-	for _, stmt := range chunk {
+	for i, stmt := range chunk {
+		if label, ok := stmt.(*ast.LabelStmt); ok && isBlockEnd(chunk[i+1:]) {
+			compileLabelStmt(context, label, true)
+			continue
+		}
 		compileStmt(context, stmt)
 	}
 } // }}}
 
+// isBlockEnd reports whether the statements following a label are only
+// labels, so that the label is out of the scope of the local variables of
+// its block.
+func isBlockEnd(chunk []ast.Stmt) bool {
+	for _, stmt := range chunk {
+		if _, ok := stmt.(*ast.LabelStmt); !ok {
+			return false
+		}
+	}
+	return true
+}
+
 func compileBlock(context *funcContext, chunk []ast.Stmt) { // {{{
 	if len(chunk) == 0 {
 		return
@@ -469,9 +522,7 @@ func compileBlock(context *funcContext, chunk []ast.Stmt) { // {{{
 	ph.SetLine(sline(chunk[0]))
 	ph.SetLastLine(eline(chunk[len(chunk)-1]))
 	context.EnterBlock(labelNoJump, ph)
-	for _, stmt := range chunk {
-		compileStmt(context, stmt)
-	}
+	compileChunk(context, chunk)
 	context.LeaveBlock()
 } // }}}
 
@@ -499,6 +550,10 @@ func compileStmt(context *funcContext, stmt ast.Stmt) { // {{{
 		compileIfStmt(context, st)
 	case *ast.BreakStmt:
 		compileBreakStmt(context, st)
+	case *ast.GotoStmt:
+		compileGotoStmt(context, st)
+	case *ast.LabelStmt:
+		compileLabelStmt(context, st, false)
 	case *ast.NumberForStmt:
 		compileNumberForStmt(context, st)
 	case *ast.GenericForStmt:
@@ -820,7 +875,11 @@ func compileRepeatStmt(context *funcContext, stmt *ast.RepeatStmt) { // {{{
 	context.SetLabelPc(initlabel, context.Code.LastPC())
 	context.SetLabelPc(elselabel, context.Code.LastPC())
 	context.EnterBlock(thenlabel, stmt)
-	compileChunk(context, stmt.Stmts)
+	// the condition sees the local variables of the body, so labels at its
+	// end are in their scope
+	for _, st := range stmt.Stmts {
+		compileStmt(context, st)
+	}
 	compileBranchCondition(context, context.RegTop(), stmt.Condition, thenlabel, elselabel, false)
 
 	context.SetLabelPc(thenlabel, context.Code.LastPC())
@@ -850,6 +909,65 @@ func compileBreakStmt(context *funcContext, stmt *ast.BreakStmt) { // {{{
 	raiseCompileError(context, sline(stmt), "no loop to break")
 } // }}}
 
+func compileGotoStmt(context *funcContext, stmt *ast.GotoStmt) { // {{{
+	level := context.Block.LocalVars.LastIndex()
+	for block := context.Block; block != nil; block = block.Parent {
+		if label, ok := block.Labels[stmt.Label]; ok {
+			// a backward jump leaves the scope of the locals declared after
+			// the label, they may be referenced by closures created later
+			if level > label.Level {
+				context.Code.AddABC(OP_CLOSE, label.Level, 0, 0, sline(stmt))
+			}
+			context.Code.AddASbx(OP_JMP, 0, label.Label, sline(stmt))
+			return
+		}
+	}
+	label := context.NewLabel()
+	context.Code.AddASbx(OP_JMP, 0, label, sline(stmt))
+	context.Gotos = append(context.Gotos, &pendingGoto{
+		Name:  stmt.Label,
+		Label: label,
+		Level: level,
+		Line:  sline(stmt),
+		Block: context.Block,
+	})
+} // }}}
+
+func compileLabelStmt(context *funcContext, stmt *ast.LabelStmt, blockEnd bool) { // {{{
+	block := context.Block
+	if label, ok := block.Labels[stmt.Name]; ok {
+		raiseCompileError(context, sline(stmt), "label '%s' already defined on line %d", stmt.Name, label.Line)
+	}
+	if block.Labels == nil {
+		block.Labels = make(map[string]*gotoLabel)
+	}
+	label := &gotoLabel{Label: context.NewLabel(), Level: block.LocalVars.LastIndex(), Line: sline(stmt)}
+	if blockEnd {
+		label.Level = block.LocalVars.offset
+	}
+	block.Labels[stmt.Name] = label
+	context.SetLabelPc(label.Label, context.Code.LastPC())
+
+	needClose := false
+	gotos := context.Gotos[:0]
+	for _, gt := range context.Gotos {
+		if gt.Block != block || gt.Name != stmt.Name {
+			gotos = append(gotos, gt)
+			continue
+		}
+		if gt.Level < label.Level {
+			name := block.LocalVars.Names()[gt.Level-block.LocalVars.offset]
+			raiseCompileError(context, gt.Line, "<goto %s> at line %d jumps into the scope of local '%s'", gt.Name, gt.Line, name)
+		}
+		context.SetLabelPc(gt.Label, context.Code.LastPC())
+		needClose = needClose || gt.Close
+	}
+	context.Gotos = gotos
+	if needClose {
+		context.Code.AddABC(OP_CLOSE, label.Level, 0, 0, sline(stmt))
+	}
+} // }}}
+
 func compileFuncDefStmt(context *funcContext, stmt *ast.FuncDefStmt) { // {{{
 	if stmt.Name.Func == nil {
 		reg := context.RegTop()
@@ -953,11 +1071,7 @@ func compileExpr(context *funcContext, reg int, expr ast.Expr, ec *expcontext) i
 		code.AddABx(OP_LOADK, sreg, context.ConstIndex(LString(ex.Value)), sline(ex))
 		return sused
 	case *ast.NumberExpr:
-		num, err := parseNumber(ex.Value)
-		if err != nil {
-			num = LNumber(math.NaN())
-		}
-		code.AddABx(OP_LOADK, sreg, context.ConstIndex(num), sline(ex))
+		code.AddABx(OP_LOADK, sreg, context.ConstIndex(numberConstant(context, ex)), sline(ex))
 		return sused
 	case *constLValueExpr:
 		code.AddABx(OP_LOADK, sreg, context.ConstIndex(ex.Value), sline(ex))
@@ -1013,7 +1127,7 @@ func compileExpr(context *funcContext, reg int, expr ast.Expr, ec *expcontext) i
 	case *ast.StringConcatOpExpr:
 		compileStringConcatOpExpr(context, reg, ex, ec)
 		return sused
-	case *ast.UnaryMinusOpExpr, *ast.UnaryNotOpExpr, *ast.UnaryLenOpExpr:
+	case *ast.UnaryMinusOpExpr, *ast.UnaryNotOpExpr, *ast.UnaryLenOpExpr, *ast.UnaryBNotOpExpr:
 		compileUnaryOpExpr(context, reg, ex, ec)
 		return sused
 	case *ast.RelationalOpExpr:
@@ -1070,38 +1184,38 @@ func compileExprWithMVPropagation(context *funcContext, expr ast.Expr, reg *int,
 	compileExprWithPropagation(context, expr, reg, save, context.Code.PropagateMV)
 } // }}}
 
-func constFold(exp ast.Expr) ast.Expr { // {{{
+func constFold(context *funcContext, exp ast.Expr) ast.Expr { // {{{
 	switch expr := exp.(type) {
 	case *ast.ArithmeticOpExpr:
-		lvalue, lisconst := lnumberValue(constFold(expr.Lhs))
-		rvalue, risconst := lnumberValue(constFold(expr.Rhs))
+		lvalue, lisconst := lnumberValue(context, constFold(context, expr.Lhs))
+		rvalue, risconst := lnumberValue(context, constFold(context, expr.Rhs))
 		if lisconst && risconst {
-			switch expr.Operator {
-			case "+":
-				return &constLValueExpr{Value: lvalue + rvalue}
-			case "-":
-				return &constLValueExpr{Value: lvalue - rvalue}
-			case "*":
-				return &constLValueExpr{Value: lvalue * rvalue}
-			case "/":
-				return &constLValueExpr{Value: lvalue / rvalue}
-			case "%":
-				return &constLValueExpr{Value: luaModulo(lvalue, rvalue)}
-			case "^":
-				return &constLValueExpr{Value: LNumber(math.Pow(float64(lvalue), float64(rvalue)))}
-			default:
-				panic(fmt.Sprintf("unknown binop: %v", expr.Operator))
+			// operations that raise an error, like bitwise operations on
+			// operands without an integer representation, raise it at run
+			// time
+			if value, err := arith(arithOpCode(expr.Operator), lvalue, rvalue); err == "" {
+				return &constLValueExpr{Value: value}
 			}
-		} else {
-			retexpr := *expr
-			retexpr.Lhs = constFold(expr.Lhs)
-			retexpr.Rhs = constFold(expr.Rhs)
-			return &retexpr
 		}
+		retexpr := *expr
+		retexpr.Lhs = constFold(context, expr.Lhs)
+		retexpr.Rhs = constFold(context, expr.Rhs)
+		return &retexpr
 	case *ast.UnaryMinusOpExpr:
-		expr.Expr = constFold(expr.Expr)
-		if value, ok := lnumberValue(expr.Expr); ok {
-			return &constLValueExpr{Value: LNumber(-value)}
+		expr.Expr = constFold(context, expr.Expr)
+		if value, ok := lnumberValue(context, expr.Expr); ok {
+			if iv, ok := value.(LInteger); ok {
+				return &constLValueExpr{Value: -iv}
+			}
+			return &constLValueExpr{Value: -value.(LNumber)}
+		}
+		return expr
+	case *ast.UnaryBNotOpExpr:
+		expr.Expr = constFold(context, expr.Expr)
+		if value, ok := lnumberValue(context, expr.Expr); ok {
+			if value, err := arith(OP_BNOT, value, value); err == "" {
+				return &constLValueExpr{Value: value}
+			}
 		}
 		return expr
 	default:
@@ -1136,6 +1250,10 @@ func compileFunctionExpr(context *funcContext, funcexpr *ast.FunctionExpr, ec *e
 	}
 
 	compileChunk(context, funcexpr.Stmts)
+	if len(context.Gotos) > 0 {
+		gt := context.Gotos[0]
+		raiseCompileError(context, gt.Line, "no visible label '%s' for <goto> at line %d", gt.Name, gt.Line)
+	}
 
 	context.Code.AddABC(OP_RETURN, 0, 1, 0, eline(funcexpr))
 	context.EndScope()
@@ -1225,7 +1343,7 @@ func compileTableExpr(context *funcContext, reg int, ex *ast.TableExpr, ec *expc
 } // }}}
 
 func compileArithmeticOpExpr(context *funcContext, reg int, expr *ast.ArithmeticOpExpr, ec *expcontext) { // {{{
-	exp := constFold(expr)
+	exp := constFold(context, expr)
 	if ex, ok := exp.(*constLValueExpr); ok {
 		exp.SetLine(sline(expr))
 		compileExpr(context, reg, ex, ec)
@@ -1238,22 +1356,37 @@ func compileArithmeticOpExpr(context *funcContext, reg int, expr *ast.Arithmetic
 	c := reg
 	compileExprWithKMVPropagation(context, expr.Rhs, &reg, &c)
 
-	op := 0
-	switch expr.Operator {
+	context.Code.AddABC(arithOpCode(expr.Operator), a, b, c, sline(expr))
+} // }}}
+
+func arithOpCode(operator string) int { // {{{
+	switch operator {
 	case "+":
-		op = OP_ADD
+		return OP_ADD
 	case "-":
-		op = OP_SUB
+		return OP_SUB
 	case "*":
-		op = OP_MUL
+		return OP_MUL
 	case "/":
-		op = OP_DIV
+		return OP_DIV
 	case "%":
-		op = OP_MOD
+		return OP_MOD
 	case "^":
-		op = OP_POW
-	}
-	context.Code.AddABC(op, a, b, c, sline(expr))
+		return OP_POW
+	case "//":
+		return OP_IDIV
+	case "&":
+		return OP_BAND
+	case "|":
+		return OP_BOR
+	case "~":
+		return OP_BXOR
+	case "<<":
+		return OP_SHL
+	case ">>":
+		return OP_SHR
+	}
+	panic(fmt.Sprintf("unknown binop: %v", operator))
 } // }}}
 
 func compileStringConcatOpExpr(context *funcContext, reg int, expr *ast.StringConcatOpExpr, ec *expcontext) { // {{{
@@ -1283,7 +1416,7 @@ func compileUnaryOpExpr(context *funcContext, reg int, expr ast.Expr, ec *expcon
 	var operandexpr ast.Expr
 	switch ex := expr.(type) {
 	case *ast.UnaryMinusOpExpr:
-		exp := constFold(ex)
+		exp := constFold(context, ex)
 		if lvexpr, ok := exp.(*constLValueExpr); ok {
 			exp.SetLine(sline(expr))
 			compileExpr(context, reg, lvexpr, ec)
@@ -1307,6 +1440,16 @@ func compileUnaryOpExpr(context *funcContext, reg int, expr ast.Expr, ec *expcon
 	case *ast.UnaryLenOpExpr:
 		opcode = OP_LEN
 		operandexpr = ex.Expr
+	case *ast.UnaryBNotOpExpr:
+		exp := constFold(context, ex)
+		if lvexpr, ok := exp.(*constLValueExpr); ok {
+			exp.SetLine(sline(expr))
+			compileExpr(context, reg, lvexpr, ec)
+			return
+		}
+		ex, _ = exp.(*ast.UnaryBNotOpExpr)
+		operandexpr = ex.Expr
+		opcode = OP_BNOT
 	}
 
 	a := savereg(ec, reg)
@@ -1568,15 +1711,25 @@ func patchCode(context *funcContext) { // {{{
 	for pc := 0; pc < len(code); pc++ {
 		inst := code[pc]
 		curop := opGetOpCode(inst)
+		if reg := opMaxRegister(inst); reg > maxreg {
+			maxreg = reg
+		}
 		switch curop {
 		case OP_CLOSURE:
 			pc += int(context.Proto.FunctionPrototypes[opGetArgBx(inst)].NumUpvalues)
 			moven = 0
 			continue
 		case OP_SETGLOBAL, OP_SETUPVAL, OP_EQ, OP_LT, OP_LE, OP_TEST,
-			OP_TAILCALL, OP_RETURN, OP_FORPREP, OP_FORLOOP, OP_TFORLOOP,
-			OP_SETLIST, OP_CLOSE:
+			OP_TAILCALL, OP_RETURN, OP_SETLIST, OP_CLOSE:
 			/* nothing to do */
+		case OP_FORPREP, OP_FORLOOP:
+			if reg := opGetArgA(inst) + 3; reg > maxreg {
+				maxreg = reg
+			}
+		case OP_TFORLOOP:
+			if reg := opGetArgA(inst) + 2 + opGetArgC(inst); reg > maxreg {
+				maxreg = reg
+			}
 		case OP_CALL:
 			if reg := opGetArgA(inst) + opGetArgC(inst) - 2; reg > maxreg {
 				maxreg = reg
@@ -1637,6 +1790,12 @@ func patchCode(context *funcContext) { // {{{
 } // }}}
 
 func Compile(chunk []ast.Stmt, name string) (proto *FunctionProto, err error) { // {{{
+	return compile(chunk, name, false)
+} // }}}
+
+// compile compiles chunk, with integer numerals as integers if integers is
+// set.
+func compile(chunk []ast.Stmt, name string, integers bool) (proto *FunctionProto, err error) { // {{{
 	defer func() {
 		if rcv := recover(); rcv != nil {
 			if _, ok := rcv.(*CompileError); ok {
@@ -1650,6 +1809,7 @@ func Compile(chunk []ast.Stmt, name string) (proto *FunctionProto, err error) {
 	parlist := &ast.ParList{HasVargs: true, Names: []string{}}
 	funcexpr := &ast.FunctionExpr{ParList: parlist, Stmts: chunk}
 	context := newFuncContext(name, nil)
+	context.integers = integers
 	compileFunctionExpr(context, funcexpr, ecnone(0))
 	proto = context.Proto
 	return
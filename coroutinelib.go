@@ -77,10 +77,19 @@ func coResume(L *LState) int {
 		L.XMoveTo(th, nargs)
 	}
 	top := L.GetTop()
-	threadRun(th)
+	threadRun(th, false)
 	return L.GetTop() - top
 }
 
+// continueResume finishes coroutine.resume or a function of coroutine.wrap
+// paused in their thread, see Continue.
+func continueResume(L *LState, i int) int {
+	th := L.CheckThread(1)
+	L.G.CurrentThread = th
+	threadRun(th, true)
+	return L.GetTop() - 1
+}
+
 func coRunning(L *LState) int {
 	if L.G.MainThread == L {
 		L.Push(LNil)
@@ -13,11 +13,13 @@ func OpenDebug(L *LState) int {
 
 var debugFuncs = map[string]LGFunction{
 	"getfenv":      debugGetFEnv,
+	"gethook":      debugGetHook,
 	"getinfo":      debugGetInfo,
 	"getlocal":     debugGetLocal,
 	"getmetatable": debugGetMetatable,
 	"getupvalue":   debugGetUpvalue,
 	"setfenv":      debugSetFEnv,
+	"sethook":      debugSetHook,
 	"setlocal":     debugSetLocal,
 	"setmetatable": debugSetMetatable,
 	"setupvalue":   debugSetUpvalue,
@@ -29,6 +31,36 @@ func debugGetFEnv(L *LState) int {
 	return 1
 }
 
+func debugGetHook(L *LState) int {
+	th := L
+	if t, ok := L.Get(1).(*LState); ok {
+		th = t
+	}
+	mask, count, fn := th.GetHook()
+	if fn == nil {
+		L.Push(LNil)
+		return 1
+	}
+	if th.hook.luaFn != nil {
+		L.Push(th.hook.luaFn)
+	} else {
+		L.Push(LString("external hook"))
+	}
+	smask := ""
+	if mask&MaskCall != 0 {
+		smask += "c"
+	}
+	if mask&MaskReturn != 0 {
+		smask += "r"
+	}
+	if mask&MaskLine != 0 {
+		smask += "l"
+	}
+	L.Push(LString(smask))
+	L.Push(LNumber(count))
+	return 3
+}
+
 func debugGetInfo(L *LState) int {
 	L.CheckTypes(1, LTFunction, LTNumber)
 	arg1 := L.Get(1)
@@ -41,8 +73,8 @@ func debugGetInfo(L *LState) int {
 	case *LFunction:
 		dbg = &Debug{}
 		fn, err = L.GetInfo(">"+what, dbg, lv)
-	case LNumber:
-		dbg, ok = L.GetStack(int(lv))
+	case LNumber, LInteger:
+		dbg, ok = L.GetStack(L.CheckInt(1))
 		if !ok {
 			L.Push(LNil)
 			return 1
@@ -111,6 +143,52 @@ func debugSetFEnv(L *LState) int {
 	return 0
 }
 
+func debugSetHook(L *LState) int {
+	th, n := L, 1
+	if t, ok := L.Get(1).(*LState); ok {
+		th, n = t, 2
+	}
+	if L.Get(n) == LNil {
+		th.SetHook(0, 0, nil)
+		return 0
+	}
+	fn := L.CheckFunction(n)
+	smask := L.OptString(n+1, "")
+	count := L.OptInt(n+2, 0)
+	var mask HookMask
+	if strings.Contains(smask, "c") {
+		mask |= MaskCall
+	}
+	if strings.Contains(smask, "r") {
+		mask |= MaskReturn
+	}
+	if strings.Contains(smask, "l") {
+		mask |= MaskLine
+	}
+	if count > 0 {
+		mask |= MaskCount
+	}
+	th.SetHook(mask, count, luaHook(fn))
+	if th.hook != nil {
+		th.hook.luaFn = fn
+	}
+	return 0
+}
+
+// luaHook returns a hook that calls fn with the event and the line.
+func luaHook(fn *LFunction) LHook {
+	return func(L *LState, event string, line int) {
+		L.Push(fn)
+		L.Push(LString(event))
+		if line < 0 {
+			L.Call(1, 0)
+		} else {
+			L.Push(LNumber(line))
+			L.Call(2, 0)
+		}
+	}
+}
+
 func debugSetLocal(L *LState) int {
 	level := L.CheckInt(1)
 	idx := L.CheckInt(2)
@@ -1,10 +1,17 @@
 package lua
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"io/ioutil"
+	"os"
 	"reflect"
+	"sort"
 	"strconv"
+	"unsafe"
+	"weak"
 
 	"github.com/gladkikhartem/gopher-lua/dump"
 )
@@ -12,7 +19,6 @@ import (
 /* TODO LIST
 
 Function Proto constans disappear after 2nd dump
-Restore STDLIB GFunctions
 Registry value dissapeared !?
 {
 "Type": 2,
@@ -21,15 +27,120 @@ Registry value dissapeared !?
 _G Table losing  globals information about STDLIB and other...
 table with _G key is lost
 
+*/
 
-TODO: save original pointer adresses to we could use them
-to track values in diff across the time
+// DumpOptions configures LState.Dump.
+type DumpOptions struct {
+	// UserData converts userdata values that do not implement LuaDumpable.
+	// If nil, only their types are saved.
+	UserData DumpUserData
+	// GFunctions names Go functions, nil means NewGFunctionRegistry().
+	GFunctions *GFunctionRegistry
+	// Files saves regular and temporary files opened by the io library.
+	// Standard streams are always saved, other files are loaded as closed
+	// files if Files is false.
+	Files bool
+	// Externals names objects DumpValue saves by reference instead of by
+	// value, nil means L.Externals().
+	Externals map[string]LValue
+	// Protos, if set, receives the function prototypes of the snapshot,
+	// which then refers to them by hash only.
+	Protos dump.ProtoStore
+}
 
+// LoadOptions configures LoadDump.
+type LoadOptions struct {
+	// UserData restores userdata values. If nil, values are left nil.
+	UserData ParseUserData
+	// UserDataTypes restores userdata values saved by LuaDumpable.
+	UserDataTypes UserDataTypes
+	// GFunctions resolves Go functions, nil means NewGFunctionRegistry().
+	GFunctions *GFunctionRegistry
+	// Files reopens saved files at their saved offsets and recreates temp
+	// files. Otherwise, and for saved files that can no longer be opened,
+	// they are loaded as closed files.
+	Files bool
+	// Migrations upgrade snapshots of older schema versions.
+	Migrations dump.Migrations
+	// Externals binds references of a partial snapshot by name, nil means
+	// L.Externals().
+	Externals map[string]LValue
+	// Verifier, if set, makes unsigned snapshots and snapshots modified
+	// after dump.Sign fail to load.
+	Verifier dump.Verifier
+	// Checkpoint is the checkpoint policy of the loaded state, see
+	// Options.Checkpoint. Policies are not saved in snapshots.
+	Checkpoint *CheckpointPolicy
+	// InstructionLimit, PauseOnInstructionLimit and MemoryLimit limit the
+	// loaded state like the Options of the same names. Limits, hooks and
+	// journals are not saved in snapshots, so the loaded state has none
+	// unless they are set here, or by SetHook and SetJournal. LoadValue
+	// ignores them, the loaded threads share the limits of L.
+	InstructionLimit        int
+	PauseOnInstructionLimit bool
+	MemoryLimit             int
+	// Journal records or replays the nondeterministic calls of the loaded
+	// state, see LState.SetJournal.
+	Journal *Journal
+	// Protos resolves function prototypes saved with DumpOptions.Protos.
+	Protos dump.ProtoStore
+	// ProtoCache, if set, shares function prototypes between all states
+	// loaded with it.
+	ProtoCache *ProtoCache
+}
 
-*/
-func (s *LState) Dump(du DumpUserData, df DumpGFunction) dump.Data {
-	d := dumper{
+// Dump returns a snapshot of the state.
+//
+// All threads reachable from the state are saved with their stacks, so
+// coroutines suspended in coroutine.yield can be resumed after LoadDump,
+// by Lua code or by LState.Resume. Dump must not be called while a
+// coroutine is running.
+func (s *LState) Dump(opts ...DumpOptions) dump.Data {
+	d := s.newDumper(opts)
+	d.dumpState(s, "dumpState", false)
+	d.ids.keep(d.ptrMap)
+	return d.d
+}
+
+// DumpValue returns a partial snapshot of lv and the objects reachable from
+// it, to be loaded by LoadValue.
+//
+// Objects named in DumpOptions.Externals are not saved, references to them
+// are saved by name and re-bound by LoadValue. lv itself is always saved.
+// Threads that are not external are saved with their stacks, but the
+// global state is not.
+func (s *LState) DumpValue(lv LValue, opts ...DumpOptions) dump.Data {
+	d := s.newDumper(opts)
+	d.partial = true
+	d.value = lv
+	d.externals = make(map[LValue]string)
+	externals := d.opts.Externals
+	if externals == nil {
+		externals = s.Externals()
+	}
+	for _, name := range sortedValueNames(externals) {
+		if _, ok := d.externals[externals[name]]; !ok {
+			d.externals[externals[name]] = name
+		}
+	}
+	d.d.Externals = make(map[dump.Ptr]*dump.External)
+	d.d.Root = d.dumpLValue(lv, "value", false)
+	return d.d
+}
+
+func (s *LState) newDumper(opts []DumpOptions) *dumper {
+	var opt DumpOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	if opt.GFunctions == nil {
+		opt.GFunctions = NewGFunctionRegistry()
+	}
+	return &dumper{
 		d: dump.Data{
+			Version:         dump.Version,
+			LuaVersion:      LuaVersion,
+			OpCodeHash:      OpCodeHash,
 			States:          make(map[dump.Ptr]*dump.State),
 			Tables:          make(map[dump.Ptr]*dump.Table),
 			CallFrames:      make(map[dump.Ptr]*dump.CallFrame),
@@ -40,24 +151,188 @@ func (s *LState) Dump(du DumpUserData, df DumpGFunction) dump.Data {
 			DbgLocalInfos:   make(map[dump.Ptr]*dump.DbgLocalInfo),
 			Upvalues:        make(map[dump.Ptr]*dump.Upvalue),
 			UserData:        make(map[dump.Ptr]*dump.UserData),
+			Files:           make(map[dump.Ptr]*dump.File),
+			Channels:        make(map[dump.Ptr]*dump.Channel),
 		},
-		prefixCount:   make(map[string]int),
-		ptrMap:        make(map[string]string),
-		dumpData:      du,
-		dumpGFunction: df,
-		dumped:        make(map[dump.Ptr]bool),
+		root:   s,
+		ptrMap: make(map[interface{}]dump.Ptr),
+		ids:    s.G.identity(),
+		opts:   opt,
+		dumped: make(map[dump.Ptr]bool),
+		stored: make(map[string]bool),
 	}
-	d.dumpState(s, "dumpState", false)
-	return d.d
+}
+
+// Externals returns the objects DumpValue and LoadValue refer to by name by
+// default: the global table as "_G", the registry as "_REGISTRY", the main
+// thread as "_MAIN", global functions by their names, loaded modules by
+// their names and module functions as "module.function".
+func (ls *LState) Externals() map[string]LValue {
+	ext := map[string]LValue{
+		"_G":        ls.G.Global,
+		"_REGISTRY": ls.G.Registry,
+		"_MAIN":     ls.G.MainThread,
+	}
+	if ls.G.MainThread == nil {
+		ext["_MAIN"] = ls
+	}
+	ls.G.Global.ForEach(func(k, v LValue) {
+		if name, ok := k.(LString); ok && v.Type() == LTFunction {
+			ext[string(name)] = v
+		}
+	})
+	if loaded, ok := ls.G.Registry.RawGetString("_LOADED").(*LTable); ok {
+		loaded.ForEach(func(k, v LValue) {
+			module, ok := k.(LString)
+			mt, isTable := v.(*LTable)
+			if !ok || !isTable {
+				return
+			}
+			if _, ok := ext[string(module)]; !ok {
+				ext[string(module)] = mt
+			}
+			mt.ForEach(func(fk, fv LValue) {
+				if fname, ok := fk.(LString); ok && fv.Type() == LTFunction {
+					ext[string(module)+"."+string(fname)] = fv
+				}
+			})
+		})
+	}
+	return ext
+}
+
+func sortedValueNames(values map[string]LValue) []string {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
 type dumper struct {
-	d             dump.Data
-	dumpData      DumpUserData
-	dumpGFunction DumpGFunction
-	ptrMap        map[string]string
-	prefixCount   map[string]int
-	dumped        map[dump.Ptr]bool
+	d      dump.Data
+	root   *LState
+	opts   DumpOptions
+	ptrMap map[interface{}]dump.Ptr // objects seen by this dump
+	ids    *dumpIdentity
+	dumped map[dump.Ptr]bool
+
+	// partial dumps save value and the objects reachable from it, except
+	// externals
+	partial   bool
+	value     LValue
+	externals map[LValue]string
+
+	fork *forkValues // set by Fork
+
+	stored    map[string]bool    // hashes put into opts.Protos
+	typeNames map[*LTable]string // type metatables by registry name
+}
+
+// external returns the Ptr of an object a partial dump refers to by name.
+func (d *dumper) external(obj LValue) (dump.Ptr, bool) {
+	if !d.partial || obj == d.value {
+		return "", false
+	}
+	name, ok := d.externals[obj]
+	if !ok {
+		return "", false
+	}
+	ptr := dump.Ptr("@" + name)
+	d.d.Externals[ptr] = &dump.External{Name: name, Type: int(obj.Type())}
+	return ptr, true
+}
+
+// dumpIdentity remembers the Ptr every object of a Global was dumped or
+// loaded as, so the same object has the same Ptr in all snapshots of a state
+// and only new objects get fresh ones.
+// Objects are referenced weakly, so that snapshots do not keep them alive,
+// and an entry is only used while its object is alive, which guarantees that
+// a freed address is never mistaken for an old object.
+type dumpIdentity struct {
+	ptrs        map[identityKey]identityEntry
+	used        map[dump.Ptr]bool
+	prefixCount map[string]int
+}
+
+// identityKey identifies an object by its type and address.
+type identityKey struct {
+	typ  reflect.Type
+	addr uintptr
+}
+
+type identityEntry struct {
+	ptr  dump.Ptr
+	weak weak.Pointer[byte] // the object, nil once it was collected
+}
+
+func newDumpIdentity() *dumpIdentity {
+	return &dumpIdentity{
+		ptrs:        make(map[identityKey]identityEntry),
+		used:        make(map[dump.Ptr]bool),
+		prefixCount: make(map[string]int),
+	}
+}
+
+func (g *Global) identity() *dumpIdentity {
+	if g.ids == nil {
+		g.ids = newDumpIdentity()
+	}
+	return g.ids
+}
+
+// objectAddr returns the address of obj, a pointer or a channel.
+func objectAddr(obj interface{}) (identityKey, unsafe.Pointer) {
+	v := reflect.ValueOf(obj)
+	addr := v.UnsafePointer()
+	return identityKey{typ: v.Type(), addr: uintptr(addr)}, addr
+}
+
+// newPtr returns an unused Ptr built from a given prefix.
+func (ids *dumpIdentity) newPtr(prefix string) dump.Ptr {
+	for {
+		count := ids.prefixCount[prefix]
+		ids.prefixCount[prefix]++
+		alias := dump.Ptr(fmt.Sprintf("%v-%v", prefix, count))
+		if count == 0 && prefix != "" {
+			alias = dump.Ptr(prefix)
+		}
+		if !ids.used[alias] {
+			ids.used[alias] = true
+			return alias
+		}
+	}
+}
+
+// get returns the Ptr obj was dumped or loaded as, if it is still alive.
+func (ids *dumpIdentity) get(obj interface{}) (dump.Ptr, bool) {
+	key, _ := objectAddr(obj)
+	e, ok := ids.ptrs[key]
+	if !ok {
+		return "", false
+	}
+	if e.weak.Value() == nil {
+		delete(ids.ptrs, key)
+		return "", false
+	}
+	return e.ptr, true
+}
+
+func (ids *dumpIdentity) set(obj interface{}, ptr dump.Ptr) {
+	key, addr := objectAddr(obj)
+	ids.ptrs[key] = identityEntry{ptr: ptr, weak: weak.Make((*byte)(addr))}
+	ids.used[ptr] = true
+}
+
+// keep forgets all objects except the given ones. Counters are not reset,
+// so Ptrs of forgotten objects are not handed out again.
+func (ids *dumpIdentity) keep(ptrs map[interface{}]dump.Ptr) {
+	ids.ptrs = make(map[identityKey]identityEntry, len(ptrs))
+	ids.used = make(map[dump.Ptr]bool, len(ptrs))
+	for obj, ptr := range ptrs {
+		ids.set(obj, ptr)
+	}
 }
 
 func (d *dumper) dumpLValue(lv LValue, name string, initonly bool) dump.Value {
@@ -69,6 +344,8 @@ func (d *dumper) dumpLValue(lv LValue, name string, initonly bool) dump.Value {
 		return dump.Value{Type: int(LTBool), Bool: bool(v)}
 	case LNumber:
 		return dump.Value{Type: int(LTNumber), Number: float64(v)}
+	case LInteger:
+		return dump.Value{Type: int(LTNumber), Integer: true, Int: int64(v)}
 	case LString:
 		return dump.Value{Type: int(LTString), String: string(v)}
 	case *LNilType:
@@ -81,25 +358,32 @@ func (d *dumper) dumpLValue(lv LValue, name string, initonly bool) dump.Value {
 		return dump.Value{Type: int(LTTable), Ptr: d.dumpTable(v, name, initonly)}
 	case *LUserData:
 		return dump.Value{Type: int(LTUserData), Ptr: d.dumpUserData(v, name, initonly)}
+	case LChannel:
+		return dump.Value{Type: int(LTChannel), Ptr: d.dumpChannel(v, name, initonly)}
 	default:
 		return dump.Value{Type: int(LTNil)}
 	}
 }
 
+// dump.Validate checks value types on its own, keep it in sync.
+var _ = [1]struct{}{}[dump.VChannel-int(LTChannel)]
+
 func (d *dumpLoader) loadLValue(vv dump.Value) (LValue, error) {
 	switch LValueType(vv.Type) {
 	case LTBool:
 		v := LBool(vv.Bool)
 		return v, nil
 	case LTNumber:
+		if vv.Integer {
+			return LInteger(vv.Int), nil
+		}
 		v := LNumber(vv.Number)
 		return v, nil
 	case LTString:
 		v := LString(vv.String)
 		return v, nil
 	case LTNil:
-		v := LNilType{}
-		return &v, nil
+		return LNil, nil
 	case LTFunction:
 		return d.loadFunction(vv.Ptr)
 	case LTThread:
@@ -108,6 +392,8 @@ func (d *dumpLoader) loadLValue(vv dump.Value) (LValue, error) {
 		return d.loadTable(vv.Ptr)
 	case LTUserData:
 		return d.loadUserData(vv.Ptr)
+	case LTChannel:
+		return d.loadChannel(vv.Ptr)
 	default:
 		return nil, fmt.Errorf("unsupported type: %#v", vv.Type)
 	}
@@ -117,6 +403,9 @@ func (d *dumper) dumpState(s *LState, name string, initonly bool) (ptr dump.Ptr)
 	if s == nil {
 		return
 	}
+	if ptr, ok := d.external(s); ok {
+		return ptr
+	}
 	ptr = d.getPtr(s, name)
 	_, ok := d.d.States[ptr]
 	if ok && d.dumped[ptr] {
@@ -136,6 +425,9 @@ func (d *dumper) dumpState(s *LState, name string, initonly bool) (ptr dump.Ptr)
 		RegistrySize:        s.Options.RegistrySize,
 		SkipOpenLibs:        s.Options.SkipOpenLibs,
 		IncludeGoStackTrace: s.Options.IncludeGoStackTrace,
+		Integers:            s.Options.Integers,
+		Lua53Operators:      s.Options.Lua53Operators,
+		Goto:                s.Options.Goto,
 	}
 	ds.Stop = s.stop
 	ds.UVCache = d.dumpUpvalue(s.uvcache, ".uvCache")
@@ -177,6 +469,14 @@ func (d *dumpLoader) loadState(ptr dump.Ptr) (*LState, error) {
 		RegistrySize:        ds.Options.RegistrySize,
 		SkipOpenLibs:        ds.Options.SkipOpenLibs,
 		IncludeGoStackTrace: ds.Options.IncludeGoStackTrace,
+		Integers:            ds.Options.Integers,
+		Lua53Operators:      ds.Options.Lua53Operators,
+		Goto:                ds.Options.Goto,
+
+		Checkpoint:              d.opts.Checkpoint,
+		InstructionLimit:        d.opts.InstructionLimit,
+		PauseOnInstructionLimit: d.opts.PauseOnInstructionLimit,
+		MemoryLimit:             d.opts.MemoryLimit,
 	}
 	s.stop = ds.Stop
 	s.reg, err = d.loadRegistry(ds.Reg)
@@ -215,23 +515,26 @@ func (d *dumpLoader) loadState(ptr dump.Ptr) (*LState, error) {
 	s.hasErrorFunc = ds.HasErrorFunc
 	s.Dead = ds.Dead
 	s.alloc = d.alloc
-	if s.Options.IncludeGoStackTrace {
-		s.Panic = panicWithTraceback
-	} else {
+	s.Panic = panicWithTraceback
+	if (d.Data.G == nil || ptr != d.Data.G.MainThread) && s.isStarted() { // a suspended coroutine, see coResume
 		s.Panic = panicWithoutTraceback
 	}
-	s.mainLoop = mainLoop
+	s.setMainLoop()
 	return s, nil
 }
 
 func (d *dumper) dumpGlobal(g *Global) {
-	if d.d.G != nil {
+	if d.d.G != nil || d.partial {
 		return
 	}
 	d.d.G = &dump.Global{}
 	d.d.G.Global = d.dumpTable(g.Global, "global", false)
-	d.d.G.MainThread = d.dumpState(g.MainThread, "mainThread", false)
-	d.d.G.CurrentThread = d.dumpState(g.CurrentThread, "curThread", false)
+	mainThread, curThread := g.MainThread, g.CurrentThread
+	if mainThread == nil { // nothing has run yet, the dumped state becomes the main thread
+		mainThread, curThread = d.root, d.root
+	}
+	d.d.G.MainThread = d.dumpState(mainThread, "mainThread", false)
+	d.d.G.CurrentThread = d.dumpState(curThread, "curThread", false)
 	d.d.G.Registry = d.dumpTable(g.Registry, "reg", false)
 	d.d.G.Gccount = g.gccount
 	d.d.G.BuiltinMts = map[string]dump.Value{}
@@ -245,7 +548,7 @@ func (d *dumper) dumpGlobal(g *Global) {
 }
 
 func (d *dumpLoader) loadGlobal(ptr dump.Ptr) (*Global, error) {
-	if d.G.MainThread != nil {
+	if d.G.MainThread != nil || d.Data.G == nil {
 		return d.G, nil
 	}
 	var err error
@@ -405,17 +708,14 @@ func (d *dumper) dumpCallFrameStack(cfs *callFrameStack, name string) (ptr dump.
 	d.d.CallFrameStacks[ptr] = &dcfs // avoid infinite recursion
 
 	dcfs.Sp = cfs.sp
-	dcfs.Array = make([]dump.Ptr, len(cfs.array))
-	for i, v := range cfs.array {
-		dcfs.Array[i] = d.dumpCallFrame(&v, fmt.Sprintf("%v.arr.[%v]", ptr, i))
+	// skip empty frames to save dump space
+	n := len(cfs.array)
+	for n > 0 && cfs.array[n-1].Fn == nil {
+		n--
 	}
-	// skip empty values to save dump space
-	for i := len(dcfs.Array) - 1; i >= 0; i-- {
-		if cfs.array[i].Fn == nil {
-			continue
-		}
-		dcfs.Array = dcfs.Array[:i+1]
-		break
+	dcfs.Array = make([]dump.Ptr, n)
+	for i := range dcfs.Array {
+		dcfs.Array[i] = d.dumpCallFrame(&cfs.array[i], fmt.Sprintf("%v.arr.[%v]", ptr, i))
 	}
 	dcfs.Len = len(cfs.array)
 	return
@@ -501,8 +801,11 @@ func (d *dumper) dumpFunction(f *LFunction, name string, initonly bool) (ptr dum
 	if f == nil {
 		return
 	}
+	if ptr, ok := d.external(f); ok {
+		return ptr
+	}
 	ptr = d.getPtr(f, name)
-	_, ok := d.d.Upvalues[ptr]
+	_, ok := d.d.Functions[ptr]
 	if ok && d.dumped[ptr] {
 		return
 	}
@@ -516,7 +819,10 @@ func (d *dumper) dumpFunction(f *LFunction, name string, initonly bool) (ptr dum
 	df.IsG = f.IsG
 	df.Env = d.dumpTable(f.Env, string(ptr)+".env", false)
 	if df.IsG {
-		df.GFunction = d.dumpGFunction(f.GFunction)
+		df.GFunction = d.opts.GFunctions.dumpName(f.GFunction)
+		if d.fork != nil {
+			d.fork.gfunctions[ptr] = f.GFunction
+		}
 	}
 	df.Proto = d.dumpFunctionProto(f.Proto, string(ptr)+".proto")
 	df.Upvalues = make([]dump.Ptr, len(f.Upvalues))
@@ -539,10 +845,11 @@ func (d *dumpLoader) loadFunction(ptr dump.Ptr) (*LFunction, error) {
 	d.Loaded[id] = true
 	var err error
 	f.IsG = df.IsG
-	if f.IsG {
-		f.GFunction, err = d.parseFunction(df.GFunction)
-		if err != nil {
-			return nil, err
+	if f.IsG && d.fork != nil {
+		f.GFunction = d.fork.gfunctions[ptr]
+	} else if f.IsG {
+		if f.GFunction, err = d.opts.GFunctions.loadFunc(df.GFunction); err != nil {
+			d.fail("Functions", ptr, "GFunction", err)
 		}
 	}
 	f.Env, err = d.loadTable(df.Env)
@@ -574,8 +881,15 @@ func (d *dumper) dumpFunctionProto(fp *FunctionProto, name string) (ptr dump.Ptr
 	if ok {
 		return
 	}
-	dfp := dump.FunctionProto{}
+	hash, _ := protoHash(fp) // prototypes without a hash are saved in full
+	dfp := dump.FunctionProto{Hash: hash}
 	d.d.FunctionProtos[ptr] = &dfp // avoid infinite recursion
+	if d.fork != nil {
+		d.fork.protos[ptr] = fp
+	}
+	if d.opts.Protos != nil && d.storeProto(fp) {
+		return // the store keeps the content
+	}
 
 	dfp.SourceName = fp.SourceName
 	dfp.LineDefined = fp.LineDefined
@@ -624,7 +938,20 @@ func (d *dumpLoader) loadFunctionProto(ptr dump.Ptr) (*FunctionProto, error) {
 		return fp, nil
 	}
 	d.Loaded[id] = true
+	if d.fork != nil && d.fork.protos[ptr] != nil {
+		d.FunctionProtos[ptr] = d.fork.protos[ptr]
+		return d.FunctionProtos[ptr], nil
+	}
 	var err error
+	if dfp.InStore() {
+		stored, err := d.loadStoredProto(dfp.Hash)
+		if err != nil {
+			d.fail("FunctionProtos", ptr, "Hash", err)
+			return fp, nil
+		}
+		d.FunctionProtos[ptr] = stored
+		return stored, nil
+	}
 	fp.SourceName = dfp.SourceName
 	fp.LineDefined = dfp.LineDefined
 	fp.LastLineDefined = dfp.LastLineDefined
@@ -664,7 +991,14 @@ func (d *dumpLoader) loadFunctionProto(ptr dump.Ptr) (*FunctionProto, error) {
 			return nil, err
 		}
 	}
-
+	if dfp.Hash != "" {
+		if hash, err := protoHash(fp); err != nil || hash != dfp.Hash {
+			d.fail("FunctionProtos", ptr, "Hash", fmt.Errorf("content does not match hash %v", dfp.Hash))
+			return fp, nil
+		}
+	}
+	fp = d.protos.share(fp)
+	d.FunctionProtos[ptr] = fp
 	return fp, nil
 }
 
@@ -709,6 +1043,9 @@ func (d *dumper) dumpTable(t *LTable, name string, initonly bool) (ptr dump.Ptr)
 	if t == nil {
 		return
 	}
+	if ptr, ok := d.external(t); ok {
+		return ptr
+	}
 	ptr = d.getPtr(t, name)
 	_, ok := d.d.Tables[ptr]
 	if ok && d.dumped[ptr] {
@@ -728,16 +1065,22 @@ func (d *dumper) dumpTable(t *LTable, name string, initonly bool) (ptr dump.Ptr)
 	for i, v := range t.array {
 		dt.Array[i] = d.dumpLValue(v, fmt.Sprintf("%v.[%v]", ptr, i), false)
 	}
-	dt.Dict = []dump.VV{}
-	for k, v := range t.dict {
-		dt.Dict = append(dt.Dict, dump.VV{ // init pointers first to make them beautiful and consistent
-			Key:   d.dumpLValue(k, fmt.Sprintf("%v.[%v].key", ptr, len(dt.Dict)), true),
-			Value: d.dumpLValue(v, fmt.Sprintf("%v.[%v].value", ptr, len(dt.Dict)), true)})
+	dictKeys := []LValue{} // t.keys order keeps the dump stable across calls
+	for _, k := range t.keys {
+		if _, ok := t.dict[k]; ok {
+			dictKeys = append(dictKeys, k)
+		}
 	}
-	for k, v := range t.dict {
-		dt.Dict = append(dt.Dict, dump.VV{
-			Key:   d.dumpLValue(k, fmt.Sprintf("%v.[%v].key", ptr, len(dt.Dict)), false),
-			Value: d.dumpLValue(v, fmt.Sprintf("%v.[%v].value", ptr, len(dt.Dict)), false)})
+	dt.Dict = make([]dump.VV, len(dictKeys))
+	for i, k := range dictKeys { // init pointers first to make them beautiful and consistent
+		dt.Dict[i] = dump.VV{
+			Key:   d.dumpLValue(k, fmt.Sprintf("%v.[%v].key", ptr, i), true),
+			Value: d.dumpLValue(t.dict[k], fmt.Sprintf("%v.[%v].value", ptr, i), true)}
+	}
+	for i, k := range dictKeys {
+		dt.Dict[i] = dump.VV{
+			Key:   d.dumpLValue(k, fmt.Sprintf("%v.[%v].key", ptr, i), false),
+			Value: d.dumpLValue(t.dict[k], fmt.Sprintf("%v.[%v].value", ptr, i), false)}
 	}
 	dt.Strdict = map[string]dump.Value{}
 	for k, v := range t.strdict { // init pointers first to make them beautiful and consistent
@@ -755,7 +1098,7 @@ func (d *dumpLoader) loadTable(ptr dump.Ptr) (*LTable, error) {
 	}
 	t, ok := d.Tables[ptr]
 	if !ok {
-		return nil, fmt.Errorf("table not found! %v %v %#v", ok, ptr, d.Tables)
+		return nil, fmt.Errorf("table %q not found", ptr)
 	}
 	dt := d.Data.Tables[ptr]
 	id := fmt.Sprint("table-", ptr)
@@ -763,6 +1106,7 @@ func (d *dumpLoader) loadTable(ptr dump.Ptr) (*LTable, error) {
 		return t, nil
 	}
 	d.Loaded[id] = true
+	t.mem = &d.G.mem
 	var err error
 	t.Metatable, err = d.loadLValue(dt.Metatable)
 	if err != nil {
@@ -808,6 +1152,9 @@ func (d *dumper) dumpUserData(t *LUserData, name string, initonly bool) (ptr dum
 	if t == nil {
 		return
 	}
+	if ptr, ok := d.external(t); ok {
+		return ptr
+	}
 	ptr = d.getPtr(t, name)
 	_, ok := d.d.UserData[ptr]
 	if ok && d.dumped[ptr] {
@@ -819,7 +1166,27 @@ func (d *dumper) dumpUserData(t *LUserData, name string, initonly bool) (ptr dum
 		return
 	}
 	d.dumped[ptr] = true
-	ud = d.dumpData(t.Value)
+	if d.fork != nil {
+		ud = dump.UserData{Type: fmt.Sprintf("%T", t.Value)}
+		d.fork.userData[ptr] = t.Value
+	} else if file, ok := t.Value.(*lFile); ok {
+		ud = dump.UserData{Type: lFileClass}
+		if df := d.dumpFile(file); df != nil {
+			d.d.Files[ptr] = df
+		}
+	} else if v, ok := t.Value.(LuaDumpable); ok {
+		ud = v.LuaDump()
+	} else if d.opts.UserData == nil { // only the type of the value is saved
+		ud = dump.UserData{Type: fmt.Sprintf("%T", t.Value)}
+	} else {
+		ud = d.opts.UserData(t.Value)
+	}
+	if name, ok := d.typeMetatable(t.Metatable); ok {
+		ud.TypeMetatable = name
+	} else {
+		ud.Metatable = d.dumpLValue(t.Metatable, string(ptr)+".meta", false)
+	}
+	ud.Env = d.dumpTable(t.Env, string(ptr)+".env", false)
 	return
 }
 
@@ -829,7 +1196,7 @@ func (d *dumpLoader) loadUserData(ptr dump.Ptr) (*LUserData, error) {
 	}
 	t, ok := d.UserData[ptr]
 	if !ok {
-		log.Printf("userdata not found! %v %v %#v", ok, ptr, d.Tables)
+		return nil, fmt.Errorf("userdata %q not found", ptr)
 	}
 	dt := d.Data.UserData[ptr]
 	id := fmt.Sprint("userdata-", ptr)
@@ -838,32 +1205,334 @@ func (d *dumpLoader) loadUserData(ptr dump.Ptr) (*LUserData, error) {
 	}
 	d.Loaded[id] = true
 	var err error
-	t, err = d.parseData(d.G.MainThread, *dt)
-	if err != nil {
-		return nil, err
+	if d.fork != nil {
+		t.Value = d.fork.userData[ptr]
+	} else if dt.Type == lFileClass {
+		t.Value = d.loadFile(ptr)
+	} else if fn, ok := d.opts.UserDataTypes[dt.Type]; ok {
+		if t.Value, err = fn(d.loadingState(), *dt); err != nil {
+			d.fail("UserData", ptr, "", err)
+		}
+	} else if d.opts.UserData != nil {
+		// t may already be referenced by loaded objects, so it is kept
+		if parsed, err := d.opts.UserData(d.loadingState(), *dt); err != nil {
+			d.fail("UserData", ptr, "", err)
+		} else if parsed != nil {
+			*t = *parsed
+		}
+	}
+	if t.Metatable == nil || dt.Metatable != (dump.Value{}) {
+		if t.Metatable, err = d.loadLValue(dt.Metatable); err != nil {
+			return nil, err
+		}
+	}
+	if dt.Env != "" {
+		if t.Env, err = d.loadTable(dt.Env); err != nil {
+			return nil, err
+		}
+	}
+	if dt.TypeMetatable != "" {
+		d.typed = append(d.typed, ptr) // the registry may not be loaded yet
 	}
 	return t, nil
 }
 
-func (d dumper) getPtr(ptr interface{}, prefix string) dump.Ptr {
-	v := reflect.ValueOf(ptr)
-	if v.IsNil() {
-		return "nil"
+// loadingState returns the state passed to userdata restore functions.
+func (d *dumpLoader) loadingState() *LState {
+	if d.L != nil {
+		return d.L
+	}
+	return d.G.MainThread
+}
+
+// setFinalizers registers the __gc metamethods of the loaded userdata. The
+// userdata of a fork share their values with the original state, which
+// keeps finalizing them.
+func (d *dumpLoader) setFinalizers() {
+	if d.fork != nil {
+		return
+	}
+	for _, ud := range d.UserData {
+		d.G.setFinalizer(ud)
+	}
+}
+
+// attachTypeMetatables attaches type metatables to the loaded userdata
+// that were saved with them, once the registry is loaded.
+func (d *dumpLoader) attachTypeMetatables() {
+	for _, ptr := range d.typed {
+		name := d.Data.UserData[ptr].TypeMetatable
+		mt, ok := d.G.Registry.RawGetString(name).(*LTable)
+		if !ok {
+			d.fail("UserData", ptr, "TypeMetatable", fmt.Errorf("type metatable %q is not registered", name))
+			continue
+		}
+		d.UserData[ptr].Metatable = mt
+	}
+}
+
+// typeMetatable returns the name mt is registered under by
+// NewTypeMetatable, if it is a type metatable.
+func (d *dumper) typeMetatable(mt LValue) (string, bool) {
+	tb, ok := mt.(*LTable)
+	if !ok {
+		return "", false
+	}
+	if d.typeNames == nil {
+		d.typeNames = make(map[*LTable]string)
+		reg := d.root.G.Registry
+		names := make([]string, 0, len(reg.strdict))
+		for name := range reg.strdict {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if t, ok := reg.strdict[name].(*LTable); ok {
+				if _, seen := d.typeNames[t]; !seen {
+					d.typeNames[t] = name
+				}
+			}
+		}
+	}
+	name, ok := d.typeNames[tb]
+	return name, ok
+}
+
+// dumpChannel saves a channel with its buffered values, see
+// channelContents. Channels that can not be read without changing them are
+// saved with an error, which makes the snapshot fail to load.
+// Fork shares channels between the state and its copy.
+func (d *dumper) dumpChannel(ch LChannel, name string, initonly bool) (ptr dump.Ptr) {
+	if ch == nil {
+		return
+	}
+	if ptr, ok := d.external(ch); ok {
+		return ptr
+	}
+	ptr = d.getPtr(ch, name)
+	_, ok := d.d.Channels[ptr]
+	if ok && d.dumped[ptr] {
+		return
+	}
+	dc := dump.Channel{Cap: cap(ch)}
+	d.d.Channels[ptr] = &dc // avoid infinite recursion
+	if initonly {
+		return
+	}
+	d.dumped[ptr] = true
+	if d.fork != nil {
+		d.fork.channels[ptr] = ch
+		return
+	}
+	values, closed, err := channelContents(ch)
+	if err != nil {
+		dc.Error = err.Error()
+		return
+	}
+	dc.Closed = closed
+	dc.Values = make([]dump.Value, len(values))
+	for i, v := range values { // init pointers first to make them beautiful and consistent
+		dc.Values[i] = d.dumpLValue(v, fmt.Sprintf("%v.[%v]", ptr, i), true)
+	}
+	for i, v := range values {
+		dc.Values[i] = d.dumpLValue(v, fmt.Sprintf("%v.[%v]", ptr, i), false)
+	}
+	return
+}
+
+// channelContents returns the buffered values of ch and whether it is
+// closed, and leaves ch as it was. The buffer can only be read by receiving,
+// so values are received and sent back: channels must not be used by other
+// goroutines while the state is dumped. Unbuffered and full channels are
+// refused because goroutines blocked sending to them would slip their
+// values in, and closed channels with buffered values because their values
+// can not be sent back.
+func channelContents(ch LChannel) ([]LValue, bool, error) {
+	n := len(ch)
+	switch {
+	case cap(ch) == 0:
+		return nil, false, errors.New("unbuffered channels can not be saved")
+	case n == cap(ch):
+		return nil, false, errors.New("full channels can not be saved")
+	case n == 0:
+		// no sender is blocked while there is room in the buffer
+		select {
+		case v, ok := <-ch:
+			if !ok {
+				return nil, true, nil
+			}
+			ch <- v // sent meanwhile
+			return []LValue{v}, false, nil
+		default:
+			return nil, false, nil
+		}
+	}
+	if !sendProbe(ch) {
+		return nil, true, errors.New("closed channels with buffered values can not be saved")
+	}
+	values := make([]LValue, n)
+	for i := range values {
+		values[i] = <-ch
+	}
+	<-ch // the probe
+	for _, v := range values {
+		ch <- v
+	}
+	return values, false, nil
+}
+
+// sendProbe sends nil to ch, which has room for it, and reports whether ch
+// was open.
+func sendProbe(ch LChannel) (open bool) {
+	defer func() {
+		if recover() != nil {
+			open = false
+		}
+	}()
+	ch <- LNil
+	return true
+}
+
+func (d *dumpLoader) loadChannel(ptr dump.Ptr) (LChannel, error) {
+	if ptr == "" {
+		return nil, nil
+	}
+	ch, ok := d.Channels[ptr]
+	if !ok {
+		return nil, fmt.Errorf("channel %q not found", ptr)
+	}
+	dc := d.Data.Channels[ptr]
+	id := fmt.Sprint("channel-", ptr)
+	if d.Loaded[id] || d.fork != nil {
+		return ch, nil
+	}
+	d.Loaded[id] = true
+	for _, v := range dc.Values {
+		lv, err := d.loadLValue(v)
+		if err != nil {
+			return nil, err
+		}
+		ch <- lv
+	}
+	if dc.Closed {
+		close(ch)
+	}
+	return ch, nil
+}
+
+// dumpFile saves a file of the io library. Processes, closed files and
+// files that can not be saved are loaded as closed files.
+func (d *dumper) dumpFile(f *lFile) *dump.File {
+	if f.closed || f.Type() != lFileFile {
+		return nil
+	}
+	df := &dump.File{}
+	if w, ok := f.writer.(*bufio.Writer); ok {
+		w.Flush() // saved offsets and contents must include buffered data
+		df.Buffer = w.Size()
+	}
+	for _, std := range stdFiles {
+		if f.fp == std.file {
+			df.Std = std.name
+			return df
+		}
+	}
+	if !d.opts.Files {
+		return nil
+	}
+	offset, err := f.fp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil
+	}
+	if f.reader != nil {
+		offset -= int64(f.reader.Buffered())
+	}
+	df.Offset = offset
+	if d.root.G.isTempFile(f.fp) {
+		df.Temp = true
+		if df.Content, err = ioutil.ReadFile(f.fp.Name()); err != nil {
+			return nil
+		}
+		return df
+	}
+	df.Path = f.fp.Name()
+	for _, option := range ioOpenOpions {
+		if flag, _, _ := ioOpenFlags(option); flag == f.flag {
+			df.Mode = option
+			break
+		}
+	}
+	return df
+}
+
+// loadFile restores a file of the io library. Files that were not saved or
+// can no longer be opened, e.g. because they were deleted, are loaded as
+// closed files. Other errors, such as failing to recreate a temp file or to
+// seek to the saved offset, are recorded.
+func (d *dumpLoader) loadFile(ptr dump.Ptr) *lFile {
+	df := d.Data.Files[ptr]
+	if df == nil || (df.Std == "" && !d.opts.Files) {
+		return &lFile{closed: true}
+	}
+	var fp *os.File
+	var flag int
+	var err error
+	writable, readable := true, true
+	switch {
+	case df.Std != "":
+		for _, std := range stdFiles {
+			if std.name == df.Std {
+				fp, writable, readable = std.file, std.writable, std.readable
+			}
+		}
+		if fp == nil {
+			err = fmt.Errorf("unknown standard stream %q", df.Std)
+		}
+	case df.Temp:
+		if fp, err = ioutil.TempFile("", ""); err == nil {
+			d.G.tempFiles = append(d.G.tempFiles, fp)
+			_, err = fp.Write(df.Content)
+		}
+	default:
+		flag, writable, readable = ioOpenFlags(df.Mode)
+		// the file must still exist and must not be truncated
+		if fp, err = os.OpenFile(df.Path, flag&^(os.O_CREATE|os.O_TRUNC), 0600); err != nil {
+			return &lFile{closed: true}
+		}
+	}
+	if err == nil && df.Std == "" {
+		_, err = fp.Seek(df.Offset, io.SeekStart)
+	}
+	if err != nil {
+		d.fail("Files", ptr, "", err)
+		return &lFile{closed: true}
+	}
+	f := &lFile{fp: fp, flag: flag}
+	if writable {
+		f.writer = fp
+		if df.Buffer > 0 {
+			f.writer = bufio.NewWriterSize(fp, df.Buffer)
+		}
 	}
-	strPtr := fmt.Sprint(v.Type(), "-", v.Pointer())
-	alias := d.ptrMap[strPtr]
-	if alias != "" {
-		return dump.Ptr(alias)
+	if readable {
+		f.reader = bufio.NewReaderSize(fp, fileDefaultReadBuffer)
 	}
+	return f
+}
 
-	count := d.prefixCount[prefix]
-	d.prefixCount[prefix]++
-	alias = fmt.Sprintf("%v-%v", prefix, count)
-	if count == 0 && prefix != "" {
-		alias = fmt.Sprintf("%v", prefix)
+func (d *dumper) getPtr(ptr interface{}, prefix string) dump.Ptr {
+	if reflect.ValueOf(ptr).IsNil() {
+		return "nil"
 	}
-	d.ptrMap[strPtr] = alias
-	return dump.Ptr(alias)
+	if alias, ok := d.ptrMap[ptr]; ok {
+		return alias
+	}
+	alias, ok := d.ids.get(ptr)
+	if !ok {
+		alias = d.ids.newPtr(prefix)
+	}
+	d.ptrMap[ptr] = alias
+	return alias
 }
 
 type dumpLoader struct {
@@ -874,6 +1543,7 @@ type dumpLoader struct {
 	States          map[dump.Ptr]*LState
 	Tables          map[dump.Ptr]*LTable
 	UserData        map[dump.Ptr]*LUserData
+	Channels        map[dump.Ptr]LChannel
 	CallFrames      map[dump.Ptr]*callFrame
 	CallFrameStacks map[dump.Ptr]*callFrameStack
 	Registries      map[dump.Ptr]*registry
@@ -883,8 +1553,11 @@ type dumpLoader struct {
 	Upvalues        map[dump.Ptr]*Upvalue
 	cfParents       map[*callFrame]*callFrame
 	alloc           *allocator
-	parseData       ParseUserData
-	parseFunction   ParseGFunction
+	opts            LoadOptions
+	L               *LState // state a partial snapshot is loaded into
+	fork            *forkValues
+	protos          *ProtoCache
+	typed           []dump.Ptr // userdata with type metatables
 }
 
 func (d *dumpLoader) init() {
@@ -901,6 +1574,11 @@ func (d *dumpLoader) init() {
 	d.Upvalues = make(map[dump.Ptr]*Upvalue)
 	d.cfParents = make(map[*callFrame]*callFrame)
 	d.UserData = make(map[dump.Ptr]*LUserData)
+	d.Channels = make(map[dump.Ptr]LChannel)
+	d.protos = d.opts.ProtoCache
+	if d.protos == nil {
+		d.protos = NewProtoCache()
+	}
 	d.G = &Global{}
 	for k := range d.Data.States {
 		d.States[k] = &LState{}
@@ -932,16 +1610,369 @@ func (d *dumpLoader) init() {
 	for k := range d.Data.UserData {
 		d.UserData[k] = &LUserData{}
 	}
+	for k, dc := range d.Data.Channels {
+		if d.fork != nil {
+			d.Channels[k] = d.fork.channels[k]
+		} else {
+			d.Channels[k] = make(LChannel, dc.Cap)
+		}
+	}
 }
 
 type ParseUserData func(*LState, dump.UserData) (*LUserData, error)
 type DumpUserData func(interface{}) dump.UserData
 
-type ParseGFunction func(dump.Ptr) (LGFunction, error)
-type DumpGFunction func(interface{}) dump.Ptr
+// LuaDumpable is implemented by userdata values that save themselves in
+// snapshots. Dump uses it instead of DumpOptions.UserData.
+type LuaDumpable interface {
+	// LuaDump returns the saved form of the value. Its Type selects the
+	// function of LoadOptions.UserDataTypes that restores it.
+	LuaDump() dump.UserData
+}
+
+// UserDataTypes restore userdata values by their dump.UserData.Type. Values
+// of other types are restored by LoadOptions.UserData.
+type UserDataTypes map[string]func(L *LState, ud dump.UserData) (interface{}, error)
+
+// Register registers the function that restores values of type typ.
+func (t UserDataTypes) Register(typ string, fn func(L *LState, ud dump.UserData) (interface{}, error)) {
+	t[typ] = fn
+}
+
+// LoadDump restores a state from a snapshot.
+//
+// If LoadOptions.Verifier is set, the signature of the snapshot is checked
+// first. Snapshots of older schema versions are upgraded by
+// LoadOptions.Migrations. Snapshots made by a runtime with another
+// LuaVersion or an instruction set this one does not extend are refused
+// after the migrations ran, so a migration that upgrades them sets
+// dump.Data.LuaVersion and dump.Data.OpCodeHash to LuaVersion and
+// OpCodeHash. The snapshot is then checked by dump.Validate. All problems found by the validation or while
+// loading are returned as dump.Errors.
+func LoadDump(d dump.Data, opts ...LoadOptions) (*LState, error) {
+	ld, err := newDumpLoader(d, opts)
+	if err != nil {
+		return nil, err
+	}
+	if ld.Data.G == nil {
+		return nil, fmt.Errorf("dump: partial snapshot must be loaded by LoadValue")
+	}
+	return ld.load(ld.Data.G.CurrentThread)
+}
+
+// Fork returns an independent copy of the state with its globals, closures,
+// upvalues and suspended coroutines.
+//
+// The state is copied by the same walk as Dump, but without encoding
+// anything: Go functions and userdata values are shared with the copy, so
+// they need not be registered and files opened by the io library refer to
+// the same open files in both states.
+//
+// The copy has the options, checkpoint policy, remaining instruction budget,
+// memory limit and hooks of the state. Its journal is reset, so the calls of
+// the copy are not mixed into the journal of the state.
+func (ls *LState) Fork() (*LState, error) {
+	d := ls.newDumper(nil)
+	d.fork = newForkValues()
+	root := d.dumpState(ls, "dumpState", false)
+	hooks := d.dumpHooks()
+	ld := &dumpLoader{Data: d.d, opts: d.loadOptions(), fork: d.fork}
+	L, err := ld.load(root)
+	if err != nil {
+		return nil, err
+	}
+	L.G.budget = nil
+	if b := ls.G.budget; b != nil {
+		L.G.budget = &instructionBudget{remaining: b.remaining, pause: b.pause}
+	}
+	for ptr, h := range hooks {
+		th := ld.States[ptr]
+		fn, luaFn := h.fn, (*LFunction)(nil)
+		if h.luaFn != nil {
+			luaFn = ld.Functions[d.ptrMap[h.luaFn]]
+			fn = luaHook(luaFn)
+		}
+		th.SetHook(h.mask, h.count, fn)
+		th.hook.luaFn, th.hook.counter = luaFn, h.counter
+	}
+	for _, th := range ld.States {
+		th.setMainLoop()
+	}
+	return L, nil
+}
+
+// dumpHooks returns the hooks of the dumped threads, and dumps the functions
+// set by debug.sethook that are not reachable otherwise.
+func (d *dumper) dumpHooks() map[dump.Ptr]*debugHook {
+	hooks := make(map[dump.Ptr]*debugHook)
+	for found := true; found; {
+		found = false
+		for obj, ptr := range d.ptrMap {
+			th, ok := obj.(*LState)
+			if !ok || th.hook == nil || hooks[ptr] != nil {
+				continue
+			}
+			hooks[ptr] = th.hook
+			if th.hook.luaFn != nil {
+				// the function may reach threads not found yet
+				d.dumpFunction(th.hook.luaFn, ".hook", false)
+				found = true
+			}
+		}
+	}
+	return hooks
+}
+
+// forkValues holds Go values Fork passes to the copy as they are.
+type forkValues struct {
+	userData   map[dump.Ptr]interface{}
+	gfunctions map[dump.Ptr]LGFunction
+	channels   map[dump.Ptr]LChannel
+	protos     map[dump.Ptr]*FunctionProto
+}
+
+func newForkValues() *forkValues {
+	return &forkValues{
+		userData:   make(map[dump.Ptr]interface{}),
+		gfunctions: make(map[dump.Ptr]LGFunction),
+		channels:   make(map[dump.Ptr]LChannel),
+		protos:     make(map[dump.Ptr]*FunctionProto),
+	}
+}
+
+func (d *dumper) loadOptions() LoadOptions {
+	return LoadOptions{
+		GFunctions:              d.opts.GFunctions,
+		Files:                   d.opts.Files,
+		Checkpoint:              d.root.Options.Checkpoint,
+		InstructionLimit:        d.root.Options.InstructionLimit,
+		PauseOnInstructionLimit: d.root.Options.PauseOnInstructionLimit,
+		MemoryLimit:             d.root.G.mem.limit,
+	}
+}
+
+// load restores the state stored under ptr and the objects reachable from it.
+func (d *dumpLoader) load(ptr dump.Ptr) (L *LState, err error) {
+	defer func() {
+		if rcv := recover(); rcv != nil {
+			L, err = nil, dump.Errors(append(d.Errors, fmt.Errorf("dump: failed to load snapshot: %v", rcv)))
+		}
+	}()
+	d.init()
+	if d.opts.Checkpoint != nil {
+		d.G.checkpoints = newCheckpointer(d.opts.Checkpoint)
+	}
+	if d.opts.InstructionLimit > 0 {
+		d.G.budget = &instructionBudget{remaining: d.opts.InstructionLimit, pause: d.opts.PauseOnInstructionLimit}
+	}
+	d.G.journal = d.opts.Journal
+	L, err = d.loadState(ptr)
+	if err != nil {
+		d.Errors = append(d.Errors, err)
+	} else {
+		d.attachTypeMetatables()
+		d.setFinalizers()
+	}
+	if len(d.Errors) > 0 {
+		return nil, dump.Errors(d.Errors)
+	}
+	d.G.ids = d.identity()
+	L.countMemory(false)
+	L.SetMemoryLimit(d.opts.MemoryLimit)
+	return L, nil
+}
 
-func LoadDump(d dump.Data, pd ParseUserData, pf ParseGFunction) (*LState, error) {
-	ld := dumpLoader{Data: d, parseData: pd, parseFunction: pf}
+// LoadValue restores a value from a partial snapshot made by DumpValue.
+// Objects are created in L, references to externals are bound to the
+// objects of LoadOptions.Externals with the same names.
+// Snapshots are checked like in LoadDump.
+func LoadValue(L *LState, d dump.Data, opts ...LoadOptions) (lv LValue, err error) {
+	ld, err := newDumpLoader(d, opts)
+	if err != nil {
+		return nil, err
+	}
+	if ld.Data.G != nil {
+		return nil, fmt.Errorf("dump: full snapshot must be loaded by LoadDump")
+	}
+	defer func() {
+		if rcv := recover(); rcv != nil {
+			lv, err = nil, dump.Errors(append(ld.Errors, fmt.Errorf("dump: failed to load snapshot: %v", rcv)))
+		}
+	}()
 	ld.init()
-	return ld.loadState(ld.Data.G.CurrentThread)
+	ld.G, ld.L = L.G, L
+	ld.opts.InstructionLimit = L.Options.InstructionLimit
+	ld.opts.PauseOnInstructionLimit = L.Options.PauseOnInstructionLimit
+	ld.opts.MemoryLimit = L.Options.MemoryLimit
+	externals := ld.opts.Externals
+	if externals == nil {
+		externals = L.Externals()
+	}
+	ld.bindExternals(externals)
+	lv, err = ld.loadLValue(ld.Data.Root)
+	if err != nil {
+		ld.Errors = append(ld.Errors, err)
+	} else {
+		ld.attachTypeMetatables()
+		ld.setFinalizers()
+	}
+	if len(ld.Errors) > 0 {
+		return nil, dump.Errors(ld.Errors)
+	}
+	return lv, nil
+}
+
+// newDumpLoader verifies, migrates, checks and validates a snapshot.
+func newDumpLoader(d dump.Data, opts []LoadOptions) (*dumpLoader, error) {
+	var opt LoadOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	if opt.Verifier != nil {
+		if err := dump.Verify(d, opt.Verifier); err != nil {
+			return nil, err
+		}
+	}
+	d, err := opt.Migrations.Migrate(d)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDumpVersion(d); err != nil {
+		return nil, err
+	}
+	if errs := dump.Validate(d); len(errs) > 0 {
+		return nil, dump.Errors(errs)
+	}
+	if opt.GFunctions == nil {
+		opt.GFunctions = NewGFunctionRegistry()
+	}
+	return &dumpLoader{Data: d, opts: opt}, nil
+}
+
+// bindExternals makes references to externals resolve to existing objects.
+// Unbound externals are reported and replaced by empty objects.
+func (d *dumpLoader) bindExternals(externals map[string]LValue) {
+	for _, ptr := range sortedDumpPtrs(d.Data.Externals) {
+		ext := d.Data.Externals[ptr]
+		lv, ok := externals[ext.Name]
+		if !ok || lv == nil {
+			d.fail("Externals", ptr, "", fmt.Errorf("external %q is not bound", ext.Name))
+		} else if lv.Type() != LValueType(ext.Type) {
+			d.fail("Externals", ptr, "", fmt.Errorf("external %q is a %v, but %v expected", ext.Name, lv.Type(), LValueType(ext.Type)))
+			lv = nil
+		}
+		switch LValueType(ext.Type) {
+		case LTFunction:
+			f, _ := lv.(*LFunction)
+			if f == nil {
+				f = &LFunction{}
+			}
+			d.Functions[ptr] = f
+			d.Loaded[fmt.Sprint("function-", ptr)] = true
+		case LTThread:
+			s, _ := lv.(*LState)
+			if s == nil {
+				s = &LState{}
+			}
+			d.States[ptr] = s
+			d.Loaded[fmt.Sprint("lstate-", ptr)] = true
+		case LTTable:
+			t, _ := lv.(*LTable)
+			if t == nil {
+				t = newLTable(0, 0)
+			}
+			d.Tables[ptr] = t
+			d.Loaded[fmt.Sprint("table-", ptr)] = true
+		case LTChannel:
+			ch, _ := lv.(LChannel)
+			if ch == nil {
+				ch = make(LChannel)
+			}
+			d.Channels[ptr] = ch
+			d.Loaded[fmt.Sprint("channel-", ptr)] = true
+		case LTUserData:
+			ud, _ := lv.(*LUserData)
+			if ud == nil {
+				ud = &LUserData{}
+			}
+			d.UserData[ptr] = ud
+			d.Loaded[fmt.Sprint("userdata-", ptr)] = true
+		}
+	}
+}
+
+func sortedDumpPtrs(externals map[dump.Ptr]*dump.External) []dump.Ptr {
+	ptrs := make([]dump.Ptr, 0, len(externals))
+	for ptr := range externals {
+		ptrs = append(ptrs, ptr)
+	}
+	sort.Slice(ptrs, func(i, j int) bool { return ptrs[i] < ptrs[j] })
+	return ptrs
+}
+
+// checkDumpVersion refuses snapshots made by a runtime with another
+// instruction set, their code can not be run by this one. Code of the
+// instruction sets this one extends is run unchanged.
+func checkDumpVersion(d dump.Data) error {
+	if d.LuaVersion != LuaVersion || (d.OpCodeHash != OpCodeHash && !olderOpCodeHashes[d.OpCodeHash]) {
+		return fmt.Errorf("dump: snapshot was made by %q with instruction set %q, but this runtime is %q with instruction set %q",
+			d.LuaVersion, d.OpCodeHash, LuaVersion, OpCodeHash)
+	}
+	return nil
+}
+
+// fail records a problem of an object, loading goes on to find the others.
+func (d *dumpLoader) fail(kind string, ptr dump.Ptr, field string, err error) {
+	d.Errors = append(d.Errors, &dump.ValidationError{Kind: kind, Ptr: ptr, Field: field, Msg: err.Error()})
+}
+
+// identity maps loaded objects to the Ptrs they were loaded from. An
+// object loaded from several Ptrs, such as a proto shared through the
+// ProtoCache, keeps the lowest one, so the next Dump does not depend on the
+// map order.
+func (d *dumpLoader) identity() *dumpIdentity {
+	ids := newDumpIdentity()
+	set := func(obj interface{}, ptr dump.Ptr) {
+		if old, ok := ids.get(obj); !ok || ptr < old {
+			ids.set(obj, ptr)
+		}
+	}
+	for k, v := range d.States {
+		set(v, k)
+	}
+	for k, v := range d.Tables {
+		set(v, k)
+	}
+	for k, v := range d.UserData {
+		set(v, k)
+	}
+	for k, v := range d.Channels {
+		set(v, k)
+	}
+	for k, v := range d.CallFrames {
+		if moved, ok := d.cfParents[v]; ok { // frame was copied into a callFrameStack
+			set(moved, k)
+			continue
+		}
+		set(v, k)
+	}
+	for k, v := range d.CallFrameStacks {
+		set(v, k)
+	}
+	for k, v := range d.Registries {
+		set(v, k)
+	}
+	for k, v := range d.Functions {
+		set(v, k)
+	}
+	for k, v := range d.FunctionProtos {
+		set(v, k)
+	}
+	for k, v := range d.DbgLocalInfos {
+		set(v, k)
+	}
+	for k, v := range d.Upvalues {
+		set(v, k)
+	}
+	return ids
 }
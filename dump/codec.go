@@ -0,0 +1,1084 @@
+package dump
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"sort"
+)
+
+/*
+Binary layout
+
+	magic   "GLDB"
+	version uvarint
+	section* (tag uvarint, length uvarint, payload)
+
+Strings, pointers, instruction streams and constant lists are stored once
+in their own sections and referenced everywhere else by uvarint ids.
+Id 0 always means "empty" (empty string, empty Ptr, nil slice).
+Decoders skip sections with unknown tags.
+*/
+
+const binaryMagic = "GLDB"
+
+// BinaryVersion is the version of the binary layout written by Encode.
+// Decode rejects snapshots of other versions.
+const BinaryVersion = 1
+
+const (
+	secStrings uint64 = iota + 1
+	secPtrs
+	secCodes
+	secConstants
+	secGlobal
+	secStates
+	secTables
+	secUserData
+	secCallFrames
+	secCallFrameStacks
+	secRegistries
+	secFunctions
+	secFunctionProtos
+	secDbgLocalInfos
+	secUpvalues
+	secFiles
+	secVersion
+	secRoot
+	secExternals
+	secChannels
+	secSignature
+)
+
+const (
+	valuePtr byte = 1 << iota
+	valueString
+	valueBool
+	valueNumber
+	valueInteger
+
+	valueFlags = valuePtr | valueString | valueBool | valueNumber | valueInteger
+)
+
+// ErrNotBinary is returned by Decode when the input does not start with the binary magic.
+var ErrNotBinary = errors.New("dump: not a binary snapshot")
+
+// IsBinary reports whether b starts with the magic written by Encode.
+func IsBinary(b []byte) bool {
+	return bytes.HasPrefix(b, []byte(binaryMagic))
+}
+
+/* encoder {{{ */
+
+type encoder struct {
+	out *bytes.Buffer
+
+	strs     map[string]uint64
+	strList  []string
+	ptrs     map[Ptr]uint64
+	ptrList  []Ptr
+	codes    map[string]uint64
+	codeBuf  []byte
+	consts   map[string]uint64
+	constBuf []byte
+}
+
+// Encode writes d to w in the compact binary format.
+// The output is deterministic: encoding equal Data values yields equal bytes.
+func Encode(w io.Writer, d Data) error {
+	e := &encoder{
+		strs:   map[string]uint64{"": 0},
+		ptrs:   map[Ptr]uint64{"": 0},
+		codes:  map[string]uint64{},
+		consts: map[string]uint64{},
+	}
+	var body bytes.Buffer
+	e.out = &body
+	if err := e.data(d); err != nil {
+		return err
+	}
+
+	var head bytes.Buffer
+	head.WriteString(binaryMagic)
+	writeUvarint(&head, BinaryVersion)
+
+	// pointers reference strings, so intern them before the string section is written
+	ptrIds := make([]uint64, len(e.ptrList))
+	for i, p := range e.ptrList {
+		ptrIds[i] = e.str(string(p))
+	}
+	e.section(&head, secStrings, func(b *bytes.Buffer) {
+		writeUvarint(b, uint64(len(e.strList)))
+		for _, s := range e.strList {
+			writeUvarint(b, uint64(len(s)))
+			b.WriteString(s)
+		}
+	})
+	e.section(&head, secPtrs, func(b *bytes.Buffer) {
+		writeUvarint(b, uint64(len(ptrIds)))
+		for _, id := range ptrIds {
+			writeUvarint(b, id)
+		}
+	})
+	e.section(&head, secCodes, func(b *bytes.Buffer) {
+		writeUvarint(b, uint64(len(e.codes)))
+		b.Write(e.codeBuf)
+	})
+	e.section(&head, secConstants, func(b *bytes.Buffer) {
+		writeUvarint(b, uint64(len(e.consts)))
+		b.Write(e.constBuf)
+	})
+	if _, err := w.Write(head.Bytes()); err != nil {
+		return err
+	}
+	_, err := w.Write(body.Bytes())
+	return err
+}
+
+func (e *encoder) section(w *bytes.Buffer, tag uint64, fn func(*bytes.Buffer)) {
+	var b bytes.Buffer
+	fn(&b)
+	writeUvarint(w, tag)
+	writeUvarint(w, uint64(b.Len()))
+	w.Write(b.Bytes())
+}
+
+func (e *encoder) str(s string) uint64 {
+	if id, ok := e.strs[s]; ok {
+		return id
+	}
+	e.strList = append(e.strList, s)
+	id := uint64(len(e.strList))
+	e.strs[s] = id
+	return id
+}
+
+func (e *encoder) ptr(p Ptr) uint64 {
+	if id, ok := e.ptrs[p]; ok {
+		return id
+	}
+	e.ptrList = append(e.ptrList, p)
+	id := uint64(len(e.ptrList))
+	e.ptrs[p] = id
+	return id
+}
+
+func (e *encoder) uvarint(v uint64)  { writeUvarint(e.out, v) }
+func (e *encoder) varint(v int64)    { writeVarint(e.out, v) }
+func (e *encoder) int(v int)         { writeVarint(e.out, int64(v)) }
+func (e *encoder) writeStr(s string) { e.uvarint(e.str(s)) }
+func (e *encoder) writePtr(p Ptr)    { e.uvarint(e.ptr(p)) }
+
+func (e *encoder) bool(v bool) {
+	if v {
+		e.out.WriteByte(1)
+	} else {
+		e.out.WriteByte(0)
+	}
+}
+
+func (e *encoder) value(v Value) {
+	var flags byte
+	if v.Ptr != "" {
+		flags |= valuePtr
+	}
+	if v.String != "" {
+		flags |= valueString
+	}
+	if v.Bool {
+		flags |= valueBool
+	}
+	if math.Float64bits(v.Number) != 0 { // keeps -0
+		flags |= valueNumber
+	}
+	if v.Integer {
+		flags |= valueInteger
+	}
+	e.int(v.Type)
+	e.out.WriteByte(flags)
+	if flags&valuePtr != 0 {
+		e.writePtr(v.Ptr)
+	}
+	if flags&valueString != 0 {
+		e.writeStr(v.String)
+	}
+	if flags&valueNumber != 0 {
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(v.Number))
+		e.out.Write(b[:])
+	}
+	if flags&valueInteger != 0 {
+		e.varint(v.Int)
+	}
+}
+
+func (e *encoder) values(vs []Value) {
+	e.uvarint(uint64(len(vs)))
+	for _, v := range vs {
+		e.value(v)
+	}
+}
+
+func (e *encoder) ptrSlice(ps []Ptr) {
+	e.uvarint(uint64(len(ps)))
+	for _, p := range ps {
+		e.writePtr(p)
+	}
+}
+
+func (e *encoder) strSlice(ss []string) {
+	e.uvarint(uint64(len(ss)))
+	for _, s := range ss {
+		e.writeStr(s)
+	}
+}
+
+func (e *encoder) intSlice(is []int) {
+	e.uvarint(uint64(len(is)))
+	for _, i := range is {
+		e.int(i)
+	}
+}
+
+// code interns an instruction stream and writes its id.
+func (e *encoder) code(code []uint32) {
+	if len(code) == 0 {
+		e.uvarint(0)
+		return
+	}
+	var b bytes.Buffer
+	writeUvarint(&b, uint64(len(code)))
+	for _, inst := range code {
+		writeUvarint(&b, uint64(inst))
+	}
+	key := b.String()
+	id, ok := e.codes[key]
+	if !ok {
+		id = uint64(len(e.codes) + 1)
+		e.codes[key] = id
+		e.codeBuf = append(e.codeBuf, b.Bytes()...)
+	}
+	e.uvarint(id)
+}
+
+// constants interns a constant list and writes its id.
+func (e *encoder) constants(vs []Value) {
+	if len(vs) == 0 {
+		e.uvarint(0)
+		return
+	}
+	out := e.out
+	var b bytes.Buffer
+	e.out = &b
+	e.values(vs)
+	e.out = out
+	key := b.String()
+	id, ok := e.consts[key]
+	if !ok {
+		id = uint64(len(e.consts) + 1)
+		e.consts[key] = id
+		e.constBuf = append(e.constBuf, b.Bytes()...)
+	}
+	e.uvarint(id)
+}
+
+// sortedPtrs returns the keys of one of the Data maps in a stable order.
+func sortedPtrs(m interface{}) []Ptr {
+	keys := reflect.ValueOf(m).MapKeys()
+	ptrs := make([]Ptr, len(keys))
+	for i, k := range keys {
+		ptrs[i] = Ptr(k.String())
+	}
+	sort.Slice(ptrs, func(i, j int) bool { return ptrs[i] < ptrs[j] })
+	return ptrs
+}
+
+func (e *encoder) data(d Data) error {
+	body := e.out
+	sec := func(tag uint64, n int, fn func()) {
+		if n == 0 {
+			return
+		}
+		var b bytes.Buffer
+		e.out = &b
+		e.uvarint(uint64(n))
+		fn()
+		e.out = body
+		writeUvarint(body, tag)
+		writeUvarint(body, uint64(b.Len()))
+		body.Write(b.Bytes())
+	}
+
+	if d.Version != 0 || d.LuaVersion != "" || d.OpCodeHash != "" {
+		sec(secVersion, 1, func() {
+			e.int(d.Version)
+			e.writeStr(d.LuaVersion)
+			e.writeStr(d.OpCodeHash)
+		})
+	}
+	if d.G != nil {
+		sec(secGlobal, 1, func() {
+			g := d.G
+			e.writePtr(g.MainThread)
+			e.writePtr(g.CurrentThread)
+			e.writePtr(g.Registry)
+			e.writePtr(g.Global)
+			keys := make([]string, 0, len(g.BuiltinMts))
+			for k := range g.BuiltinMts {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			e.uvarint(uint64(len(keys)))
+			for _, k := range keys {
+				e.writeStr(k)
+				e.value(g.BuiltinMts[k])
+			}
+			e.varint(int64(g.Gccount))
+		})
+	}
+	if d.Root != (Value{}) {
+		sec(secRoot, 1, func() {
+			e.value(d.Root)
+		})
+	}
+	sec(secExternals, len(d.Externals), func() {
+		for _, p := range sortedPtrs(d.Externals) {
+			e.writePtr(p)
+			e.writeStr(d.Externals[p].Name)
+			e.int(d.Externals[p].Type)
+		}
+	})
+	sec(secStates, len(d.States), func() {
+		for _, p := range sortedPtrs(d.States) {
+			s := d.States[p]
+			e.writePtr(p)
+			e.writePtr(s.G)
+			e.writePtr(s.Parent)
+			e.writePtr(s.Env)
+			e.bool(s.Dead)
+			e.int(s.Options.CallStackSize)
+			e.int(s.Options.RegistrySize)
+			e.bool(s.Options.SkipOpenLibs)
+			e.bool(s.Options.IncludeGoStackTrace)
+			e.bool(s.Options.Integers)
+			e.bool(s.Options.Lua53Operators)
+			e.bool(s.Options.Goto)
+			e.varint(int64(s.Stop))
+			e.writePtr(s.Reg)
+			e.writePtr(s.Stack)
+			e.writePtr(s.CurrentFrame)
+			e.bool(s.Wrapped)
+			e.writePtr(s.UVCache)
+			e.bool(s.HasErrorFunc)
+		}
+	})
+	sec(secTables, len(d.Tables), func() {
+		for _, p := range sortedPtrs(d.Tables) {
+			t := d.Tables[p]
+			e.writePtr(p)
+			e.value(t.Metatable)
+			e.values(t.Array)
+			e.uvarint(uint64(len(t.Dict)))
+			for _, kv := range t.Dict {
+				e.value(kv.Key)
+				e.value(kv.Value)
+			}
+			keys := make([]string, 0, len(t.Strdict))
+			for k := range t.Strdict {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			e.uvarint(uint64(len(keys)))
+			for _, k := range keys {
+				e.writeStr(k)
+				e.value(t.Strdict[k])
+			}
+			e.values(t.Keys)
+			e.uvarint(uint64(len(t.K2i)))
+			for _, kv := range t.K2i {
+				e.value(kv.Key)
+				e.int(kv.Value)
+			}
+		}
+	})
+	var err error
+	sec(secUserData, len(d.UserData), func() {
+		for _, p := range sortedPtrs(d.UserData) {
+			ud := d.UserData[p]
+			e.writePtr(p)
+			e.writeStr(ud.Type)
+			b, jerr := json.Marshal(ud.Data)
+			if jerr != nil && err == nil {
+				err = fmt.Errorf("dump: can not encode userdata %v: %v", p, jerr)
+			}
+			e.uvarint(uint64(len(b)))
+			e.out.Write(b)
+			e.value(ud.Metatable)
+			e.writePtr(ud.Env)
+			e.writeStr(ud.TypeMetatable)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	sec(secCallFrames, len(d.CallFrames), func() {
+		for _, p := range sortedPtrs(d.CallFrames) {
+			cf := d.CallFrames[p]
+			e.writePtr(p)
+			e.int(cf.Idx)
+			e.writePtr(cf.Fn)
+			e.writePtr(cf.Parent)
+			e.int(cf.Pc)
+			e.int(cf.Base)
+			e.int(cf.LocalBase)
+			e.int(cf.ReturnBase)
+			e.int(cf.NArgs)
+			e.int(cf.NRet)
+			e.int(cf.TailCall)
+		}
+	})
+	sec(secCallFrameStacks, len(d.CallFrameStacks), func() {
+		for _, p := range sortedPtrs(d.CallFrameStacks) {
+			cfs := d.CallFrameStacks[p]
+			e.writePtr(p)
+			e.ptrSlice(cfs.Array)
+			e.int(cfs.Len)
+			e.int(cfs.Sp)
+		}
+	})
+	sec(secRegistries, len(d.Registries), func() {
+		for _, p := range sortedPtrs(d.Registries) {
+			r := d.Registries[p]
+			e.writePtr(p)
+			e.values(r.Array)
+			e.int(r.Len)
+			e.int(r.Top)
+		}
+	})
+	sec(secFunctions, len(d.Functions), func() {
+		for _, p := range sortedPtrs(d.Functions) {
+			f := d.Functions[p]
+			e.writePtr(p)
+			e.bool(f.IsG)
+			e.writePtr(f.Env)
+			e.writePtr(f.Proto)
+			e.writePtr(f.GFunction)
+			e.ptrSlice(f.Upvalues)
+		}
+	})
+	sec(secFunctionProtos, len(d.FunctionProtos), func() {
+		for _, p := range sortedPtrs(d.FunctionProtos) {
+			fp := d.FunctionProtos[p]
+			e.writePtr(p)
+			e.writeStr(fp.SourceName)
+			e.int(fp.LineDefined)
+			e.int(fp.LastLineDefined)
+			e.out.Write([]byte{fp.NumUpvalues, fp.NumParameters, fp.IsVarArg, fp.NumUsedRegisters})
+			e.code(fp.Code)
+			e.constants(fp.Constants)
+			e.ptrSlice(fp.FunctionPrototypes)
+			e.intSlice(fp.DbgSourcePositions)
+			e.ptrSlice(fp.DbgLocals)
+			e.uvarint(uint64(len(fp.DbgCalls)))
+			for _, c := range fp.DbgCalls {
+				e.writeStr(c.Name)
+				e.int(c.Pc)
+			}
+			e.strSlice(fp.DbgUpvalues)
+			e.strSlice(fp.StringConstants)
+			e.writeStr(fp.Hash)
+		}
+	})
+	sec(secDbgLocalInfos, len(d.DbgLocalInfos), func() {
+		for _, p := range sortedPtrs(d.DbgLocalInfos) {
+			li := d.DbgLocalInfos[p]
+			e.writePtr(p)
+			e.writeStr(li.Name)
+			e.int(li.StartPc)
+			e.int(li.EndPc)
+		}
+	})
+	sec(secUpvalues, len(d.Upvalues), func() {
+		for _, p := range sortedPtrs(d.Upvalues) {
+			uv := d.Upvalues[p]
+			e.writePtr(p)
+			e.writePtr(uv.Next)
+			e.writePtr(uv.Reg)
+			e.int(uv.Index)
+			e.value(uv.Value)
+			e.bool(uv.Closed)
+		}
+	})
+	sec(secFiles, len(d.Files), func() {
+		for _, p := range sortedPtrs(d.Files) {
+			f := d.Files[p]
+			e.writePtr(p)
+			e.writeStr(f.Std)
+			e.writeStr(f.Path)
+			e.writeStr(f.Mode)
+			e.varint(f.Offset)
+			e.int(f.Buffer)
+			e.bool(f.Temp)
+			e.uvarint(uint64(len(f.Content)))
+			e.out.Write(f.Content)
+		}
+	})
+	sec(secChannels, len(d.Channels), func() {
+		for _, p := range sortedPtrs(d.Channels) {
+			ch := d.Channels[p]
+			e.writePtr(p)
+			e.int(ch.Cap)
+			e.values(ch.Values)
+			e.bool(ch.Closed)
+			e.writeStr(ch.Error)
+		}
+	})
+	if len(d.Signature) > 0 {
+		sec(secSignature, 1, func() {
+			e.uvarint(uint64(len(d.Signature)))
+			e.out.Write(d.Signature)
+		})
+	}
+	return nil
+}
+
+func writeUvarint(b *bytes.Buffer, v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	b.Write(buf[:n])
+}
+
+func writeVarint(b *bytes.Buffer, v int64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(buf[:], v)
+	b.Write(buf[:n])
+}
+
+/* }}} */
+
+/* decoder {{{ */
+
+type decoder struct {
+	b      []byte
+	err    error
+	strs   []string
+	ptrs   []Ptr
+	codes  [][]uint32
+	consts [][]Value
+}
+
+// Decode reads a snapshot written by Encode.
+func Decode(r io.Reader) (Data, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return Data{}, err
+	}
+	if !IsBinary(b) {
+		return Data{}, ErrNotBinary
+	}
+	dec := &decoder{b: b[len(binaryMagic):], strs: []string{""}, ptrs: []Ptr{""}}
+	version := dec.uvarint()
+	if dec.err == nil && version != BinaryVersion {
+		return Data{}, fmt.Errorf("dump: unsupported binary version %v (supported: %v)", version, BinaryVersion)
+	}
+	d := Data{
+		Externals:       make(map[Ptr]*External),
+		States:          make(map[Ptr]*State),
+		Tables:          make(map[Ptr]*Table),
+		UserData:        make(map[Ptr]*UserData),
+		Files:           make(map[Ptr]*File),
+		Channels:        make(map[Ptr]*Channel),
+		CallFrames:      make(map[Ptr]*CallFrame),
+		CallFrameStacks: make(map[Ptr]*CallFrameStack),
+		Registries:      make(map[Ptr]*Registry),
+		Functions:       make(map[Ptr]*Function),
+		FunctionProtos:  make(map[Ptr]*FunctionProto),
+		DbgLocalInfos:   make(map[Ptr]*DbgLocalInfo),
+		Upvalues:        make(map[Ptr]*Upvalue),
+	}
+	for dec.err == nil && len(dec.b) > 0 {
+		tag := dec.uvarint()
+		n := dec.uvarint()
+		if dec.err != nil {
+			break
+		}
+		if n > uint64(len(dec.b)) {
+			dec.fail("section %v is truncated", tag)
+			break
+		}
+		rest := dec.b[n:]
+		dec.b = dec.b[:n]
+		dec.section(tag, &d)
+		if dec.err == nil && len(dec.b) != 0 {
+			dec.fail("section %v has %v trailing bytes", tag, len(dec.b))
+		}
+		dec.b = rest
+	}
+	if dec.err != nil {
+		return Data{}, dec.err
+	}
+	return d, nil
+}
+
+func (dec *decoder) fail(format string, args ...interface{}) {
+	if dec.err == nil {
+		dec.err = fmt.Errorf("dump: corrupted binary snapshot: "+format, args...)
+	}
+}
+
+func (dec *decoder) uvarint() uint64 {
+	if dec.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(dec.b)
+	if n <= 0 {
+		dec.fail("bad uvarint")
+		return 0
+	}
+	dec.b = dec.b[n:]
+	return v
+}
+
+func (dec *decoder) varint() int64 {
+	if dec.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(dec.b)
+	if n <= 0 {
+		dec.fail("bad varint")
+		return 0
+	}
+	dec.b = dec.b[n:]
+	return v
+}
+
+func (dec *decoder) int() int { return int(dec.varint()) }
+
+func (dec *decoder) byte() byte {
+	if dec.err != nil {
+		return 0
+	}
+	if len(dec.b) == 0 {
+		dec.fail("unexpected end of data")
+		return 0
+	}
+	c := dec.b[0]
+	dec.b = dec.b[1:]
+	return c
+}
+
+func (dec *decoder) bytes(n uint64) []byte {
+	if dec.err != nil {
+		return nil
+	}
+	if n > uint64(len(dec.b)) {
+		dec.fail("unexpected end of data")
+		return nil
+	}
+	b := dec.b[:n]
+	dec.b = dec.b[n:]
+	return b
+}
+
+func (dec *decoder) bool() bool { return dec.byte() != 0 }
+
+// count reads a slice length and checks it against the remaining input,
+// every element takes at least one byte.
+func (dec *decoder) count() int {
+	n := dec.uvarint()
+	if n > uint64(len(dec.b)) {
+		dec.fail("bad length %v", n)
+		return 0
+	}
+	return int(n)
+}
+
+func (dec *decoder) str() string {
+	id := dec.uvarint()
+	if id >= uint64(len(dec.strs)) {
+		dec.fail("bad string id %v", id)
+		return ""
+	}
+	return dec.strs[id]
+}
+
+func (dec *decoder) ptr() Ptr {
+	id := dec.uvarint()
+	if id >= uint64(len(dec.ptrs)) {
+		dec.fail("bad pointer id %v", id)
+		return ""
+	}
+	return dec.ptrs[id]
+}
+
+func (dec *decoder) value() Value {
+	v := Value{Type: dec.int()}
+	flags := dec.byte()
+	if flags&^valueFlags != 0 {
+		dec.fail("unknown value flags %#x", flags&^valueFlags)
+		return v
+	}
+	if flags&valuePtr != 0 {
+		v.Ptr = dec.ptr()
+	}
+	if flags&valueString != 0 {
+		v.String = dec.str()
+	}
+	v.Bool = flags&valueBool != 0
+	if flags&valueNumber != 0 {
+		if b := dec.bytes(8); b != nil {
+			v.Number = math.Float64frombits(binary.LittleEndian.Uint64(b))
+		}
+	}
+	if flags&valueInteger != 0 {
+		v.Integer = true
+		v.Int = dec.varint()
+	}
+	return v
+}
+
+func (dec *decoder) values() []Value {
+	n := dec.count()
+	if n == 0 {
+		return nil
+	}
+	vs := make([]Value, n)
+	for i := range vs {
+		vs[i] = dec.value()
+	}
+	return vs
+}
+
+func (dec *decoder) ptrSlice() []Ptr {
+	n := dec.count()
+	if n == 0 {
+		return nil
+	}
+	ps := make([]Ptr, n)
+	for i := range ps {
+		ps[i] = dec.ptr()
+	}
+	return ps
+}
+
+func (dec *decoder) strSlice() []string {
+	n := dec.count()
+	if n == 0 {
+		return nil
+	}
+	ss := make([]string, n)
+	for i := range ss {
+		ss[i] = dec.str()
+	}
+	return ss
+}
+
+func (dec *decoder) intSlice() []int {
+	n := dec.count()
+	if n == 0 {
+		return nil
+	}
+	is := make([]int, n)
+	for i := range is {
+		is[i] = dec.int()
+	}
+	return is
+}
+
+func (dec *decoder) code() []uint32 {
+	id := dec.uvarint()
+	if id > uint64(len(dec.codes)) {
+		dec.fail("bad code id %v", id)
+		return nil
+	}
+	if id == 0 {
+		return nil
+	}
+	return dec.codes[id-1]
+}
+
+func (dec *decoder) constants() []Value {
+	id := dec.uvarint()
+	if id > uint64(len(dec.consts)) {
+		dec.fail("bad constants id %v", id)
+		return nil
+	}
+	if id == 0 {
+		return nil
+	}
+	return dec.consts[id-1]
+}
+
+func (dec *decoder) section(tag uint64, d *Data) {
+	switch tag {
+	case secStrings:
+		n := dec.count()
+		for i := 0; i < n; i++ {
+			dec.strs = append(dec.strs, string(dec.bytes(dec.uvarint())))
+		}
+	case secPtrs:
+		n := dec.count()
+		for i := 0; i < n; i++ {
+			dec.ptrs = append(dec.ptrs, Ptr(dec.str()))
+		}
+	case secCodes:
+		n := dec.count()
+		for i := 0; i < n; i++ {
+			code := make([]uint32, dec.count())
+			for j := range code {
+				code[j] = uint32(dec.uvarint())
+			}
+			dec.codes = append(dec.codes, code)
+		}
+	case secConstants:
+		n := dec.count()
+		for i := 0; i < n; i++ {
+			dec.consts = append(dec.consts, dec.values())
+		}
+	case secGlobal:
+		dec.count()
+		g := &Global{}
+		g.MainThread = dec.ptr()
+		g.CurrentThread = dec.ptr()
+		g.Registry = dec.ptr()
+		g.Global = dec.ptr()
+		n := dec.count()
+		g.BuiltinMts = make(map[string]Value, n)
+		for i := 0; i < n; i++ {
+			k := dec.str()
+			g.BuiltinMts[k] = dec.value()
+		}
+		g.Gccount = int32(dec.varint())
+		d.G = g
+	case secRoot:
+		dec.count()
+		d.Root = dec.value()
+	case secExternals:
+		n := dec.count()
+		for i := 0; i < n; i++ {
+			p := dec.ptr()
+			ext := &External{}
+			ext.Name = dec.str()
+			ext.Type = dec.int()
+			d.Externals[p] = ext
+		}
+	case secStates:
+		n := dec.count()
+		for i := 0; i < n; i++ {
+			p := dec.ptr()
+			s := &State{}
+			s.G = dec.ptr()
+			s.Parent = dec.ptr()
+			s.Env = dec.ptr()
+			s.Dead = dec.bool()
+			s.Options.CallStackSize = dec.int()
+			s.Options.RegistrySize = dec.int()
+			s.Options.SkipOpenLibs = dec.bool()
+			s.Options.IncludeGoStackTrace = dec.bool()
+			s.Options.Integers = dec.bool()
+			s.Options.Lua53Operators = dec.bool()
+			s.Options.Goto = dec.bool()
+			s.Stop = int32(dec.varint())
+			s.Reg = dec.ptr()
+			s.Stack = dec.ptr()
+			s.CurrentFrame = dec.ptr()
+			s.Wrapped = dec.bool()
+			s.UVCache = dec.ptr()
+			s.HasErrorFunc = dec.bool()
+			d.States[p] = s
+		}
+	case secTables:
+		n := dec.count()
+		for i := 0; i < n; i++ {
+			p := dec.ptr()
+			t := &Table{}
+			t.Metatable = dec.value()
+			t.Array = dec.values()
+			if m := dec.count(); m > 0 {
+				t.Dict = make([]VV, m)
+				for j := range t.Dict {
+					t.Dict[j].Key = dec.value()
+					t.Dict[j].Value = dec.value()
+				}
+			}
+			if m := dec.count(); m > 0 {
+				t.Strdict = make(map[string]Value, m)
+				for j := 0; j < m; j++ {
+					k := dec.str()
+					t.Strdict[k] = dec.value()
+				}
+			}
+			t.Keys = dec.values()
+			if m := dec.count(); m > 0 {
+				t.K2i = make([]VI, m)
+				for j := range t.K2i {
+					t.K2i[j].Key = dec.value()
+					t.K2i[j].Value = dec.int()
+				}
+			}
+			d.Tables[p] = t
+		}
+	case secUserData:
+		n := dec.count()
+		for i := 0; i < n; i++ {
+			p := dec.ptr()
+			ud := &UserData{}
+			ud.Type = dec.str()
+			if b := dec.bytes(dec.uvarint()); len(b) > 0 && dec.err == nil {
+				if err := json.Unmarshal(b, &ud.Data); err != nil {
+					dec.fail("userdata %v: %v", p, err)
+				}
+			}
+			ud.Metatable = dec.value()
+			ud.Env = dec.ptr()
+			ud.TypeMetatable = dec.str()
+			d.UserData[p] = ud
+		}
+	case secCallFrames:
+		n := dec.count()
+		for i := 0; i < n; i++ {
+			p := dec.ptr()
+			cf := &CallFrame{}
+			cf.Idx = dec.int()
+			cf.Fn = dec.ptr()
+			cf.Parent = dec.ptr()
+			cf.Pc = dec.int()
+			cf.Base = dec.int()
+			cf.LocalBase = dec.int()
+			cf.ReturnBase = dec.int()
+			cf.NArgs = dec.int()
+			cf.NRet = dec.int()
+			cf.TailCall = dec.int()
+			d.CallFrames[p] = cf
+		}
+	case secCallFrameStacks:
+		n := dec.count()
+		for i := 0; i < n; i++ {
+			p := dec.ptr()
+			cfs := &CallFrameStack{}
+			cfs.Array = dec.ptrSlice()
+			cfs.Len = dec.int()
+			cfs.Sp = dec.int()
+			d.CallFrameStacks[p] = cfs
+		}
+	case secRegistries:
+		n := dec.count()
+		for i := 0; i < n; i++ {
+			p := dec.ptr()
+			r := &Registry{}
+			r.Array = dec.values()
+			r.Len = dec.int()
+			r.Top = dec.int()
+			d.Registries[p] = r
+		}
+	case secFunctions:
+		n := dec.count()
+		for i := 0; i < n; i++ {
+			p := dec.ptr()
+			f := &Function{}
+			f.IsG = dec.bool()
+			f.Env = dec.ptr()
+			f.Proto = dec.ptr()
+			f.GFunction = dec.ptr()
+			f.Upvalues = dec.ptrSlice()
+			d.Functions[p] = f
+		}
+	case secFunctionProtos:
+		n := dec.count()
+		for i := 0; i < n; i++ {
+			p := dec.ptr()
+			fp := &FunctionProto{}
+			fp.SourceName = dec.str()
+			fp.LineDefined = dec.int()
+			fp.LastLineDefined = dec.int()
+			fp.NumUpvalues = dec.byte()
+			fp.NumParameters = dec.byte()
+			fp.IsVarArg = dec.byte()
+			fp.NumUsedRegisters = dec.byte()
+			fp.Code = dec.code()
+			fp.Constants = dec.constants()
+			fp.FunctionPrototypes = dec.ptrSlice()
+			fp.DbgSourcePositions = dec.intSlice()
+			fp.DbgLocals = dec.ptrSlice()
+			if m := dec.count(); m > 0 {
+				fp.DbgCalls = make([]DbgCall, m)
+				for j := range fp.DbgCalls {
+					fp.DbgCalls[j].Name = dec.str()
+					fp.DbgCalls[j].Pc = dec.int()
+				}
+			}
+			fp.DbgUpvalues = dec.strSlice()
+			fp.StringConstants = dec.strSlice()
+			fp.Hash = dec.str()
+			d.FunctionProtos[p] = fp
+		}
+	case secDbgLocalInfos:
+		n := dec.count()
+		for i := 0; i < n; i++ {
+			p := dec.ptr()
+			li := &DbgLocalInfo{}
+			li.Name = dec.str()
+			li.StartPc = dec.int()
+			li.EndPc = dec.int()
+			d.DbgLocalInfos[p] = li
+		}
+	case secUpvalues:
+		n := dec.count()
+		for i := 0; i < n; i++ {
+			p := dec.ptr()
+			uv := &Upvalue{}
+			uv.Next = dec.ptr()
+			uv.Reg = dec.ptr()
+			uv.Index = dec.int()
+			uv.Value = dec.value()
+			uv.Closed = dec.bool()
+			d.Upvalues[p] = uv
+		}
+	case secFiles:
+		n := dec.count()
+		for i := 0; i < n; i++ {
+			p := dec.ptr()
+			f := &File{}
+			f.Std = dec.str()
+			f.Path = dec.str()
+			f.Mode = dec.str()
+			f.Offset = dec.varint()
+			f.Buffer = dec.int()
+			f.Temp = dec.bool()
+			if b := dec.bytes(dec.uvarint()); len(b) > 0 {
+				f.Content = append([]byte{}, b...)
+			}
+			d.Files[p] = f
+		}
+	case secVersion:
+		dec.count()
+		d.Version = dec.int()
+		d.LuaVersion = dec.str()
+		d.OpCodeHash = dec.str()
+	case secChannels:
+		n := dec.count()
+		for i := 0; i < n; i++ {
+			p := dec.ptr()
+			ch := &Channel{}
+			ch.Cap = dec.int()
+			ch.Values = dec.values()
+			ch.Closed = dec.bool()
+			ch.Error = dec.str()
+			d.Channels[p] = ch
+		}
+	case secSignature:
+		dec.count()
+		d.Signature = append([]byte{}, dec.bytes(dec.uvarint())...)
+	default:
+		// written by a newer encoder, skip it
+		dec.b = nil
+	}
+}
+
+/* }}} */
@@ -0,0 +1,184 @@
+package dump
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+)
+
+func testData() Data {
+	code := []uint32{134217729, 603979776, 2617245696, 2214592513}
+	consts := []Value{{Type: 3, String: "x"}, {Type: 2, Number: 1.5}, {Type: 2, Integer: true, Int: -1 << 60}}
+	return Data{
+		Version:    Version,
+		LuaVersion: "Lua 5.1",
+		OpCodeHash: "hash",
+		G: &Global{
+			MainThread:    "main",
+			CurrentThread: "main",
+			Registry:      "reg",
+			Global:        "global",
+			BuiltinMts:    map[string]Value{"3": {Type: 7, Ptr: "strmt"}},
+			Gccount:       3,
+		},
+		States: map[Ptr]*State{
+			"main": {G: "g", Env: "global", Reg: "main.reg", Stack: "main.stack", CurrentFrame: "cf",
+				Options: Options{CallStackSize: 256, RegistrySize: 5120, SkipOpenLibs: true, Integers: true, Lua53Operators: true, Goto: true}, Stop: 1},
+		},
+		Tables: map[Ptr]*Table{
+			"global": {
+				Metatable: Value{},
+				Array:     []Value{{Type: 1, Bool: true}, {Type: 2, Number: -7}},
+				Dict:      []VV{{Key: Value{Type: 1, Bool: true}, Value: Value{Type: 4, Ptr: "f"}}},
+				Strdict:   map[string]Value{"a": {Type: 3, String: "hello"}, "b": {Type: 7, Ptr: "reg"}},
+				Keys:      []Value{{Type: 3, String: "a"}},
+				K2i:       []VI{{Key: Value{Type: 3, String: "a"}, Value: 0}},
+			},
+			"reg":   {},
+			"strmt": {},
+		},
+		UserData: map[Ptr]*UserData{
+			"ud": {Type: "point", Data: map[string]interface{}{"x": 1.0, "y": "2"},
+				Metatable: Value{Type: 7, Ptr: "strmt"}, Env: "global"},
+			"typed": {Type: "point", TypeMetatable: "point"},
+		},
+		Files: map[Ptr]*File{
+			"ud": {Path: "report.txt", Mode: "w+", Offset: 12, Buffer: 4096, Temp: true, Content: []byte("hello\x00")},
+		},
+		Channels: map[Ptr]*Channel{
+			"ch":    {Cap: 2, Values: []Value{{Type: 3, String: "msg"}, {Type: 7, Ptr: "reg"}}, Closed: true},
+			"chErr": {Error: "unbuffered channel"},
+		},
+		CallFrames: map[Ptr]*CallFrame{
+			"cf": {Idx: 1, Fn: "f", Parent: "cf0", Pc: 3, Base: 1, LocalBase: 2, ReturnBase: 1, NArgs: 1, NRet: -1, TailCall: 2},
+		},
+		CallFrameStacks: map[Ptr]*CallFrameStack{
+			"main.stack": {Array: []Ptr{"cf0", "cf"}, Len: 256, Sp: 2},
+		},
+		Registries: map[Ptr]*Registry{
+			"main.reg": {Array: []Value{{Type: 4, Ptr: "f"}, {}, {Type: 3, String: "x"}}, Len: 5120, Top: 3},
+		},
+		Functions: map[Ptr]*Function{
+			"f":  {Env: "global", Proto: "p1", Upvalues: []Ptr{"uv"}},
+			"gf": {IsG: true, GFunction: "print"},
+		},
+		FunctionProtos: map[Ptr]*FunctionProto{
+			"p1": {SourceName: "<string>", LineDefined: 1, LastLineDefined: 3, NumUpvalues: 1, NumParameters: 2,
+				IsVarArg: 7, NumUsedRegisters: 4, Code: code, Constants: consts, FunctionPrototypes: []Ptr{"p2"},
+				DbgSourcePositions: []int{1, 1, 2, 3}, DbgLocals: []Ptr{"li"}, DbgCalls: []DbgCall{{Name: "print", Pc: 2}},
+				DbgUpvalues: []string{"x"}, StringConstants: []string{"x", ""}},
+			"p2": {SourceName: "<string>", NumUsedRegisters: 2, Code: code, Constants: consts, Hash: "0123456789abcdef"},
+		},
+		DbgLocalInfos: map[Ptr]*DbgLocalInfo{
+			"li": {Name: "a", StartPc: 1, EndPc: 3},
+		},
+		Upvalues: map[Ptr]*Upvalue{
+			"uv": {Next: "uv2", Reg: "main.reg", Index: 2, Value: Value{Type: 2, Number: 3}, Closed: true},
+		},
+	}
+}
+
+func mustJSON(t *testing.T, d Data) string {
+	b, err := json.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestEncodeDecode(t *testing.T) {
+	d := testData()
+	var buf bytes.Buffer
+	if err := Encode(&buf, d); err != nil {
+		t.Fatal(err)
+	}
+	if !IsBinary(buf.Bytes()) {
+		t.Fatal("encoded snapshot does not start with the magic")
+	}
+	d2, err := Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, b := mustJSON(t, d), mustJSON(t, d2); a != b {
+		t.Errorf("round trip mismatch:\n%s\n%s", a, b)
+	}
+
+	var buf2 bytes.Buffer
+	if err := Encode(&buf2, d2); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), buf2.Bytes()) {
+		t.Error("encoding is not deterministic")
+	}
+}
+
+func TestEncodeSharesCode(t *testing.T) {
+	d := testData()
+	code := make([]uint32, 100)
+	for i := range code {
+		code[i] = uint32(i * 1000003)
+	}
+	d.FunctionProtos["p1"].Code = code
+	var one bytes.Buffer
+	if err := Encode(&one, d); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		p := Ptr("copy" + string(rune('a'+i)))
+		d.FunctionProtos[p] = &FunctionProto{SourceName: "<string>", Code: code,
+			Constants: d.FunctionProtos["p1"].Constants}
+	}
+	var many bytes.Buffer
+	if err := Encode(&many, d); err != nil {
+		t.Fatal(err)
+	}
+	// every extra proto only adds a handful of ids, not another copy of its code
+	if grow := many.Len() - one.Len(); grow > 10*40 {
+		t.Errorf("code and constants are not shared: snapshot grew by %v bytes", grow)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	if _, err := Decode(bytes.NewReader([]byte(`{"G":{}}`))); err != ErrNotBinary {
+		t.Errorf("ErrNotBinary expected, but got %v", err)
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, testData()); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	for _, n := range []int{4, len(b) / 2, len(b) - 1} {
+		if _, err := Decode(bytes.NewReader(b[:n])); err == nil {
+			t.Errorf("truncated snapshot (%v of %v bytes) decoded without errors", n, len(b))
+		}
+	}
+
+	future := append([]byte{}, b...)
+	future = append(future, 100, 3, 1, 2, 3)
+	if _, err := Decode(bytes.NewReader(future)); err != nil {
+		t.Errorf("unknown sections must be skipped, but got %v", err)
+	}
+
+	newer := append([]byte{}, b...)
+	newer[len(binaryMagic)] = BinaryVersion + 1
+	if _, err := Decode(bytes.NewReader(newer)); err == nil || !strings.Contains(err.Error(), "unsupported binary version") {
+		t.Errorf("newer binary version must be rejected, but got %v", err)
+	}
+}
+
+func TestEncodeNegativeZero(t *testing.T) {
+	d := Data{Root: Value{Type: 2, Number: math.Copysign(0, -1)}}
+	var buf bytes.Buffer
+	if err := Encode(&buf, d); err != nil {
+		t.Fatal(err)
+	}
+	d2, err := Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := d2.Root.Number; n != 0 || !math.Signbit(n) {
+		t.Errorf("-0 expected, but got %v", n)
+	}
+}
@@ -0,0 +1,226 @@
+package dump
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sort"
+)
+
+// Patch holds the object level difference between two snapshots.
+// Objects are matched by their Ptr, so Diff is only meaningful for snapshots
+// of the same LState taken at different times.
+type Patch struct {
+	// Objects that exist only in the new snapshot.
+	Added Data `json:",omitempty"`
+	// Objects that exist in both snapshots but changed. Top level fields
+	// such as G are stored here when they differ.
+	Modified Data `json:",omitempty"`
+	// Ptrs of the objects that exist only in the old snapshot, sorted and
+	// keyed by the name of their Data field, such as "Tables".
+	Removed map[string][]Ptr `json:",omitempty"`
+	// Names of the top level fields that changed, such as "G" or
+	// "Signature". Their new values are in Modified, where a zero value
+	// cannot be told apart from an unchanged field otherwise.
+	Fields []string `json:",omitempty"`
+}
+
+// IsEmpty reports whether applying p would not change anything.
+func (p Patch) IsEmpty() bool {
+	if len(p.Fields) > 0 || len(p.Removed) > 0 {
+		return false
+	}
+	for _, d := range []Data{p.Added, p.Modified} {
+		dv := reflect.ValueOf(d)
+		for i := 0; i < dv.NumField(); i++ {
+			if dv.Type().Field(i).PkgPath == "" && !dv.Field(i).IsZero() && !(dv.Field(i).Kind() == reflect.Map && dv.Field(i).Len() == 0) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Diff computes the patch that turns old into new.
+func Diff(old, new Data) Patch {
+	var p Patch
+	ov := reflect.ValueOf(old)
+	nv := reflect.ValueOf(new)
+	av := reflect.ValueOf(&p.Added).Elem()
+	mv := reflect.ValueOf(&p.Modified).Elem()
+	for i := 0; i < nv.NumField(); i++ {
+		if nv.Type().Field(i).PkgPath != "" {
+			continue
+		}
+		of, nf := ov.Field(i), nv.Field(i)
+		if nf.Kind() != reflect.Map {
+			if !reflect.DeepEqual(of.Interface(), nf.Interface()) {
+				mv.Field(i).Set(nf)
+				p.Fields = append(p.Fields, nv.Type().Field(i).Name)
+			}
+			continue
+		}
+		added := reflect.MakeMap(nf.Type())
+		modified := reflect.MakeMap(nf.Type())
+		for _, k := range nf.MapKeys() {
+			n := nf.MapIndex(k)
+			o := of.MapIndex(k)
+			switch {
+			case !o.IsValid():
+				added.SetMapIndex(k, n)
+			case !reflect.DeepEqual(o.Interface(), n.Interface()):
+				modified.SetMapIndex(k, n)
+			}
+		}
+		var removed []Ptr
+		for _, k := range of.MapKeys() {
+			if !nf.MapIndex(k).IsValid() {
+				removed = append(removed, Ptr(k.String()))
+			}
+		}
+		setNonEmpty(av.Field(i), added)
+		setNonEmpty(mv.Field(i), modified)
+		if len(removed) > 0 {
+			sort.Slice(removed, func(i, j int) bool { return removed[i] < removed[j] })
+			if p.Removed == nil {
+				p.Removed = make(map[string][]Ptr)
+			}
+			p.Removed[nv.Type().Field(i).Name] = removed
+		}
+	}
+	return p
+}
+
+// Apply returns a new snapshot with p applied to base. base itself is not
+// modified, unchanged objects are shared between base and the result.
+func Apply(base Data, p Patch) Data {
+	out := base
+	outv := reflect.ValueOf(&out).Elem()
+	av := reflect.ValueOf(p.Added)
+	mv := reflect.ValueOf(p.Modified)
+	for _, name := range p.Fields {
+		if field := outv.FieldByName(name); field.IsValid() && field.Kind() != reflect.Map {
+			field.Set(mv.FieldByName(name))
+		}
+	}
+	for i := 0; i < outv.NumField(); i++ {
+		if outv.Type().Field(i).PkgPath != "" {
+			continue
+		}
+		field := outv.Field(i)
+		if field.Kind() != reflect.Map {
+			continue
+		}
+		removed := p.Removed[outv.Type().Field(i).Name]
+		if av.Field(i).Len() == 0 && mv.Field(i).Len() == 0 && len(removed) == 0 {
+			continue
+		}
+		merged := reflect.MakeMap(field.Type())
+		for _, k := range field.MapKeys() {
+			merged.SetMapIndex(k, field.MapIndex(k))
+		}
+		for _, ptr := range removed {
+			merged.SetMapIndex(reflect.ValueOf(ptr), reflect.Value{})
+		}
+		for _, src := range []reflect.Value{av.Field(i), mv.Field(i)} {
+			for _, k := range src.MapKeys() {
+				merged.SetMapIndex(k, src.MapIndex(k))
+			}
+		}
+		field.Set(merged)
+	}
+	return out
+}
+
+func setNonEmpty(field, m reflect.Value) {
+	if m.Len() > 0 {
+		field.Set(m)
+	}
+}
+
+const patchMagic = "GLDP"
+
+// EncodePatch writes p to w. The added and the modified objects are written
+// as two snapshots by Encode, followed by the removed Ptrs and the names of
+// the changed top level fields.
+func EncodePatch(w io.Writer, p Patch) error {
+	var b bytes.Buffer
+	b.WriteString(patchMagic)
+	for _, d := range []Data{p.Added, p.Modified} {
+		var snap bytes.Buffer
+		if err := Encode(&snap, d); err != nil {
+			return err
+		}
+		writeUvarint(&b, uint64(snap.Len()))
+		b.Write(snap.Bytes())
+	}
+	kinds := make([]string, 0, len(p.Removed))
+	for kind := range p.Removed {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	writeUvarint(&b, uint64(len(kinds)))
+	for _, kind := range kinds {
+		writeString(&b, kind)
+		writeUvarint(&b, uint64(len(p.Removed[kind])))
+		for _, ptr := range p.Removed[kind] {
+			writeString(&b, string(ptr))
+		}
+	}
+	writeUvarint(&b, uint64(len(p.Fields)))
+	for _, name := range p.Fields {
+		writeString(&b, name)
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// DecodePatch reads a patch written by EncodePatch.
+func DecodePatch(r io.Reader) (Patch, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return Patch{}, err
+	}
+	if !bytes.HasPrefix(b, []byte(patchMagic)) {
+		return Patch{}, errors.New("dump: not a binary patch")
+	}
+	dec := &decoder{b: b[len(patchMagic):]}
+	var p Patch
+	for _, d := range []*Data{&p.Added, &p.Modified} {
+		snap := dec.bytes(dec.uvarint())
+		if dec.err != nil {
+			break
+		}
+		if *d, err = Decode(bytes.NewReader(snap)); err != nil {
+			return Patch{}, err
+		}
+	}
+	if n := dec.count(); n > 0 {
+		p.Removed = make(map[string][]Ptr, n)
+		for i := 0; i < n; i++ {
+			kind := string(dec.bytes(dec.uvarint()))
+			ptrs := make([]Ptr, dec.count())
+			for j := range ptrs {
+				ptrs[j] = Ptr(dec.bytes(dec.uvarint()))
+			}
+			p.Removed[kind] = ptrs
+		}
+	}
+	for n, i := dec.count(), 0; i < n; i++ {
+		p.Fields = append(p.Fields, string(dec.bytes(dec.uvarint())))
+	}
+	if dec.err == nil && len(dec.b) > 0 {
+		dec.fail("patch has %v trailing bytes", len(dec.b))
+	}
+	if dec.err != nil {
+		return Patch{}, dec.err
+	}
+	return p, nil
+}
+
+func writeString(b *bytes.Buffer, s string) {
+	writeUvarint(b, uint64(len(s)))
+	b.WriteString(s)
+}
@@ -0,0 +1,103 @@
+package dump
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDiffApply(t *testing.T) {
+	old := testData()
+	new := testData()
+	new.Tables["global"].Strdict["a"] = Value{Type: 3, String: "changed"}
+	new.Tables["added"] = &Table{Array: []Value{{Type: 2, Number: 1}}}
+	delete(new.Upvalues, "uv")
+	new.Functions["f"].Upvalues = nil
+	new.CallFrames["cf"].Pc = 4
+	new.Registries["main.reg"].Top = 1
+	new.G.Gccount = 4
+
+	p := Diff(old, new)
+	if p.IsEmpty() {
+		t.Fatal("patch must not be empty")
+	}
+	if _, ok := p.Added.Tables["added"]; !ok || len(p.Added.Tables) != 1 {
+		t.Errorf("unexpected added tables: %v", p.Added.Tables)
+	}
+	if _, ok := p.Modified.Tables["global"]; !ok || len(p.Modified.Tables) != 1 {
+		t.Errorf("unexpected modified tables: %v", p.Modified.Tables)
+	}
+	if ptrs := p.Removed["Upvalues"]; len(ptrs) != 1 || ptrs[0] != "uv" || len(p.Removed) != 1 {
+		t.Errorf("unexpected removed objects: %v", p.Removed)
+	}
+	if len(p.Modified.CallFrames) != 1 || len(p.Modified.Registries) != 1 || len(p.Modified.Functions) != 1 {
+		t.Errorf("unexpected patch: %v", mustJSON(t, p.Modified))
+	}
+	if p.Modified.G == nil || p.Modified.G.Gccount != 4 {
+		t.Errorf("changed G is not in the patch")
+	}
+	if len(p.Modified.States) != 0 || len(p.Modified.FunctionProtos) != 0 {
+		t.Errorf("unchanged objects are in the patch: %v", mustJSON(t, p.Modified))
+	}
+
+	before := mustJSON(t, old)
+	got := Apply(old, p)
+	if a, b := mustJSON(t, new), mustJSON(t, got); a != b {
+		t.Errorf("Apply result mismatch:\n%s\n%s", a, b)
+	}
+	if mustJSON(t, old) != before {
+		t.Errorf("Apply modified its base snapshot")
+	}
+
+	if p := Diff(new, got); !p.IsEmpty() {
+		t.Errorf("patch between equal snapshots must be empty, but got %v", mustJSON(t, p.Modified))
+	}
+}
+
+func TestDiffApplyZeroFields(t *testing.T) {
+	old := testData()
+	old.Signature = []byte("sig")
+	old.Root = Value{Type: 7, Ptr: "global"}
+	new := testData()
+	new.G = nil
+
+	p := Diff(old, new)
+	if p.IsEmpty() {
+		t.Fatal("patch clearing fields must not be empty")
+	}
+	got := Apply(old, p)
+	if got.Signature != nil || got.G != nil || got.Root != (Value{}) {
+		t.Errorf("fields set to their zero value are not cleared: %v", mustJSON(t, got))
+	}
+	if a, b := mustJSON(t, new), mustJSON(t, got); a != b {
+		t.Errorf("Apply result mismatch:\n%s\n%s", a, b)
+	}
+}
+
+func TestEncodePatch(t *testing.T) {
+	old := testData()
+	new := testData()
+	new.Tables["added"] = &Table{Array: []Value{{Type: 2, Number: 1}}}
+	delete(new.Upvalues, "uv")
+	delete(new.Tables, "strmt")
+	new.Signature = nil
+
+	p := Diff(old, new)
+	var buf bytes.Buffer
+	if err := EncodePatch(&buf, p); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	p2, err := DecodePatch(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, b := mustJSON(t, Apply(old, p)), mustJSON(t, Apply(old, p2)); a != b {
+		t.Errorf("decoded patch applies differently:\n%s\n%s", a, b)
+	}
+	if _, err := DecodePatch(bytes.NewReader(b[:len(b)-1])); err == nil {
+		t.Error("truncated patch decoded without errors")
+	}
+	if _, err := DecodePatch(bytes.NewReader([]byte("GLDB"))); err == nil {
+		t.Error("snapshot decoded as a patch")
+	}
+}
@@ -26,6 +26,9 @@ type Value struct {
 	String string  `json:",omitempty"`
 	Bool   bool    `json:",omitempty"`
 	Number float64 `json:",omitempty"`
+	// Integer marks numbers that are integers (LInteger), their value is Int.
+	Integer bool  `json:",omitempty"`
+	Int     int64 `json:",omitempty"`
 }
 
 type CallFrame struct {
@@ -68,8 +71,7 @@ type Global struct {
 	Global        Ptr `json:",omitempty"`
 
 	BuiltinMts map[string]Value `json:",omitempty"`
-	//tempFiles  []*os.File  // TODO: save files???
-	Gccount int32 `json:",omitempty"`
+	Gccount    int32            `json:",omitempty"`
 }
 
 type Options struct {
@@ -77,6 +79,9 @@ type Options struct {
 	RegistrySize        int  `json:",omitempty"`
 	SkipOpenLibs        bool `json:",omitempty"`
 	IncludeGoStackTrace bool `json:",omitempty"`
+	Integers            bool `json:",omitempty"`
+	Lua53Operators      bool `json:",omitempty"`
+	Goto                bool `json:",omitempty"`
 }
 
 type DbgCall struct {
@@ -105,15 +110,48 @@ type State struct {
 }
 
 type UserData struct {
-	Type string
-	Data interface{}
+	Type      string
+	Data      interface{}
+	Metatable Value `json:",omitempty"`
+	Env       Ptr   `json:",omitempty"` //*LTable
+	// TypeMetatable names the type metatable in the registry that is
+	// attached on load instead of Metatable.
+	TypeMetatable string `json:",omitempty"`
+}
+
+// File is a file of the io library. It is stored under the Ptr of its
+// userdata.
+type File struct {
+	Std     string `json:",omitempty"` // "stdin", "stdout" or "stderr" for standard streams
+	Path    string `json:",omitempty"`
+	Mode    string `json:",omitempty"` // io.open mode
+	Offset  int64  `json:",omitempty"`
+	Buffer  int    `json:",omitempty"` // write buffer size set by setvbuf, 0 if unbuffered
+	Temp    bool   `json:",omitempty"` // created by io.tmpfile, Content holds its data
+	Content []byte `json:",omitempty"`
+}
+
+// Channel is a channel of the channel library with its buffered values.
+type Channel struct {
+	Cap    int     `json:",omitempty"`
+	Values []Value `json:",omitempty"`
+	Closed bool    `json:",omitempty"`
+	Error  string  `json:",omitempty"` // why the channel could not be saved, the snapshot fails to load
 }
 
 type Data struct {
-	G               *Global                 `json:",omitempty"` //for consistency
+	Version         int                     `json:",omitempty"` // schema version, see Version
+	LuaVersion      string                  `json:",omitempty"` // lua.LuaVersion of the runtime that made the snapshot
+	OpCodeHash      string                  `json:",omitempty"` // hash of the instruction set of that runtime
+	Signature       []byte                  `json:",omitempty"` // see Sign
+	G               *Global                 `json:",omitempty"` //for consistency, nil in partial snapshots
+	Root            Value                   `json:",omitempty"` // the value saved by a partial snapshot
+	Externals       map[Ptr]*External       `json:",omitempty"` // objects a partial snapshot refers to by name
 	States          map[Ptr]*State          `json:",omitempty"`
 	Tables          map[Ptr]*Table          `json:",omitempty"`
 	UserData        map[Ptr]*UserData       `json:",omitempty"`
+	Files           map[Ptr]*File           `json:",omitempty"`
+	Channels        map[Ptr]*Channel        `json:",omitempty"`
 	CallFrames      map[Ptr]*CallFrame      `json:",omitempty"`
 	CallFrameStacks map[Ptr]*CallFrameStack `json:",omitempty"`
 	Registries      map[Ptr]*Registry       `json:",omitempty"`
@@ -123,13 +161,23 @@ type Data struct {
 	Upvalues        map[Ptr]*Upvalue        `json:",omitempty"`
 }
 
+// External is an object left out of a partial snapshot. Values refer to it
+// by its Ptr, and it is bound by Name when the snapshot is loaded.
+type External struct {
+	Name string
+	Type int // value type of the object
+}
+
 type DbgLocalInfo struct {
 	Name    string `json:",omitempty"`
 	StartPc int    `json:",omitempty"`
 	EndPc   int    `json:",omitempty"`
 }
 
+// FunctionProto is a function prototype. A prototype with a Hash but no
+// Code is a reference to a prototype kept in a ProtoStore.
 type FunctionProto struct {
+	Hash               string   `json:",omitempty"` // content hash, see HashProto
 	SourceName         string   `json:",omitempty"`
 	LineDefined        int      `json:",omitempty"`
 	LastLineDefined    int      `json:",omitempty"`
@@ -148,6 +196,12 @@ type FunctionProto struct {
 
 	StringConstants []string `json:",omitempty"`
 }
+
+// InStore reports whether p refers to a prototype kept in a ProtoStore.
+func (p *FunctionProto) InStore() bool {
+	return p.Hash != "" && len(p.Code) == 0
+}
+
 type Function struct {
 	IsG       bool  `json:",omitempty"`
 	Env       Ptr   `json:",omitempty"` //*LTable
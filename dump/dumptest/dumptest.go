@@ -7,7 +7,7 @@ import (
 	"log"
 
 	lua "github.com/gladkikhartem/gopher-lua"
-	"github.com/sergi/go-diff/diffmatchpatch"
+	"github.com/gladkikhartem/gopher-lua/dump"
 	ordjson "github.com/virtuald/go-ordered-json"
 )
 
@@ -45,7 +45,7 @@ func main() {
 	d := L.Dump()
 	data, _ := ordjson.MarshalIndent(d, " ", " ")
 
-	l2, err := lua.LoadDump(d, nil)
+	l2, err := lua.LoadDump(d)
 	if err != nil {
 		panic(err)
 	}
@@ -61,9 +61,14 @@ func main() {
 	d2 := l2.Dump()
 	data2, _ := ordjson.MarshalIndent(d2, " ", " ")
 
-	dmp := diffmatchpatch.New()
-	diffs := dmp.DiffMain(string(data), string(data2), false)
-	fmt.Println(dmp.DiffPrettyText(diffs))
-	fmt.Println(len(makeGzip(data2)))
+	patch, _ := ordjson.MarshalIndent(dump.Diff(d, d2), " ", " ")
+	fmt.Println(string(patch))
+	fmt.Println(len(data), len(makeGzip(data2)), len(patch))
+
+	var bin bytes.Buffer
+	if err := dump.Encode(&bin, d2); err != nil {
+		panic(err)
+	}
+	fmt.Println(bin.Len(), len(makeGzip(bin.Bytes())))
 
 }
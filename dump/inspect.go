@@ -0,0 +1,294 @@
+package dump
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Thread is a thread of a snapshot with its reconstructed call stack.
+type Thread struct {
+	Ptr    Ptr
+	Status string  // "running", "normal", "suspended" or "dead"
+	Frames []Frame // innermost first
+}
+
+// Frame is a call frame of a Thread.
+type Frame struct {
+	Func   string // described as in Lua stack tracebacks
+	Source string // "[G]" for Go functions
+	Line   int    // current line, 0 if unknown
+	Locals []Local
+}
+
+// Local is a local variable of a Frame.
+type Local struct {
+	Name  string
+	Value Value
+}
+
+// Threads returns the threads of d with their call stacks, the main thread
+// first. Snapshots are read as they are, no code is run.
+func Threads(d Data) []Thread {
+	var ptrs []Ptr
+	if d.G != nil && d.States[d.G.MainThread] != nil {
+		ptrs = append(ptrs, d.G.MainThread)
+	}
+	for _, p := range sortedPtrs(d.States) {
+		if d.G == nil || p != d.G.MainThread {
+			ptrs = append(ptrs, p)
+		}
+	}
+	threads := make([]Thread, 0, len(ptrs))
+	for _, p := range ptrs {
+		threads = append(threads, Thread{Ptr: p, Status: threadStatus(d, p), Frames: frames(d, p)})
+	}
+	return threads
+}
+
+func threadStatus(d Data, p Ptr) string {
+	if d.States[p].Dead {
+		return "dead"
+	}
+	if d.G == nil {
+		return "suspended"
+	}
+	if p == d.G.CurrentThread {
+		return "running"
+	}
+	// threads that resumed the running one, tampered snapshots may have
+	// cycles
+	visited := map[Ptr]bool{d.G.CurrentThread: true}
+	for s := d.States[d.G.CurrentThread]; s != nil && s.Parent != "" && !visited[s.Parent]; s = d.States[s.Parent] {
+		if s.Parent == p {
+			return "normal"
+		}
+		visited[s.Parent] = true
+	}
+	return "suspended"
+}
+
+func frames(d Data, p Ptr) []Frame {
+	s := d.States[p]
+	stack := d.CallFrameStacks[s.Stack]
+	if stack == nil {
+		return nil
+	}
+	var reg []Value
+	if r := d.Registries[s.Reg]; r != nil {
+		reg = r.Array
+	}
+	var frames []Frame
+	for i := stack.Sp - 1; i >= 0 && i < len(stack.Array); i-- {
+		cf := d.CallFrames[stack.Array[i]]
+		if cf == nil || d.Functions[cf.Fn] == nil {
+			continue
+		}
+		fn := d.Functions[cf.Fn]
+		f := Frame{Source: "[G]", Func: frameFuncName(d, p, cf, fn)}
+		if fp := d.FunctionProtos[fn.Proto]; !fn.IsG && fp != nil {
+			pc := cf.Pc - 1
+			f.Source = fp.SourceName
+			if pc >= 0 && pc < len(fp.DbgSourcePositions) {
+				f.Line = fp.DbgSourcePositions[pc]
+			}
+			n := 0
+			for _, lp := range fp.DbgLocals {
+				li := d.DbgLocalInfos[lp]
+				if li == nil || li.StartPc >= pc {
+					break
+				}
+				if pc < li.EndPc {
+					local := Local{Name: li.Name}
+					if r := cf.LocalBase + n; r < len(reg) {
+						local.Value = reg[r]
+					}
+					f.Locals = append(f.Locals, local)
+					n++
+				}
+			}
+		}
+		frames = append(frames, f)
+	}
+	return frames
+}
+
+// frameFuncName mirrors LState.formattedFrameFuncName.
+func frameFuncName(d Data, p Ptr, cf *CallFrame, fn *Function) string {
+	parent := d.CallFrames[cf.Parent]
+	if parent == nil && (d.G == nil || p == d.G.MainThread) {
+		return "main chunk"
+	}
+	if fn.IsG {
+		if fn.GFunction != "" {
+			return fmt.Sprintf("function '%s'", fn.GFunction)
+		}
+		return "function (anonymous)"
+	}
+	fp := d.FunctionProtos[fn.Proto]
+	if fp == nil {
+		return "function ?"
+	}
+	anonymous := fmt.Sprintf("function <%v:%v>", fp.SourceName, fp.LineDefined)
+	if parent == nil { // body of a coroutine
+		return anonymous
+	}
+	if pf := d.Functions[parent.Fn]; pf != nil && !pf.IsG && d.FunctionProtos[pf.Proto] != nil && cf.TailCall == 0 {
+		for _, call := range d.FunctionProtos[pf.Proto].DbgCalls {
+			if call.Pc == parent.Pc-1 && call.Name != "?" {
+				return fmt.Sprintf("function '%s'", call.Name)
+			}
+		}
+	}
+	return anonymous
+}
+
+// Stats holds the sizes of a snapshot.
+type Stats struct {
+	Counts      map[string]int // objects by Data field, such as "Tables"
+	StringBytes int            // bytes of strings in values, keys and constants
+	CodeBytes   int            // bytes of instructions
+	Tables      []TableSize    // largest first
+}
+
+// TableSize is the size of a table of a snapshot.
+type TableSize struct {
+	Ptr     Ptr
+	Entries int
+}
+
+// Measure returns the sizes of d.
+func Measure(d Data) Stats {
+	st := Stats{Counts: map[string]int{
+		"States":         len(d.States),
+		"Tables":         len(d.Tables),
+		"UserData":       len(d.UserData),
+		"Channels":       len(d.Channels),
+		"Functions":      len(d.Functions),
+		"FunctionProtos": len(d.FunctionProtos),
+		"Upvalues":       len(d.Upvalues),
+		"CallFrames":     len(d.CallFrames),
+		"Files":          len(d.Files),
+		"Externals":      len(d.Externals),
+	}}
+	values := func(vs []Value) {
+		for _, v := range vs {
+			st.StringBytes += len(v.String)
+		}
+	}
+	for _, p := range sortedPtrs(d.Tables) {
+		t := d.Tables[p]
+		values(t.Array)
+		for _, kv := range t.Dict {
+			values([]Value{kv.Key, kv.Value})
+		}
+		for k, v := range t.Strdict {
+			st.StringBytes += len(k) + len(v.String)
+		}
+		st.Tables = append(st.Tables, TableSize{Ptr: p, Entries: len(t.Array) + len(t.Dict) + len(t.Strdict)})
+	}
+	sort.SliceStable(st.Tables, func(i, j int) bool { return st.Tables[i].Entries > st.Tables[j].Entries })
+	for _, r := range d.Registries {
+		values(r.Array)
+	}
+	for _, uv := range d.Upvalues {
+		values([]Value{uv.Value})
+	}
+	for _, ch := range d.Channels {
+		values(ch.Values)
+	}
+	for _, fp := range d.FunctionProtos {
+		values(fp.Constants)
+		st.CodeBytes += 4 * len(fp.Code)
+	}
+	return st
+}
+
+// Inspect writes a report of d for operators: the call stacks of its
+// threads with their locals, the globals, and its sizes. Only the top
+// largest tables are listed.
+func Inspect(w io.Writer, d Data, top int) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "snapshot version %v, %v, instruction set %v\n", d.Version, d.LuaVersion, d.OpCodeHash)
+	for _, t := range Threads(d) {
+		fmt.Fprintf(&b, "\nthread %v (%v)\n", t.Ptr, t.Status)
+		for _, f := range t.Frames {
+			line := "?"
+			if f.Line > 0 {
+				line = fmt.Sprint(f.Line)
+			}
+			fmt.Fprintf(&b, "  %v:%v: in %v\n", f.Source, line, f.Func)
+			for _, l := range f.Locals {
+				fmt.Fprintf(&b, "      %v = %v\n", l.Name, formatValue(l.Value))
+			}
+		}
+	}
+	if d.G != nil {
+		if g := d.Tables[d.G.Global]; g != nil {
+			fmt.Fprintf(&b, "\nglobals\n")
+			names := make([]string, 0, len(g.Strdict))
+			for name := range g.Strdict {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				fmt.Fprintf(&b, "  %v = %v\n", name, formatValue(g.Strdict[name]))
+			}
+		}
+	} else {
+		fmt.Fprintf(&b, "\npartial snapshot of %v\n", formatValue(d.Root))
+	}
+	st := Measure(d)
+	fmt.Fprintf(&b, "\nsizes\n")
+	kinds := make([]string, 0, len(st.Counts))
+	for kind := range st.Counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		if st.Counts[kind] > 0 {
+			fmt.Fprintf(&b, "  %-15v %v\n", kind, st.Counts[kind])
+		}
+	}
+	fmt.Fprintf(&b, "  %-15v %v\n", "string bytes", st.StringBytes)
+	fmt.Fprintf(&b, "  %-15v %v\n", "code bytes", st.CodeBytes)
+	if top > len(st.Tables) {
+		top = len(st.Tables)
+	}
+	if top > 0 {
+		fmt.Fprintf(&b, "\nlargest tables\n")
+		for _, t := range st.Tables[:top] {
+			fmt.Fprintf(&b, "  %v %v entries\n", t.Ptr, t.Entries)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+var typeNames = []string{"nil", "boolean", "number", "string", "function", "userdata", "thread", "table", "channel"}
+
+// formatValue formats v like tostring, strings are quoted and shortened.
+func formatValue(v Value) string {
+	switch v.Type {
+	case VNil:
+		return "nil"
+	case VBool:
+		return fmt.Sprint(v.Bool)
+	case VNumber:
+		if v.Integer {
+			return fmt.Sprint(v.Int)
+		}
+		return fmt.Sprint(v.Number)
+	case VString:
+		s := v.String
+		if len(s) > 40 {
+			s = s[:40] + "..."
+		}
+		return fmt.Sprintf("%q", s)
+	}
+	if v.Type > 0 && v.Type < len(typeNames) {
+		return fmt.Sprintf("%v: %v", typeNames[v.Type], v.Ptr)
+	}
+	return fmt.Sprintf("?: %v", v.Ptr)
+}
@@ -0,0 +1,17 @@
+package dump
+
+// Journal holds the results of the nondeterministic calls made by a state
+// since recording began, so the run can be replayed exactly. It is stored
+// next to the snapshot the run started from, and encodes to JSON like Data.
+type Journal struct {
+	Entries []JournalEntry `json:",omitempty"`
+}
+
+// JournalEntry holds the results of one call.
+type JournalEntry struct {
+	Name    string  `json:",omitempty"` // name of the called function
+	Results []Value `json:",omitempty"`
+	// Refs holds partial snapshots of the results that are reference
+	// values, by result index. Their Results entries only hold the type.
+	Refs map[int]*Data `json:",omitempty"`
+}
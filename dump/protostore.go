@@ -0,0 +1,153 @@
+package dump
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"sync"
+)
+
+// Proto is a self-contained FunctionProto kept in a ProtoStore. Nested
+// prototypes are referred to by their hashes and debug locals are inlined.
+type Proto struct {
+	FunctionProto
+	Locals []DbgLocalInfo `json:",omitempty"`
+}
+
+// HashProto returns the content hash of p. Its Hash field is not hashed.
+// The hash is taken over a binary encoding of the fields that keeps the
+// bits of numbers, so constants like 1/0 and 0/0 are hashed exactly.
+// Constants must not refer to objects.
+func HashProto(p *Proto) (string, error) {
+	var h protoHasher
+	h.str(p.SourceName)
+	h.int(int64(p.LineDefined))
+	h.int(int64(p.LastLineDefined))
+	h.int(int64(p.NumUpvalues))
+	h.int(int64(p.NumParameters))
+	h.int(int64(p.IsVarArg))
+	h.int(int64(p.NumUsedRegisters))
+	h.int(int64(len(p.Code)))
+	for _, inst := range p.Code {
+		h.int(int64(inst))
+	}
+	h.int(int64(len(p.Constants)))
+	for i, v := range p.Constants {
+		if v.Ptr != "" {
+			return "", fmt.Errorf("dump: constant %v of proto refers to %v", i, v.Ptr)
+		}
+		h.int(int64(v.Type))
+		h.str(v.String)
+		h.bool(v.Bool)
+		h.int(int64(math.Float64bits(v.Number)))
+		h.bool(v.Integer)
+		h.int(v.Int)
+	}
+	h.ptrs(p.FunctionPrototypes)
+	h.int(int64(len(p.DbgSourcePositions)))
+	for _, pos := range p.DbgSourcePositions {
+		h.int(int64(pos))
+	}
+	h.ptrs(p.DbgLocals)
+	h.int(int64(len(p.DbgCalls)))
+	for _, call := range p.DbgCalls {
+		h.str(call.Name)
+		h.int(int64(call.Pc))
+	}
+	h.strs(p.DbgUpvalues)
+	h.strs(p.StringConstants)
+	h.int(int64(len(p.Locals)))
+	for _, local := range p.Locals {
+		h.str(local.Name)
+		h.int(int64(local.StartPc))
+		h.int(int64(local.EndPc))
+	}
+	sum := sha256.Sum256(h.b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// protoHasher encodes the fields of a Proto for HashProto. Slices and
+// strings are prefixed by their lengths, so different contents never
+// encode alike.
+type protoHasher struct {
+	b []byte
+}
+
+func (h *protoHasher) int(n int64) {
+	h.b = binary.AppendVarint(h.b, n)
+}
+
+func (h *protoHasher) bool(b bool) {
+	if b {
+		h.int(1)
+	} else {
+		h.int(0)
+	}
+}
+
+func (h *protoHasher) str(s string) {
+	h.int(int64(len(s)))
+	h.b = append(h.b, s...)
+}
+
+func (h *protoHasher) strs(ss []string) {
+	h.int(int64(len(ss)))
+	for _, s := range ss {
+		h.str(s)
+	}
+}
+
+func (h *protoHasher) ptrs(ps []Ptr) {
+	h.int(int64(len(ps)))
+	for _, p := range ps {
+		h.str(string(p))
+	}
+}
+
+// ProtoStore keeps function prototypes by their content hashes, so snapshots
+// of the same code can refer to them instead of repeating them.
+//
+// Put is called by every Dump for all prototypes of the snapshot and should
+// ignore hashes it already has.
+type ProtoStore interface {
+	Put(hash string, p *Proto) error
+	Get(hash string) (*Proto, error)
+}
+
+// MemProtoStore is a ProtoStore in memory. It is safe for concurrent use.
+type MemProtoStore struct {
+	mu     sync.RWMutex
+	protos map[string]*Proto
+}
+
+func NewMemProtoStore() *MemProtoStore {
+	return &MemProtoStore{protos: make(map[string]*Proto)}
+}
+
+func (s *MemProtoStore) Put(hash string, p *Proto) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.protos[hash]; !ok {
+		s.protos[hash] = p
+	}
+	return nil
+}
+
+func (s *MemProtoStore) Get(hash string) (*Proto, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.protos[hash]
+	if !ok {
+		return nil, fmt.Errorf("dump: proto %v is not in the store", hash)
+	}
+	return p, nil
+}
+
+// Len returns the number of stored prototypes.
+func (s *MemProtoStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.protos)
+}
@@ -0,0 +1,92 @@
+package dump
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestMemProtoStore(t *testing.T) {
+	d := testData()
+	var p Proto
+	for _, fp := range d.FunctionProtos {
+		p.FunctionProto = *fp
+		break
+	}
+	hash, err := HashProto(&p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Hash = hash
+	if again, _ := HashProto(&p); again != hash {
+		t.Error("hash must not depend on the Hash field")
+	}
+	s := NewMemProtoStore()
+	if _, err := s.Get(hash); err == nil {
+		t.Error("missing proto must be an error")
+	}
+	s.Put(hash, &p)
+	other := p
+	other.Code = nil
+	s.Put(hash, &other)
+	got, err := s.Get(hash)
+	if err != nil || got != &p || s.Len() != 1 {
+		t.Errorf("stored proto must be kept, got %v, %v", got, err)
+	}
+}
+
+func TestHashProto(t *testing.T) {
+	p := Proto{FunctionProto: FunctionProto{Constants: []Value{
+		{Type: 2, Number: math.Inf(1)},
+		{Type: 2, Number: math.NaN()},
+	}}}
+	hash, err := HashProto(&p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := HashProto(&p); again != hash {
+		t.Error("hash of NaN and infinity constants must be deterministic")
+	}
+	p.Constants[0].Number = math.Inf(-1)
+	if other, _ := HashProto(&p); other == hash {
+		t.Error("hash must depend on the bits of numbers")
+	}
+
+	// every field but Hash is hashed
+	set := func(v reflect.Value) {
+		switch v.Kind() {
+		case reflect.String:
+			v.SetString("x")
+		case reflect.Int, reflect.Int64:
+			v.SetInt(1)
+		case reflect.Uint8:
+			v.SetUint(1)
+		case reflect.Slice:
+			v.Set(reflect.MakeSlice(v.Type(), 1, 1))
+		default:
+			t.Fatalf("field of kind %v is not covered by the test", v.Kind())
+		}
+	}
+	var empty Proto
+	base, _ := HashProto(&empty)
+	fields := reflect.TypeOf(FunctionProto{})
+	for i := 0; i < fields.NumField(); i++ {
+		if fields.Field(i).Name == "Hash" {
+			continue
+		}
+		var q Proto
+		set(reflect.ValueOf(&q.FunctionProto).Elem().Field(i))
+		if h, err := HashProto(&q); err != nil || h == base {
+			t.Errorf("field %v is not hashed: %v", fields.Field(i).Name, err)
+		}
+	}
+	q := Proto{Locals: []DbgLocalInfo{{}}}
+	if h, _ := HashProto(&q); h == base {
+		t.Error("field Locals is not hashed")
+	}
+
+	p.Constants = []Value{{Type: 5, Ptr: "t"}}
+	if _, err := HashProto(&p); err == nil {
+		t.Error("constant referring to an object must be an error")
+	}
+}
@@ -0,0 +1,96 @@
+package dump
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+)
+
+// ErrUnsigned is returned by Verify for snapshots without a signature.
+var ErrUnsigned = errors.New("dump: snapshot is not signed")
+
+// ErrBadSignature is returned by Verify for snapshots that were modified
+// after signing or signed by another key.
+var ErrBadSignature = errors.New("dump: snapshot signature is invalid")
+
+// Signer signs snapshots, see Sign.
+type Signer interface {
+	Sign(msg []byte) ([]byte, error)
+}
+
+// Verifier checks signatures made by a Signer.
+type Verifier interface {
+	Verify(msg, sig []byte) bool
+}
+
+// Sign signs the canonical encoding of d and stores the signature in
+// d.Signature. Any later change of d invalidates the signature.
+func Sign(d *Data, s Signer) error {
+	msg, err := canonical(*d)
+	if err != nil {
+		return err
+	}
+	sig, err := s.Sign(msg)
+	if err != nil {
+		return err
+	}
+	d.Signature = sig
+	return nil
+}
+
+// Verify checks that d is signed and was not modified since.
+func Verify(d Data, v Verifier) error {
+	if len(d.Signature) == 0 {
+		return ErrUnsigned
+	}
+	msg, err := canonical(d)
+	if err != nil {
+		return err
+	}
+	if !v.Verify(msg, d.Signature) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// canonical returns the binary encoding of d without its signature. Encode
+// is deterministic and skips empty maps, so a snapshot has the same
+// canonical encoding after an Encode/Decode round trip.
+func canonical(d Data) ([]byte, error) {
+	d.Signature = nil
+	var b bytes.Buffer
+	if err := Encode(&b, d); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// HMAC signs and verifies snapshots with HMAC-SHA256.
+type HMAC []byte
+
+func (key HMAC) Sign(msg []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(msg)
+	return mac.Sum(nil), nil
+}
+
+func (key HMAC) Verify(msg, sig []byte) bool {
+	expected, _ := key.Sign(msg)
+	return hmac.Equal(expected, sig)
+}
+
+// Ed25519Signer signs snapshots with an ed25519 private key.
+type Ed25519Signer ed25519.PrivateKey
+
+func (key Ed25519Signer) Sign(msg []byte) ([]byte, error) {
+	return ed25519.Sign(ed25519.PrivateKey(key), msg), nil
+}
+
+// Ed25519Verifier verifies snapshots signed by Ed25519Signer.
+type Ed25519Verifier ed25519.PublicKey
+
+func (key Ed25519Verifier) Verify(msg, sig []byte) bool {
+	return ed25519.Verify(ed25519.PublicKey(key), msg, sig)
+}
@@ -0,0 +1,51 @@
+package dump
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+)
+
+func TestSignVerify(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, keys := range map[string]struct {
+		s Signer
+		v Verifier
+	}{
+		"hmac":    {HMAC("secret"), HMAC("secret")},
+		"ed25519": {Ed25519Signer(priv), Ed25519Verifier(pub)},
+	} {
+		d := testData()
+		if err := Verify(d, keys.v); err != ErrUnsigned {
+			t.Errorf("%v: unsigned snapshot: %v", name, err)
+		}
+		if err := Sign(&d, keys.s); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := Encode(&buf, d); err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := Decode(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Verify(decoded, keys.v); err != nil {
+			t.Errorf("%v: decoded snapshot: %v", name, err)
+		}
+
+		decoded.FunctionProtos["p1"].Code = []uint32{1, 2, 3}
+		if err := Verify(decoded, keys.v); err != ErrBadSignature {
+			t.Errorf("%v: tampered snapshot: %v", name, err)
+		}
+	}
+	d := testData()
+	Sign(&d, HMAC("secret"))
+	if err := Verify(d, HMAC("other")); err != ErrBadSignature {
+		t.Errorf("snapshot signed by another key: %v", err)
+	}
+}
@@ -0,0 +1,633 @@
+package dump
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Value types, equal to lua.LValueType.
+const (
+	VNil = iota
+	VBool
+	VNumber
+	VString
+	VFunction
+	VUserData
+	VThread
+	VTable
+	VChannel
+)
+
+// Instruction set limits, kept in sync with the lua package by a
+// compile-time check in opcode.go.
+const (
+	OpCodeMax    = 48
+	OpSetList    = 37
+	MaxRegisters = 200 // registers a function may use
+
+	opReturn    = 33
+	opBitRk     = 1 << 8
+	opMaxArgSbx = 0x3ffff >> 1
+)
+
+// Operand kinds of instructions, see OpModes.
+const (
+	ArgN     = iota // unused
+	ArgU            // a count or flag, not checked
+	ArgR            // a register
+	ArgRK           // a register, or a constant if the RK bit is set
+	ArgK            // a constant (Bx)
+	ArgProto        // a function prototype of the function (Bx)
+	ArgUpval        // an upvalue of the function
+	ArgJump         // a jump offset (sBx)
+)
+
+// Operand modes of instructions for the compiler of the lua package.
+const (
+	OpArgN = iota // unused
+	OpArgU        // used, but not a register or constant
+	OpArgR        // a register or a jump offset
+	OpArgK        // a constant or a register/constant
+)
+
+// Instruction formats.
+const (
+	OpTypeABC = iota
+	OpTypeABx
+	OpTypeASbx
+)
+
+// OpMode describes an instruction. Validate checks its operands by A, B, C
+// and Skip, instructions with a Bx or sBx operand use B for it. The other
+// fields are the properties the lua package builds its instruction table
+// from.
+type OpMode struct {
+	Name    string
+	A, B, C int
+	Skip    bool // the instruction may skip the next one
+
+	IsTest   bool
+	SetRegA  bool
+	ModeArgB int // OpArgN, OpArgU, OpArgR or OpArgK
+	ModeArgC int
+	Type     int // OpTypeABC, OpTypeABx or OpTypeASbx
+}
+
+// OpModes holds the OpMode of every instruction, indexed by opcode.
+var OpModes = [OpCodeMax + 1]OpMode{
+	{"MOVE", ArgR, ArgR, ArgN, false, false, true, OpArgR, OpArgN, OpTypeABC},
+	{"MOVEN", ArgR, ArgR, ArgU, false, false, true, OpArgR, OpArgN, OpTypeABC},
+	{"LOADK", ArgR, ArgK, ArgN, false, false, true, OpArgK, OpArgN, OpTypeABx},
+	{"LOADBOOL", ArgR, ArgU, ArgU, true, false, true, OpArgU, OpArgU, OpTypeABC},
+	{"LOADNIL", ArgR, ArgR, ArgN, false, false, true, OpArgR, OpArgN, OpTypeABC},
+	{"GETUPVAL", ArgR, ArgUpval, ArgN, false, false, true, OpArgU, OpArgN, OpTypeABC},
+	{"GETGLOBAL", ArgR, ArgK, ArgN, false, false, true, OpArgK, OpArgN, OpTypeABx},
+	{"GETTABLE", ArgR, ArgR, ArgRK, false, false, true, OpArgR, OpArgK, OpTypeABC},
+	{"GETTABLEKS", ArgR, ArgR, ArgRK, false, false, true, OpArgR, OpArgK, OpTypeABC},
+	{"SETGLOBAL", ArgR, ArgK, ArgN, false, false, false, OpArgK, OpArgN, OpTypeABx},
+	{"SETUPVAL", ArgR, ArgUpval, ArgN, false, false, false, OpArgU, OpArgN, OpTypeABC},
+	{"SETTABLE", ArgR, ArgRK, ArgRK, false, false, false, OpArgK, OpArgK, OpTypeABC},
+	{"SETTABLEKS", ArgR, ArgRK, ArgRK, false, false, false, OpArgK, OpArgK, OpTypeABC},
+	{"NEWTABLE", ArgR, ArgU, ArgU, false, false, true, OpArgU, OpArgU, OpTypeABC},
+	{"SELF", ArgR, ArgR, ArgRK, false, false, true, OpArgR, OpArgK, OpTypeABC},
+	{"ADD", ArgR, ArgRK, ArgRK, false, false, true, OpArgK, OpArgK, OpTypeABC},
+	{"SUB", ArgR, ArgRK, ArgRK, false, false, true, OpArgK, OpArgK, OpTypeABC},
+	{"MUL", ArgR, ArgRK, ArgRK, false, false, true, OpArgK, OpArgK, OpTypeABC},
+	{"DIV", ArgR, ArgRK, ArgRK, false, false, true, OpArgK, OpArgK, OpTypeABC},
+	{"MOD", ArgR, ArgRK, ArgRK, false, false, true, OpArgK, OpArgK, OpTypeABC},
+	{"POW", ArgR, ArgRK, ArgRK, false, false, true, OpArgK, OpArgK, OpTypeABC},
+	{"UNM", ArgR, ArgRK, ArgN, false, false, true, OpArgR, OpArgN, OpTypeABC},
+	{"NOT", ArgR, ArgR, ArgN, false, false, true, OpArgR, OpArgN, OpTypeABC},
+	{"LEN", ArgR, ArgRK, ArgN, false, false, true, OpArgR, OpArgN, OpTypeABC},
+	{"CONCAT", ArgR, ArgR, ArgR, false, false, true, OpArgR, OpArgR, OpTypeABC},
+	{"JMP", ArgN, ArgJump, ArgN, false, false, false, OpArgR, OpArgN, OpTypeASbx},
+	{"EQ", ArgU, ArgRK, ArgRK, true, true, false, OpArgK, OpArgK, OpTypeABC},
+	{"LT", ArgU, ArgRK, ArgRK, true, true, false, OpArgK, OpArgK, OpTypeABC},
+	{"LE", ArgU, ArgRK, ArgRK, true, true, false, OpArgK, OpArgK, OpTypeABC},
+	{"TEST", ArgR, ArgN, ArgU, true, true, true, OpArgR, OpArgU, OpTypeABC},
+	{"TESTSET", ArgR, ArgR, ArgU, true, true, true, OpArgR, OpArgU, OpTypeABC},
+	{"CALL", ArgR, ArgU, ArgU, false, false, true, OpArgU, OpArgU, OpTypeABC},
+	{"TAILCALL", ArgR, ArgU, ArgU, false, false, true, OpArgU, OpArgU, OpTypeABC},
+	{"RETURN", ArgU, ArgU, ArgN, false, false, false, OpArgU, OpArgN, OpTypeABC},
+	{"FORLOOP", ArgR, ArgJump, ArgN, false, false, true, OpArgR, OpArgN, OpTypeASbx},
+	{"FORPREP", ArgR, ArgJump, ArgN, true, false, true, OpArgR, OpArgN, OpTypeASbx},
+	{"TFORLOOP", ArgR, ArgN, ArgU, true, true, false, OpArgN, OpArgU, OpTypeABC},
+	{"SETLIST", ArgR, ArgU, ArgU, false, false, false, OpArgU, OpArgU, OpTypeABC},
+	{"CLOSE", ArgU, ArgN, ArgN, false, false, false, OpArgN, OpArgN, OpTypeABC},
+	{"CLOSURE", ArgR, ArgProto, ArgN, false, false, true, OpArgU, OpArgN, OpTypeABx},
+	{"VARARG", ArgR, ArgU, ArgN, false, false, true, OpArgU, OpArgN, OpTypeABC},
+	{"NOP", ArgN, ArgN, ArgN, false, false, false, OpArgR, OpArgN, OpTypeASbx},
+	{"IDIV", ArgR, ArgRK, ArgRK, false, false, true, OpArgK, OpArgK, OpTypeABC},
+	{"BAND", ArgR, ArgRK, ArgRK, false, false, true, OpArgK, OpArgK, OpTypeABC},
+	{"BOR", ArgR, ArgRK, ArgRK, false, false, true, OpArgK, OpArgK, OpTypeABC},
+	{"BXOR", ArgR, ArgRK, ArgRK, false, false, true, OpArgK, OpArgK, OpTypeABC},
+	{"SHL", ArgR, ArgRK, ArgRK, false, false, true, OpArgK, OpArgK, OpTypeABC},
+	{"SHR", ArgR, ArgRK, ArgRK, false, false, true, OpArgK, OpArgK, OpTypeABC},
+	{"BNOT", ArgR, ArgRK, ArgN, false, false, true, OpArgR, OpArgN, OpTypeABC},
+}
+
+// ValidationError describes a single problem of a snapshot.
+type ValidationError struct {
+	Kind  string // object kind, the name of a Data field such as "Tables"
+	Ptr   Ptr    // object with the problem, empty for Data.G
+	Field string // field of the object, such as "Array[3]"
+	Msg   string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%v[%q].%v: %v", e.Kind, e.Ptr, e.Field, e.Msg)
+}
+
+// Errors is a list of problems of a snapshot.
+type Errors []error
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("dump: %v problems found: %v", len(e), strings.Join(msgs, "; "))
+}
+
+type validator struct {
+	d    Data
+	errs []error
+
+	kind  string
+	ptr   Ptr
+	field string
+}
+
+// Validate checks that a snapshot is consistent enough to be loaded:
+// referenced objects exist, stack and registry positions are in range, the
+// registers of every Lua call frame fit in its registry and function code
+// consists of valid instructions, whose registers (below NumUsedRegisters),
+// constants, function prototypes, upvalues and jump targets are in range.
+// Errors are returned as *ValidationError in a deterministic order.
+//
+// A snapshot without G is a partial snapshot of its Root value.
+func Validate(d Data) []error {
+	v := validator{d: d}
+	v.global()
+	for _, p := range sortedPtrs(d.Externals) {
+		v.external(p, d.Externals[p])
+	}
+	for _, p := range sortedPtrs(d.States) {
+		v.state(p, d.States[p])
+	}
+	for _, p := range sortedPtrs(d.Tables) {
+		v.table(p, d.Tables[p])
+	}
+	for _, p := range sortedPtrs(d.UserData) {
+		v.userData(p, d.UserData[p])
+	}
+	for _, p := range sortedPtrs(d.Files) {
+		v.at("Files", p, "")
+		if v.notNil(d.Files[p] != nil) {
+			v.mustRef("", "UserData", p)
+		}
+	}
+	for _, p := range sortedPtrs(d.Channels) {
+		v.channel(p, d.Channels[p])
+	}
+	for _, p := range sortedPtrs(d.CallFrames) {
+		v.callFrame(p, d.CallFrames[p])
+	}
+	for _, p := range sortedPtrs(d.CallFrameStacks) {
+		v.callFrameStack(p, d.CallFrameStacks[p])
+	}
+	for _, p := range sortedPtrs(d.Registries) {
+		v.registry(p, d.Registries[p])
+	}
+	for _, p := range sortedPtrs(d.Functions) {
+		v.function(p, d.Functions[p])
+	}
+	for _, p := range sortedPtrs(d.FunctionProtos) {
+		v.functionProto(p, d.FunctionProtos[p])
+	}
+	for _, p := range sortedPtrs(d.DbgLocalInfos) {
+		v.at("DbgLocalInfos", p, "")
+		v.notNil(d.DbgLocalInfos[p] != nil)
+	}
+	for _, p := range sortedPtrs(d.Upvalues) {
+		v.upvalue(p, d.Upvalues[p])
+	}
+	return v.errs
+}
+
+func (v *validator) at(kind string, p Ptr, field string) {
+	v.kind, v.ptr, v.field = kind, p, field
+}
+
+func (v *validator) errorf(format string, args ...interface{}) {
+	v.errs = append(v.errs, &ValidationError{Kind: v.kind, Ptr: v.ptr, Field: v.field, Msg: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) notNil(ok bool) bool {
+	if !ok {
+		v.errorf("object is nil")
+	}
+	return ok
+}
+
+// ref checks that p is empty or refers to an object of a given kind.
+func (v *validator) ref(field string, kind string, p Ptr) {
+	if p == "" {
+		return
+	}
+	if ext, ok := v.d.Externals[p]; ok {
+		if ext != nil && ext.Type != kindTypes[kind] {
+			v.field = field
+			v.errorf("external %q is not in %v", p, kind)
+		}
+		return
+	}
+	var ok bool
+	switch kind {
+	case "States":
+		_, ok = v.d.States[p]
+	case "Tables":
+		_, ok = v.d.Tables[p]
+	case "UserData":
+		_, ok = v.d.UserData[p]
+	case "Channels":
+		_, ok = v.d.Channels[p]
+	case "CallFrames":
+		_, ok = v.d.CallFrames[p]
+	case "CallFrameStacks":
+		_, ok = v.d.CallFrameStacks[p]
+	case "Registries":
+		_, ok = v.d.Registries[p]
+	case "Functions":
+		_, ok = v.d.Functions[p]
+	case "FunctionProtos":
+		_, ok = v.d.FunctionProtos[p]
+	case "DbgLocalInfos":
+		_, ok = v.d.DbgLocalInfos[p]
+	case "Upvalues":
+		_, ok = v.d.Upvalues[p]
+	}
+	if !ok {
+		v.field = field
+		v.errorf("%v[%q] does not exist", kind, p)
+	}
+}
+
+// mustRef is ref for references that can not be empty.
+func (v *validator) mustRef(field string, kind string, p Ptr) {
+	if p == "" {
+		v.field = field
+		v.errorf("reference to %v is empty", kind)
+		return
+	}
+	v.ref(field, kind, p)
+}
+
+func (v *validator) value(field string, val Value) {
+	switch val.Type {
+	case VNil, VBool, VNumber, VString:
+	case VFunction:
+		v.mustRef(field, "Functions", val.Ptr)
+	case VUserData:
+		v.mustRef(field, "UserData", val.Ptr)
+	case VThread:
+		v.mustRef(field, "States", val.Ptr)
+	case VTable:
+		v.mustRef(field, "Tables", val.Ptr)
+	case VChannel:
+		v.mustRef(field, "Channels", val.Ptr)
+	default:
+		v.field = field
+		v.errorf("unsupported value type %v", val.Type)
+	}
+}
+
+func (v *validator) global() {
+	if v.d.G == nil {
+		v.at("Root", "", "")
+		v.value("", v.d.Root)
+		return
+	}
+	v.at("G", "", "")
+	g := v.d.G
+	if !v.notNil(g != nil) {
+		return
+	}
+	v.mustRef("MainThread", "States", g.MainThread)
+	v.mustRef("CurrentThread", "States", g.CurrentThread)
+	v.mustRef("Registry", "Tables", g.Registry)
+	v.mustRef("Global", "Tables", g.Global)
+	for _, k := range sortedKeys(g.BuiltinMts) {
+		v.value(fmt.Sprintf("BuiltinMts[%v]", k), g.BuiltinMts[k])
+	}
+}
+
+// kindTypes are the value types of objects that can be external.
+var kindTypes = map[string]int{
+	"States":    VThread,
+	"Tables":    VTable,
+	"UserData":  VUserData,
+	"Functions": VFunction,
+	"Channels":  VChannel,
+}
+
+func (v *validator) external(p Ptr, ext *External) {
+	v.at("Externals", p, "")
+	if !v.notNil(ext != nil) {
+		return
+	}
+	if ext.Name == "" {
+		v.field = "Name"
+		v.errorf("name is empty")
+	}
+	switch ext.Type {
+	case VFunction, VUserData, VThread, VTable, VChannel:
+	default:
+		v.field = "Type"
+		v.errorf("unsupported value type %v", ext.Type)
+	}
+}
+
+func (v *validator) state(p Ptr, s *State) {
+	v.at("States", p, "")
+	if !v.notNil(s != nil) {
+		return
+	}
+	v.ref("Parent", "States", s.Parent)
+	v.mustRef("Env", "Tables", s.Env)
+	v.mustRef("Reg", "Registries", s.Reg)
+	v.mustRef("Stack", "CallFrameStacks", s.Stack)
+	v.ref("CurrentFrame", "CallFrames", s.CurrentFrame)
+	v.ref("UVCache", "Upvalues", s.UVCache)
+
+	// frames of a state address its registry
+	reg, stack := v.d.Registries[s.Reg], v.d.CallFrameStacks[s.Stack]
+	if reg == nil || stack == nil {
+		return
+	}
+	frames := append([]Ptr{s.CurrentFrame}, stack.Array...)
+	for i, fp := range frames {
+		cf := v.d.CallFrames[fp]
+		if cf == nil {
+			continue
+		}
+		v.field = fmt.Sprintf("Stack[%v]", i-1)
+		if i == 0 {
+			v.field = "CurrentFrame"
+		}
+		if cf.LocalBase > reg.Len || cf.ReturnBase > reg.Len {
+			v.errorf("frame %q is out of the registry (size %v)", fp, reg.Len)
+			continue
+		}
+		// the registers of a Lua function lie in the registry
+		if fn := v.d.Functions[cf.Fn]; fn != nil && !fn.IsG {
+			if proto := v.d.FunctionProtos[fn.Proto]; proto != nil && !proto.InStore() && cf.LocalBase+int(proto.NumUsedRegisters) > reg.Len {
+				v.errorf("the %v registers of frame %q are out of the registry (size %v)", proto.NumUsedRegisters, fp, reg.Len)
+			}
+		}
+	}
+}
+
+func (v *validator) table(p Ptr, t *Table) {
+	v.at("Tables", p, "")
+	if !v.notNil(t != nil) {
+		return
+	}
+	v.value("Metatable", t.Metatable)
+	for i, val := range t.Array {
+		v.value(fmt.Sprintf("Array[%v]", i), val)
+	}
+	for i, kv := range t.Dict {
+		v.value(fmt.Sprintf("Dict[%v].Key", i), kv.Key)
+		v.value(fmt.Sprintf("Dict[%v].Value", i), kv.Value)
+		if kv.Key.Type == VNil {
+			v.errorf("nil key")
+		}
+	}
+	for _, k := range sortedKeys(t.Strdict) {
+		v.value(fmt.Sprintf("Strdict[%q]", k), t.Strdict[k])
+	}
+}
+
+func (v *validator) userData(p Ptr, ud *UserData) {
+	v.at("UserData", p, "")
+	if !v.notNil(ud != nil) {
+		return
+	}
+	v.value("Metatable", ud.Metatable)
+	v.ref("Env", "Tables", ud.Env)
+	if ud.TypeMetatable != "" && ud.Metatable != (Value{}) {
+		v.at("UserData", p, "TypeMetatable")
+		v.errorf("userdata has both a metatable and a type metatable")
+	}
+}
+
+func (v *validator) channel(p Ptr, ch *Channel) {
+	v.at("Channels", p, "")
+	if !v.notNil(ch != nil) {
+		return
+	}
+	if ch.Error != "" {
+		v.at("Channels", p, "Error")
+		v.errorf("channel was not saved: %v", ch.Error)
+		v.at("Channels", p, "")
+	}
+	if ch.Cap < 0 || len(ch.Values) > ch.Cap {
+		v.errorf("invalid size: %v values, capacity %v", len(ch.Values), ch.Cap)
+	}
+	for i, val := range ch.Values {
+		v.value(fmt.Sprintf("Values[%v]", i), val)
+	}
+}
+
+func (v *validator) callFrame(p Ptr, cf *CallFrame) {
+	v.at("CallFrames", p, "")
+	if !v.notNil(cf != nil) {
+		return
+	}
+	v.ref("Fn", "Functions", cf.Fn)
+	v.ref("Parent", "CallFrames", cf.Parent)
+	v.field = ""
+	if cf.Base < 0 || cf.LocalBase < cf.Base || cf.ReturnBase < 0 {
+		v.errorf("invalid frame bases %v/%v/%v", cf.Base, cf.LocalBase, cf.ReturnBase)
+	}
+	if fn := v.d.Functions[cf.Fn]; fn != nil && !fn.IsG {
+		if proto := v.d.FunctionProtos[fn.Proto]; proto != nil && !proto.InStore() && (cf.Pc < 0 || cf.Pc > len(proto.Code)) {
+			v.field = "Pc"
+			v.errorf("pc %v is out of the code (size %v)", cf.Pc, len(proto.Code))
+		}
+	}
+}
+
+func (v *validator) callFrameStack(p Ptr, cfs *CallFrameStack) {
+	v.at("CallFrameStacks", p, "")
+	if !v.notNil(cfs != nil) {
+		return
+	}
+	if len(cfs.Array) > cfs.Len || cfs.Sp < 0 || cfs.Sp > cfs.Len {
+		v.errorf("invalid size: %v frames, sp %v, size %v", len(cfs.Array), cfs.Sp, cfs.Len)
+	}
+	for i, fp := range cfs.Array {
+		v.ref(fmt.Sprintf("Array[%v]", i), "CallFrames", fp)
+	}
+}
+
+func (v *validator) registry(p Ptr, r *Registry) {
+	v.at("Registries", p, "")
+	if !v.notNil(r != nil) {
+		return
+	}
+	if len(r.Array) > r.Len || r.Top < 0 || r.Top > r.Len {
+		v.errorf("invalid size: %v values, top %v, size %v", len(r.Array), r.Top, r.Len)
+	}
+	for i, val := range r.Array {
+		v.value(fmt.Sprintf("Array[%v]", i), val)
+	}
+}
+
+func (v *validator) function(p Ptr, fn *Function) {
+	v.at("Functions", p, "")
+	if !v.notNil(fn != nil) {
+		return
+	}
+	v.ref("Env", "Tables", fn.Env)
+	if fn.IsG {
+		if fn.GFunction == "" {
+			v.field = "GFunction"
+			v.errorf("gfunction name is empty")
+		}
+	} else {
+		v.mustRef("Proto", "FunctionProtos", fn.Proto)
+	}
+	for i, uv := range fn.Upvalues {
+		v.ref(fmt.Sprintf("Upvalues[%v]", i), "Upvalues", uv)
+	}
+}
+
+func (v *validator) functionProto(p Ptr, fp *FunctionProto) {
+	v.at("FunctionProtos", p, "")
+	if !v.notNil(fp != nil) {
+		return
+	}
+	if fp.InStore() {
+		if len(fp.Constants) > 0 || len(fp.FunctionPrototypes) > 0 || len(fp.DbgLocals) > 0 {
+			v.errorf("proto in a store has content")
+		}
+		return
+	}
+	if fp.NumUsedRegisters > MaxRegisters {
+		v.field = "NumUsedRegisters"
+		v.errorf("%v registers are more than %v", fp.NumUsedRegisters, MaxRegisters)
+	}
+	if len(fp.Code) == 0 || fp.Code[len(fp.Code)-1]>>26 != opReturn {
+		v.field = "Code"
+		v.errorf("code does not end with RETURN")
+	}
+	for i := 0; i < len(fp.Code); i++ {
+		v.field = fmt.Sprintf("Code[%v]", i)
+		op := int(fp.Code[i] >> 26)
+		if op > OpCodeMax {
+			v.errorf("invalid opcode %v", op)
+			continue
+		}
+		v.instruction(fp, i)
+		if op == OpSetList && (fp.Code[i]>>9)&0x1ff == 0 {
+			i++ // the next word is an operand of SETLIST
+		}
+	}
+	for i, c := range fp.Constants {
+		v.value(fmt.Sprintf("Constants[%v]", i), c)
+	}
+	for i, proto := range fp.FunctionPrototypes {
+		v.mustRef(fmt.Sprintf("FunctionPrototypes[%v]", i), "FunctionProtos", proto)
+	}
+	for i, li := range fp.DbgLocals {
+		v.mustRef(fmt.Sprintf("DbgLocals[%v]", i), "DbgLocalInfos", li)
+	}
+}
+
+// instruction checks the operands of the instruction at pc of fp, so that
+// running it cannot index out of the registers, constants, function
+// prototypes, upvalues or code of the function.
+func (v *validator) instruction(fp *FunctionProto, pc int) {
+	inst := fp.Code[pc]
+	op := int(inst >> 26)
+	mode := OpModes[op]
+	a := int(inst>>18) & 0xff
+	b := int(inst & 0x1ff)
+	c := int(inst>>9) & 0x1ff
+	bx := int(inst & 0x3ffff)
+	check := func(name string, kind, arg int) {
+		switch kind {
+		case ArgR:
+			if arg >= int(fp.NumUsedRegisters) {
+				v.errorf("%v: register %v is out of the %v registers of %v", name, arg, fp.NumUsedRegisters, mode.Name)
+			}
+		case ArgRK:
+			if arg&opBitRk != 0 {
+				if k := arg &^ opBitRk; k >= len(fp.Constants) {
+					v.errorf("%v: constant %v is out of the %v constants of %v", name, k, len(fp.Constants), mode.Name)
+				}
+			} else if arg >= int(fp.NumUsedRegisters) {
+				v.errorf("%v: register %v is out of the %v registers of %v", name, arg, fp.NumUsedRegisters, mode.Name)
+			}
+		case ArgK:
+			if bx >= len(fp.Constants) {
+				v.errorf("%v: constant %v is out of the %v constants of %v", name, bx, len(fp.Constants), mode.Name)
+			}
+		case ArgProto:
+			if bx >= len(fp.FunctionPrototypes) {
+				v.errorf("%v: function prototype %v is out of the %v of %v", name, bx, len(fp.FunctionPrototypes), mode.Name)
+			}
+		case ArgUpval:
+			if arg >= int(fp.NumUpvalues) {
+				v.errorf("%v: upvalue %v is out of the %v upvalues of %v", name, arg, fp.NumUpvalues, mode.Name)
+			}
+		case ArgJump:
+			if target := pc + 1 + bx - opMaxArgSbx; target < 0 || target >= len(fp.Code) {
+				v.errorf("%v: jump target %v is out of the code of %v", name, target, mode.Name)
+			}
+		}
+	}
+	check("A", mode.A, a)
+	check("B", mode.B, b)
+	check("C", mode.C, c)
+	next := pc + 1
+	switch {
+	case op == OpSetList && c == 0:
+		next++ // the operand word
+	case mode.Name == "MOVEN":
+		next += c // the moves it runs
+	case mode.Name == "FORPREP":
+		next = pc + 2 + bx - opMaxArgSbx // an empty loop skips the FORLOOP
+	case mode.Skip && (mode.Name != "LOADBOOL" || c != 0):
+		next++
+	}
+	if next >= len(fp.Code) && op != opReturn && mode.Name != "JMP" {
+		v.errorf("%v runs past the end of the code", mode.Name)
+	}
+}
+
+func (v *validator) upvalue(p Ptr, uv *Upvalue) {
+	v.at("Upvalues", p, "")
+	if !v.notNil(uv != nil) {
+		return
+	}
+	v.ref("Next", "Upvalues", uv.Next)
+	v.ref("Reg", "Registries", uv.Reg)
+	v.value("Value", uv.Value)
+	if reg := v.d.Registries[uv.Reg]; reg != nil && !uv.Closed && (uv.Index < 0 || uv.Index >= reg.Len) {
+		v.field = "Index"
+		v.errorf("index %v is out of the registry (size %v)", uv.Index, reg.Len)
+	}
+}
+
+func sortedKeys(m map[string]Value) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,120 @@
+package dump
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	d := testData()
+	d.Tables["global"].Array = append(d.Tables["global"].Array, Value{Type: VTable, Ptr: "gone"})
+	d.FunctionProtos["p2"].Code = []uint32{37 << 26, 63 << 26, 63 << 26}
+	d.UserData["typed"].Metatable = Value{Type: VTable, Ptr: "strmt"}
+	errs := Validate(d)
+	got := map[string]bool{}
+	for _, err := range errs {
+		got[err.Error()] = true
+	}
+	for _, msg := range []string{
+		`CallFrames["cf"].Parent: CallFrames["cf0"] does not exist`,
+		`CallFrameStacks["main.stack"].Array[0]: CallFrames["cf0"] does not exist`,
+		`Upvalues["uv"].Next: Upvalues["uv2"] does not exist`,
+		`Tables["global"].Array[2]: Tables["gone"] does not exist`,
+		`FunctionProtos["p2"].Code[2]: invalid opcode 63`,
+		`UserData["typed"].TypeMetatable: userdata has both a metatable and a type metatable`,
+		`Channels["chErr"].Error: channel was not saved: unbuffered channel`,
+	} {
+		if !got[msg] {
+			t.Errorf("%v is not reported", msg)
+		}
+	}
+	if got[`FunctionProtos["p2"].Code[1]: invalid opcode 63`] {
+		t.Error("operand of SETLIST is decoded as an instruction")
+	}
+	if len(Validate(d)) != len(errs) {
+		t.Error("Validate is not deterministic")
+	}
+}
+
+func TestValidateOperands(t *testing.T) {
+	abc := func(op, a, b, c int) uint32 { return uint32(op<<26 | a<<18 | c<<9 | b) }
+	abx := func(op, a, bx int) uint32 { return uint32(op<<26 | a<<18 | bx) }
+	d := testData()
+	// p1 has 3 constants, 1 upvalue and 1 function prototype
+	d.FunctionProtos["p1"].Code = []uint32{
+		abx(2, 0, 99),               // LOADK of a missing constant
+		abc(7, 0, 1, opBitRk|50),    // GETTABLE with a missing constant
+		abc(0, 0, 4, 0),             // MOVE from a register out of range
+		abx(39, 0, 5),               // CLOSURE of a missing prototype
+		abc(5, 0, 3, 0),             // GETUPVAL of a missing upvalue
+		abx(25, 0, opMaxArgSbx+100), // JMP out of the code
+		abx(25, 0, opMaxArgSbx-10),  // JMP before the code
+		abc(26, 0, 1, 2),            // EQ skipping past the end
+		abc(33, 0, 1, 0),            // RETURN
+	}
+	d.FunctionProtos["p2"].Code = []uint32{abc(0, 0, 1, 0)}
+	got := map[string]bool{}
+	for _, err := range Validate(d) {
+		got[err.Error()] = true
+	}
+	for _, msg := range []string{
+		`FunctionProtos["p1"].Code[0]: B: constant 99 is out of the 3 constants of LOADK`,
+		`FunctionProtos["p1"].Code[1]: C: constant 50 is out of the 3 constants of GETTABLE`,
+		`FunctionProtos["p1"].Code[2]: B: register 4 is out of the 4 registers of MOVE`,
+		`FunctionProtos["p1"].Code[3]: B: function prototype 5 is out of the 1 of CLOSURE`,
+		`FunctionProtos["p1"].Code[4]: B: upvalue 3 is out of the 1 upvalues of GETUPVAL`,
+		`FunctionProtos["p1"].Code[5]: B: jump target 106 is out of the code of JMP`,
+		`FunctionProtos["p1"].Code[6]: B: jump target -3 is out of the code of JMP`,
+		`FunctionProtos["p1"].Code[7]: EQ runs past the end of the code`,
+		`FunctionProtos["p2"].Code: code does not end with RETURN`,
+		`FunctionProtos["p2"].Code[0]: MOVE runs past the end of the code`,
+	} {
+		if !got[msg] {
+			t.Errorf("%v is not reported, got %v", msg, got)
+		}
+	}
+	for _, err := range Validate(testData()) {
+		if strings.HasPrefix(err.Error(), `FunctionProtos["p1"]`) {
+			t.Errorf("valid code is reported: %v", err)
+		}
+	}
+}
+
+func TestValidateRegisters(t *testing.T) {
+	d := testData()
+	d.FunctionProtos["p2"].NumUsedRegisters = MaxRegisters + 1
+	d.Registries["main.reg"].Len = 5 // frame "cf" of p1 needs 2+4
+	got := map[string]bool{}
+	for _, err := range Validate(d) {
+		got[err.Error()] = true
+	}
+	for _, msg := range []string{
+		`FunctionProtos["p2"].NumUsedRegisters: 201 registers are more than 200`,
+		`States["main"].CurrentFrame: the 4 registers of frame "cf" are out of the registry (size 5)`,
+	} {
+		if !got[msg] {
+			t.Errorf("%v is not reported, got %v", msg, got)
+		}
+	}
+	d.Registries["main.reg"].Len = 6
+	for _, err := range Validate(d) {
+		if strings.HasPrefix(err.Error(), `States["main"]`) {
+			t.Errorf("frame in the registry is reported: %v", err)
+		}
+	}
+}
+
+func TestValidatePartial(t *testing.T) {
+	d := Data{
+		Root:      Value{Type: VTable, Ptr: "t"},
+		Externals: map[Ptr]*External{"@_G": {Name: "_G", Type: VTable}, "@print": {Name: "print", Type: VFunction}},
+		Tables: map[Ptr]*Table{"t": {
+			Array:   []Value{{Type: VTable, Ptr: "@_G"}},
+			Strdict: map[string]Value{"f": {Type: VTable, Ptr: "@print"}},
+		}},
+	}
+	errs := Validate(d)
+	if len(errs) != 1 || errs[0].Error() != `Tables["t"].Strdict["f"]: external "@print" is not in Tables` {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+}
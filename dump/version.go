@@ -0,0 +1,46 @@
+package dump
+
+import (
+	"fmt"
+)
+
+// Version is the schema version of Data written by this package. It is
+// increased on every change of the types in this package or of the
+// instruction set that makes older snapshots unloadable.
+const Version = 1
+
+// Migration upgrades a snapshot of one schema version to the next one.
+type Migration func(d Data) (Data, error)
+
+// Migrations upgrade snapshots of older schema versions. The migration
+// stored under version v receives a snapshot of version v and returns one
+// of version v+1. Snapshots written before versioning have version 0 and
+// neither LuaVersion nor OpCodeHash, their migration sets both.
+type Migrations map[int]Migration
+
+// Register registers a migration from version from to from+1.
+func (m Migrations) Register(from int, fn Migration) {
+	m[from] = fn
+}
+
+// Migrate upgrades d to Version by applying migrations one by one.
+// The caller's snapshot is not modified unless a migration modifies it.
+func (m Migrations) Migrate(d Data) (Data, error) {
+	if d.Version > Version {
+		return d, fmt.Errorf("dump: snapshot version %v is newer than supported version %v", d.Version, Version)
+	}
+	for d.Version < Version {
+		from := d.Version
+		fn, ok := m[from]
+		if !ok {
+			return d, fmt.Errorf("dump: no migration from snapshot version %v to %v", from, from+1)
+		}
+		next, err := fn(d)
+		if err != nil {
+			return d, fmt.Errorf("dump: migration from version %v: %v", from, err)
+		}
+		d = next
+		d.Version = from + 1
+	}
+	return d, nil
+}
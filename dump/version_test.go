@@ -0,0 +1,33 @@
+package dump
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	old := testData()
+	old.Version = 0
+	delete(old.Tables["global"].Strdict, "a")
+
+	m := Migrations{}
+	if _, err := m.Migrate(old); err == nil || !strings.Contains(err.Error(), "no migration from snapshot version 0") {
+		t.Errorf("missing migration must be reported, but got %v", err)
+	}
+	m.Register(0, func(d Data) (Data, error) {
+		d.Tables["global"].Strdict["a"] = Value{Type: VString, String: "migrated"}
+		return d, nil
+	})
+	d, err := m.Migrate(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Version != Version || d.Tables["global"].Strdict["a"].String != "migrated" {
+		t.Errorf("snapshot is not migrated: %v", mustJSON(t, d))
+	}
+
+	d.Version = Version + 1
+	if _, err := m.Migrate(d); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("newer snapshot must be refused, but got %v", err)
+	}
+}
@@ -0,0 +1,1022 @@
+package lua
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"weak"
+
+	"github.com/gladkikhartem/gopher-lua/dump"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+func testDumpUserData(v interface{}) dump.UserData {
+	return dump.UserData{Data: v}
+}
+
+func testParseUserData(L *LState, ud dump.UserData) (*LUserData, error) {
+	return &LUserData{Value: ud.Data}, nil
+}
+
+func testDump(L *LState) dump.Data {
+	return L.Dump(DumpOptions{UserData: testDumpUserData})
+}
+
+func testLoad(d dump.Data) (*LState, error) {
+	return LoadDump(d, LoadOptions{UserData: testParseUserData})
+}
+
+func TestDumpStableIdentity(t *testing.T) {
+	L := NewState(Options{SkipOpenLibs: true})
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+    t1 = {1, 2, {}}
+    t2 = {x = t1}
+    t2[t1] = t1
+    function f() return t1 end
+    `)
+	d1 := testDump(L)
+	d2 := testDump(L)
+	if p := dump.Diff(d1, d2); !p.IsEmpty() {
+		t.Fatalf("two dumps of an unchanged state differ: %v", p)
+	}
+
+	errorIfScriptFail(t, L, `t3 = {}`)
+	d3 := testDump(L)
+	p := dump.Diff(d2, d3)
+	errorIfNotEqual(t, 1, len(p.Added.Tables))
+	errorIfNotEqual(t, 1, len(p.Modified.Tables))
+	errorIfNotEqual(t, 0, len(p.Removed["Tables"]))
+
+	L2, err := testLoad(d3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d4 := testDump(L2)
+	if p := dump.Diff(d3, d4); !p.IsEmpty() {
+		t.Fatalf("dump of a loaded state differs from its snapshot: %v", p)
+	}
+
+	errorIfScriptFail(t, L2, `t4 = {}; t3 = nil`)
+	d5 := testDump(L2)
+	p = dump.Diff(d4, d5)
+	errorIfNotEqual(t, 1, len(p.Added.Tables))
+	for ptr := range p.Added.Tables {
+		if _, ok := d4.Tables[ptr]; ok {
+			t.Errorf("new table got a Ptr of an existing one: %v", ptr)
+		}
+	}
+	errorIfNotEqual(t, 1, len(p.Removed["Tables"]))
+	for _, ptr := range p.Removed["Tables"] {
+		if _, ok := d3.Tables[ptr]; !ok {
+			t.Errorf("removed table was not in the loaded snapshot: %v", ptr)
+		}
+	}
+}
+
+func TestDumpPatchEncode(t *testing.T) {
+	L := NewState(Options{SkipOpenLibs: true})
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+    kept, dropped = {1, 2}, {x = 1}
+    function count() return #kept end
+    `)
+	d1 := testDump(L)
+	errorIfScriptFail(t, L, `
+    dropped = nil
+    kept[3] = {y = 2}
+    added = function() return kept[3].y end
+    `)
+	d2 := testDump(L)
+
+	p := dump.Diff(d1, d2)
+	errorIfNotEqual(t, 1, len(p.Removed["Tables"]))
+	var buf bytes.Buffer
+	if err := dump.EncodePatch(&buf, p); err != nil {
+		t.Fatal(err)
+	}
+	p2, err := dump.DecodePatch(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want, got bytes.Buffer
+	if err := dump.Encode(&want, d2); err != nil {
+		t.Fatal(err)
+	}
+	if err := dump.Encode(&got, dump.Apply(d1, p2)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want.Bytes(), got.Bytes()) {
+		t.Fatal("decoded patch applied to the old snapshot differs from the new one")
+	}
+	L2, err := testLoad(dump.Apply(d1, p2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer L2.Close()
+	errorIfScriptFail(t, L2, `ok = dropped == nil and count() == 3 and added() == 2`)
+	errorIfNotEqual(t, LTrue, L2.GetGlobal("ok"))
+}
+
+func TestDumpStableIdentitySharedProtos(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+    f1 = loadstring("return 1")
+    f2 = loadstring("return 1")
+    `)
+	protoPtr := func(d dump.Data, name string) dump.Ptr {
+		return d.Functions[d.Tables[d.G.Global].Strdict[name].Ptr].Proto
+	}
+	d := testDump(L)
+	p1, p2 := protoPtr(d, "f1"), protoPtr(d, "f2")
+	if p1 == p2 {
+		t.Fatal("protos of separately loaded chunks must have their own Ptrs")
+	}
+	lowest := p1
+	if p2 < p1 {
+		lowest = p2
+	}
+	for i := 0; i < 10; i++ {
+		L2, err := testLoad(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d2 := testDump(L2)
+		L2.Close()
+		errorIfNotEqual(t, lowest, protoPtr(d2, "f1"))
+		errorIfNotEqual(t, lowest, protoPtr(d2, "f2"))
+	}
+}
+
+func TestDumpIdentityIsWeak(t *testing.T) {
+	L := NewState(Options{SkipOpenLibs: true})
+	defer L.Close()
+	errorIfScriptFail(t, L, `t = {}`)
+	wt := weak.Make(L.GetGlobal("t").(*LTable))
+	testDump(L)
+	errorIfScriptFail(t, L, `t = nil`)
+	for i := 0; i < 5 && wt.Value() != nil; i++ {
+		runtime.GC()
+	}
+	if wt.Value() != nil {
+		t.Error("a dumped table is kept alive by the snapshot identities")
+	}
+
+	// objects still alive keep their Ptrs
+	errorIfScriptFail(t, L, `u = {}`)
+	d1 := testDump(L)
+	runtime.GC()
+	d2 := testDump(L)
+	if p := dump.Diff(d1, d2); !p.IsEmpty() {
+		t.Errorf("two dumps of an unchanged state differ: %v", p)
+	}
+}
+
+func TestDumpStdLib(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+    gen = coroutine.wrap(function() for i = 1, 3 do coroutine.yield(i) end end)
+    fmt = string.format
+    `)
+	L2, err := testLoad(testDump(L))
+	if err != nil {
+		t.Fatal(err)
+	}
+	errorIfScriptFail(t, L2, `
+    local t = {}
+    for i, v in ipairs({"a", "b"}) do table.insert(t, v .. i) end
+    for k, v in pairs({x = 1}) do table.insert(t, k .. v) end
+    table.insert(t, gen())
+    result = fmt("%s-%d", table.concat(t, ","), math.max(1, 2))
+    `)
+	errorIfNotEqual(t, LString("a1,b2,x1,1-2"), L2.GetGlobal("result"))
+}
+
+func TestDumpGFunctionRegistry(t *testing.T) {
+	double := func(L *LState) int {
+		L.Push(L.CheckNumber(1) * 2)
+		return 1
+	}
+	L := NewState(Options{SkipOpenLibs: true})
+	defer L.Close()
+	L.SetGlobal("double", L.NewFunction(double))
+	reg := NewGFunctionRegistry()
+	reg.Register("double", double)
+	d := L.Dump(DumpOptions{UserData: testDumpUserData, GFunctions: reg})
+	errorIfNotEqual(t, dump.Ptr("double"), d.Functions[d.Tables[d.G.Global].Strdict["double"].Ptr].GFunction)
+
+	L2, err := LoadDump(d, LoadOptions{UserData: testParseUserData, GFunctions: reg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errorIfScriptFail(t, L2, `result = double(21)`)
+	errorIfNotEqual(t, LNumber(42), L2.GetGlobal("result"))
+
+	if _, err := testLoad(d); err == nil || !strings.Contains(err.Error(), `"double" is not registered`) {
+		t.Errorf("unregistered function must fail to load, but got %v", err)
+	}
+}
+
+func TestDumpSuspendedCoroutines(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+    co = coroutine.create(function(a)
+      local n = 0
+      inc = function() n = n + 1 end
+      local b = coroutine.yield(a + 1)
+      local c = coroutine.yield(n + b)
+      return a + b + c
+    end)
+    assert(select(2, coroutine.resume(co, 1)) == 2)
+
+    outer = coroutine.create(function()
+      local inner = coroutine.create(function(x)
+        while true do x = coroutine.yield(x * 2) end
+      end)
+      local _, v = coroutine.resume(inner, 1)
+      while true do
+        local arg = coroutine.yield(v)
+        _, v = coroutine.resume(inner, arg)
+      end
+    end)
+    assert(select(2, coroutine.resume(outer)) == 2)
+
+    gen = coroutine.wrap(function()
+      for i = 1, 3 do coroutine.yield(i) end
+    end)
+    assert(gen() == 1)
+
+    bad = coroutine.create(function() coroutine.yield() error("boom") end)
+    coroutine.resume(bad)
+    dead = coroutine.create(function() end)
+    coroutine.resume(dead)
+    `)
+
+	L2, err := testLoad(testDump(L))
+	if err != nil {
+		t.Fatal(err)
+	}
+	errorIfScriptFail(t, L2, `
+    inc(); inc()
+    local ok, v = coroutine.resume(co, 10)
+    assert(ok and v == 12, tostring(v))
+    ok, v = coroutine.resume(co, 100)
+    assert(ok and v == 111, tostring(v))
+    assert(coroutine.status(co) == "dead")
+
+    assert(select(2, coroutine.resume(outer, 5)) == 10)
+    assert(select(2, coroutine.resume(outer, 7)) == 14)
+
+    assert(gen() == 2)
+    assert(gen() == 3)
+
+    local ok, msg = coroutine.resume(bad)
+    assert(not ok and msg:find("boom"), msg)
+    assert(coroutine.status(dead) == "dead")
+    assert(not coroutine.resume(dead))
+    `)
+
+	errorIfScriptFail(t, L, `
+    co = coroutine.create(function(a)
+      local b = coroutine.yield(a * 2)
+      return a + b
+    end)
+    coroutine.resume(co, 3)
+    `)
+	var buf bytes.Buffer
+	if err := dump.Encode(&buf, testDump(L)); err != nil {
+		t.Fatal(err)
+	}
+	d, err := dump.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	L3, err := testLoad(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	co := L3.GetGlobal("co").(*LState)
+	st, err, values := L3.Resume(co, nil, LNumber(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	errorIfNotEqual(t, ResumeOK, st)
+	errorIfNotEqual(t, 1, len(values))
+	errorIfNotEqual(t, LNumber(7), values[0])
+}
+
+func TestDumpValidate(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+    co = coroutine.create(function() local t = {1, 2} coroutine.yield() return t end)
+    coroutine.resume(co)
+    `)
+	if errs := dump.Validate(testDump(L)); len(errs) != 0 {
+		t.Fatalf("valid snapshot has errors: %v", errs)
+	}
+
+	d := testDump(L)
+	d.Tables[d.G.Global].Strdict["broken"] = dump.Value{Type: int(LTTable), Ptr: "missing"}
+	for _, r := range d.Registries {
+		r.Top = r.Len + 1
+		break
+	}
+	for _, fp := range d.FunctionProtos {
+		if len(fp.Code) > 0 {
+			fp.Code[0] = 63 << 26
+			break
+		}
+	}
+	_, err := testLoad(d)
+	errs, ok := err.(dump.Errors)
+	if !ok {
+		t.Fatalf("dump.Errors expected, but got %v", err)
+	}
+	kinds := map[string]bool{}
+	for _, err := range errs {
+		kinds[err.(*dump.ValidationError).Kind] = true
+	}
+	for _, kind := range []string{"Tables", "Registries", "FunctionProtos"} {
+		if !kinds[kind] {
+			t.Errorf("problem in %v is not reported: %v", kind, errs)
+		}
+	}
+}
+
+func TestDumpOpModes(t *testing.T) {
+	// opProps is built from dump.OpModes, indexed by the opcodes of this package
+	for op, name := range map[int]string{OP_MOVE: "MOVE", OP_JMP: "JMP", OP_SETLIST: "SETLIST", OP_NOP: "NOP", OP_BNOT: "BNOT"} {
+		if opProps[op].Name != name {
+			t.Errorf("opcode %v is %v, not %v", op, opProps[op].Name, name)
+		}
+	}
+	// dump.Validate checks register operands against NumUsedRegisters
+	var check func(proto *FunctionProto)
+	check = func(proto *FunctionProto) {
+		for pc := 0; pc < len(proto.Code); pc++ {
+			inst := proto.Code[pc]
+			if reg := opMaxRegister(inst); reg >= int(proto.NumUsedRegisters) {
+				t.Errorf("%v at %v uses register %v of %v", opToString(inst), pc, reg, proto.NumUsedRegisters)
+			}
+			if opGetOpCode(inst) == OP_CLOSURE {
+				pc += int(proto.FunctionPrototypes[opGetArgBx(inst)].NumUpvalues)
+			}
+		}
+		for _, p := range proto.FunctionPrototypes {
+			check(p)
+		}
+	}
+	chunk, err := parse.Parse(strings.NewReader(`
+		function f1() local t, u = {}, {}; t.f = function() end end
+		function f2(t) for k, v in pairs(t) do t[k] = v end end
+	`), "<string>")
+	errorIfNotNil(t, err)
+	proto, err := Compile(chunk, "<string>")
+	errorIfNotNil(t, err)
+	check(proto)
+}
+
+func TestDumpFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gopher-lua-dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	input := filepath.Join(dir, "input.txt")
+	if err := ioutil.WriteFile(input, []byte("line1\nline2\nline3\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	L := NewState()
+	defer L.Close()
+	L.SetGlobal("dir", LString(dir))
+	errorIfScriptFail(t, L, `
+    report = io.open(dir .. "/report.txt", "w")
+    report:setvbuf("full", 1024)
+    report:write("first,")
+    input = io.open(dir .. "/input.txt", "r")
+    assert(input:read("*l") == "line1")
+    tmp = io.tmpfile()
+    tmp:write("temp data")
+    closed = io.open(dir .. "/input.txt", "r")
+    closed:close()
+    `)
+	d := L.Dump(DumpOptions{Files: true})
+	L.Close()
+
+	L2, err := LoadDump(d, LoadOptions{Files: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer L2.Close()
+	errorIfScriptFail(t, L2, `
+    report:write("second")
+    report:close()
+    assert(input:read("*l") == "line2")
+    tmp:seek("set", 0)
+    assert(tmp:read("*a") == "temp data")
+    assert(io.type(closed) == "closed file")
+    assert(io.type(io.stdout) == "file")
+    assert(io.type(io.stderr) == "file")
+    `)
+	b, err := ioutil.ReadFile(filepath.Join(dir, "report.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	errorIfNotEqual(t, "first,second", string(b))
+
+	L3, err := LoadDump(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer L3.Close()
+	errorIfScriptFail(t, L3, `
+    assert(io.type(report) == "closed file")
+    assert(io.type(tmp) == "closed file")
+    assert(io.type(io.stdout) == "file")
+    assert(report:write("x") == nil)
+    `)
+
+	os.Remove(input)
+	L4, err := LoadDump(d, LoadOptions{Files: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer L4.Close()
+	errorIfScriptFail(t, L4, `
+    assert(io.type(input) == "closed file")
+    assert(input:read("*l") == nil)
+    assert(io.type(report) == "file")
+    report:close()
+    assert(io.type(tmp) == "file")
+    `)
+}
+
+func TestDumpVersion(t *testing.T) {
+	L := NewState(Options{SkipOpenLibs: true})
+	defer L.Close()
+	errorIfScriptFail(t, L, `x = 1`)
+	d := testDump(L)
+	errorIfNotEqual(t, dump.Version, d.Version)
+	errorIfNotEqual(t, LuaVersion, d.LuaVersion)
+
+	changed := testDump(L)
+	changed.OpCodeHash = "other"
+	if _, err := testLoad(changed); err == nil || !strings.Contains(err.Error(), "instruction set") {
+		t.Errorf("snapshot of another instruction set must be refused, but got %v", err)
+	}
+
+	// the code of the Lua 5.1 instruction set runs unchanged
+	lua51 := testDump(L)
+	lua51.OpCodeHash = "ecaf818c70648adf"
+	if _, err := testLoad(lua51); err != nil {
+		t.Errorf("snapshot of the Lua 5.1 instruction set must load, but got %v", err)
+	}
+
+	old := testDump(L)
+	old.Version = 0
+	if _, err := testLoad(old); err == nil || !strings.Contains(err.Error(), "no migration") {
+		t.Errorf("old snapshot without a migration must be refused, but got %v", err)
+	}
+	migrations := dump.Migrations{}
+	migrations.Register(0, func(d dump.Data) (dump.Data, error) {
+		d.Tables[d.G.Global].Strdict["x"] = dump.Value{Type: int(LTNumber), Number: 2}
+		return d, nil
+	})
+	L2, err := LoadDump(old, LoadOptions{UserData: testParseUserData, Migrations: migrations})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errorIfNotEqual(t, LNumber(2), L2.GetGlobal("x"))
+
+	// snapshots written before versioning carry no runtime, and snapshots of
+	// older instruction sets another hash, the migration sets the current ones
+	for _, hash := range []string{"", "0123456789abcdef"} {
+		v0 := testDump(L)
+		v0.Version, v0.LuaVersion, v0.OpCodeHash = 0, "", hash
+		if _, err := LoadDump(v0, LoadOptions{UserData: testParseUserData, Migrations: migrations}); err == nil || !strings.Contains(err.Error(), "instruction set") {
+			t.Errorf("migrated snapshot of instruction set %q must be refused, but got %v", hash, err)
+		}
+		upgrade := dump.Migrations{}
+		upgrade.Register(0, func(d dump.Data) (dump.Data, error) {
+			d.LuaVersion, d.OpCodeHash = LuaVersion, OpCodeHash
+			return d, nil
+		})
+		L3, err := LoadDump(v0, LoadOptions{UserData: testParseUserData, Migrations: upgrade})
+		if err != nil {
+			t.Fatal(err)
+		}
+		errorIfNotEqual(t, LTNumber, L3.GetGlobal("x").Type())
+		L3.Close()
+	}
+}
+
+func TestDumpValue(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+    shared = {name = "shared"}
+    entity = {hp = 10, pos = {x = 1, y = 2}, shared = shared, log = print}
+    entity.self = entity
+    local hits = 0
+    entity.hit = function(n)
+      hits = hits + n
+      entity.hp = entity.hp - n
+      return string.format("%d/%d", hits, entity.hp)
+    end
+    `)
+	d := L.DumpValue(L.GetGlobal("entity"), DumpOptions{
+		UserData:  testDumpUserData,
+		Externals: map[string]LValue{"_G": L.G.Global, "shared": L.GetGlobal("shared"), "print": L.GetGlobal("print")},
+	})
+	if d.G != nil {
+		t.Fatal("partial snapshot must not contain the global state")
+	}
+	if _, ok := d.Tables[d.Tables[d.Root.Ptr].Strdict["shared"].Ptr]; ok {
+		t.Error("external table is saved")
+	}
+	var buf bytes.Buffer
+	if err := dump.Encode(&buf, d); err != nil {
+		t.Fatal(err)
+	}
+	d, err := dump.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	L2 := NewState()
+	defer L2.Close()
+	errorIfScriptFail(t, L2, `shared = {name = "other"}`)
+	lv, err := LoadValue(L2, d, LoadOptions{
+		UserData:  testParseUserData,
+		Externals: map[string]LValue{"_G": L2.G.Global, "shared": L2.GetGlobal("shared"), "print": L2.GetGlobal("print")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	L2.SetGlobal("entity", lv)
+	errorIfScriptFail(t, L2, `
+    assert(entity.self == entity)
+    assert(entity.shared == shared)
+    assert(entity.log == print)
+    assert(entity.pos.y == 2)
+    assert(entity.hit(3) == "3/7")
+    assert(entity.hit(2) == "5/5")
+    `)
+
+	if _, err := LoadValue(L2, d, LoadOptions{Externals: map[string]LValue{}}); err == nil || !strings.Contains(err.Error(), `external "shared" is not bound`) {
+		t.Errorf("unbound external must be reported, but got %v", err)
+	}
+	if _, err := LoadDump(d); err == nil {
+		t.Error("partial snapshot must not be loaded by LoadDump")
+	}
+	if _, err := LoadValue(L2, testDump(L)); err == nil {
+		t.Error("full snapshot must not be loaded by LoadValue")
+	}
+}
+
+func TestDumpValueDefaultExternals(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+    co = coroutine.create(function(a)
+      local b = coroutine.yield(a)
+      return string.rep(a, b)
+    end)
+    coroutine.resume(co, "ab")
+    `)
+	d := L.DumpValue(L.GetGlobal("co"))
+	names := map[string]bool{}
+	for _, ext := range d.Externals {
+		names[ext.Name] = true
+	}
+	if len(names) != 2 || !names["_G"] || !names["coroutine.yield"] {
+		t.Errorf("unexpected externals: %v", names)
+	}
+	errorIfNotEqual(t, 0, len(d.Tables))
+
+	L2 := NewState()
+	defer L2.Close()
+	co, err := LoadValue(L2, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	L2.SetGlobal("co", co)
+	errorIfScriptFail(t, L2, `
+    local ok, v = coroutine.resume(co, 3)
+    assert(ok and v == "ababab", tostring(v))
+    `)
+}
+
+func TestFork(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.SetGlobal("double", L.NewFunction(func(L *LState) int {
+		L.Push(L.CheckNumber(1) * 2)
+		return 1
+	}))
+	ud := L.NewUserData()
+	ud.Value = &struct{ n int }{1}
+	L.SetGlobal("ud", ud)
+	errorIfScriptFail(t, L, `
+    counter = {n = 0}
+    local step = 1
+    function inc() counter.n = counter.n + step; step = step * 2 end
+    gen = coroutine.wrap(function() for i = 1, 3 do coroutine.yield(double(i)) end end)
+    inc()
+    assert(gen() == 2)
+    `)
+
+	L2, err := L.Fork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer L2.Close()
+	errorIfScriptFail(t, L, `inc(); assert(counter.n == 3)`)
+	errorIfScriptFail(t, L2, `
+    assert(counter.n == 1)
+    inc(); inc()
+    assert(counter.n == 7)
+    assert(gen() == 4)
+    assert(gen() == 6)
+    `)
+	errorIfScriptFail(t, L, `assert(counter.n == 3); assert(gen() == 4)`)
+	if L2.GetGlobal("ud").(*LUserData).Value != ud.Value {
+		t.Error("userdata value must be shared with the fork")
+	}
+	if L2.GetGlobal("ud") == LValue(ud) {
+		t.Error("userdata must be copied")
+	}
+}
+
+func TestForkSettings(t *testing.T) {
+	L := NewState(Options{InstructionLimit: 100000, PauseOnInstructionLimit: true, MemoryLimit: 1 << 22})
+	defer L.Close()
+	L.SetJournal(NewJournal(nil))
+	errorIfScriptFail(t, L, `
+    calls = 0
+    function noop() end
+    debug.sethook(function() calls = calls + 1 end, "c")
+    `)
+	co, _ := L.NewThread()
+	var hooked []*LState
+	co.SetHook(MaskCall, 0, func(L *LState, event string, line int) { hooked = append(hooked, L) })
+	L.SetGlobal("co", co)
+	remaining, _ := L.InstructionBudget()
+
+	L2, err := L.Fork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer L2.Close()
+	if n, ok := L2.InstructionBudget(); !ok || n != remaining {
+		t.Errorf("fork must keep the budget %v, but got %v %v", remaining, n, ok)
+	}
+	errorIfNotEqual(t, true, L2.Options.PauseOnInstructionLimit)
+	errorIfNotEqual(t, 1<<22, L2.G.mem.limit)
+	if L2.G.journal != nil {
+		t.Error("fork must not share the journal")
+	}
+	errorIfScriptFail(t, L2, `
+    local before = calls
+    tostring(1)
+    assert(calls > before)
+    `)
+	errorIfNotEqual(t, LNumber(0), L.GetGlobal("calls"))
+	co2 := L2.GetGlobal("co").(*LState)
+	if _, _, fn := co2.GetHook(); fn == nil {
+		t.Fatal("fork must keep the hooks of coroutines")
+	}
+	if _, err, _ := L2.Resume(co2, L2.GetGlobal("noop").(*LFunction)); err != nil {
+		t.Fatal(err)
+	}
+	if len(hooked) == 0 || hooked[0] != co2 {
+		t.Error("hook of the forked coroutine must be called with it")
+	}
+}
+
+func TestLoadDumpSettings(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `function spin() while true do end end`)
+	d := testDump(L)
+
+	L2, err := LoadDump(d, LoadOptions{InstructionLimit: 1000, MemoryLimit: 1 << 22})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer L2.Close()
+	errorIfNotEqual(t, 1<<22, L2.G.mem.limit)
+	errorIfNotEqual(t, 1000, L2.Options.InstructionLimit)
+	errorIfNotApiError(t, L2.DoString(`spin()`), ApiErrorBudget)
+
+	L3, err := LoadDump(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer L3.Close()
+	if _, ok := L3.InstructionBudget(); ok || L3.G.mem.limit != 0 {
+		t.Error("limits must not be saved in snapshots")
+	}
+}
+
+func TestDumpChannels(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+    queue = channel.make(4)
+    queue:send("first")
+    queue:send({n = 2})
+    holder = {q = queue}
+    function pop() local ok, v = queue:receive() return v end
+    done = channel.make(1)
+    done:close()
+    `)
+	d := testDump(L)
+	var buf bytes.Buffer
+	if err := dump.Encode(&buf, d); err != nil {
+		t.Fatal(err)
+	}
+	d2, err := dump.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errorIfScriptFail(t, L, `
+    assert(pop() == "first")
+    assert(pop().n == 2)
+    `)
+
+	L2, err := testLoad(d2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer L2.Close()
+	errorIfScriptFail(t, L2, `
+    assert(holder.q == queue)
+    holder.q:send("third")
+    assert(pop() == "first")
+    assert(pop().n == 2)
+    assert(pop() == "third")
+    assert(not done:receive())
+    `)
+}
+
+func TestDumpChannelsUnchanged(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	closed := make(chan LValue, 2)
+	closed <- LString("kept")
+	close(closed)
+	sync := make(chan LValue)
+	sent := make(chan struct{})
+	go func() {
+		sync <- LString("blocked")
+		close(sent)
+	}()
+	full := make(chan LValue, 1)
+	full <- LTrue
+
+	for name, ch := range map[string]chan LValue{"closed": closed, "sync": sync, "full": full} {
+		L.SetGlobal("ch", LChannel(ch))
+		_, err := testLoad(testDump(L))
+		if err == nil || !strings.Contains(err.Error(), "channel was not saved") {
+			t.Errorf("%v channel must be refused, but got %v", name, err)
+		}
+	}
+	if v, ok := <-closed; !ok || v != LString("kept") {
+		t.Error("dump must keep the values of a closed channel")
+	}
+	if v := <-sync; v != LString("blocked") {
+		t.Error("dump must not receive from a blocked sender")
+	}
+	<-sent
+	errorIfNotEqual(t, 1, len(full))
+}
+
+func TestDumpSigned(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `function f() return 42 end`)
+	key := dump.HMAC("secret")
+	opts := LoadOptions{UserData: testParseUserData, Verifier: key}
+
+	d := testDump(L)
+	if _, err := LoadDump(d, opts); err != dump.ErrUnsigned {
+		t.Errorf("unsigned snapshot must be refused, but got %v", err)
+	}
+	if err := dump.Sign(&d, key); err != nil {
+		t.Fatal(err)
+	}
+	L2, err := LoadDump(d, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errorIfScriptFail(t, L2, `assert(f() == 42)`)
+
+	for _, fp := range d.FunctionProtos {
+		fp.Code = append([]uint32{}, fp.Code...)
+		fp.Code[0] = 0
+	}
+	if _, err := LoadDump(d, opts); err != dump.ErrBadSignature {
+		t.Errorf("tampered snapshot must be refused, but got %v", err)
+	}
+}
+
+func TestDumpInfiniteConstants(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+    function consts() local inf, nan = 1/0, 0/0 return inf, nan end
+    `)
+	store := dump.NewMemProtoStore()
+	for _, d := range []dump.Data{testDump(L), L.Dump(DumpOptions{UserData: testDumpUserData, Protos: store})} {
+		L2, err := LoadDump(d, LoadOptions{UserData: testParseUserData, Protos: store})
+		if err != nil {
+			t.Fatal(err)
+		}
+		errorIfScriptFail(t, L2, `
+    local inf, nan = consts()
+    assert(inf > 0 and inf == inf * 2 and nan ~= nan)
+    `)
+		L2.Close()
+	}
+}
+
+func TestDumpProtoStore(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+    function outer(x)
+      return function(y) return x + y, "sum" end
+    end
+    add2 = outer(2)
+    `)
+	store := dump.NewMemProtoStore()
+	d := L.Dump(DumpOptions{UserData: testDumpUserData, Protos: store})
+	if store.Len() == 0 {
+		t.Fatal("protos must be put into the store")
+	}
+	for ptr, fp := range d.FunctionProtos {
+		if !fp.InStore() {
+			t.Errorf("proto %v must only refer to the store", ptr)
+		}
+	}
+	var b bytes.Buffer
+	if err := dump.Encode(&b, d); err != nil {
+		t.Fatal(err)
+	}
+	d, err := dump.Decode(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := testLoad(d); err == nil {
+		t.Error("snapshot must not load without its store")
+	}
+	cache := NewProtoCache()
+	opts := LoadOptions{UserData: testParseUserData, Protos: store, ProtoCache: cache}
+	L1, err := LoadDump(d, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	L2, err := LoadDump(d, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errorIfScriptFail(t, L1, `local v, s = add2(40); assert(v == 42 and s == "sum")`)
+	errorIfScriptFail(t, L2, `assert(outer(1)(1) == 2)`)
+	p1 := L1.GetGlobal("add2").(*LFunction).Proto
+	p2 := L2.GetGlobal("add2").(*LFunction).Proto
+	if p1 != p2 {
+		t.Error("protos must be shared by states loaded with the same cache")
+	}
+
+	for ptr := range d.FunctionProtos {
+		p, _ := store.Get(d.FunctionProtos[ptr].Hash)
+		p.Code = append([]uint32{}, p.Code...)
+		p.Code[0] = 0
+	}
+	if _, err := LoadDump(d, LoadOptions{UserData: testParseUserData, Protos: store}); err == nil {
+		t.Error("tampered proto must be refused")
+	}
+}
+
+type testPoint struct{ X, Y float64 }
+
+func (p *testPoint) LuaDump() dump.UserData {
+	return dump.UserData{Type: "point", Data: []float64{p.X, p.Y}}
+}
+
+func TestDumpLuaDumpable(t *testing.T) {
+	pointX := func(L *LState) int {
+		L.Push(LNumber(L.CheckUserData(1).Value.(*testPoint).X))
+		return 1
+	}
+	setup := func(L *LState) {
+		mt := L.NewTypeMetatable("point")
+		L.SetField(mt, "__index", L.SetFuncs(L.NewTable(), map[string]LGFunction{"x": pointX}))
+	}
+	reg := NewGFunctionRegistry()
+	reg.Register("point.x", pointX)
+	types := UserDataTypes{}
+	types.Register("point", func(L *LState, ud dump.UserData) (interface{}, error) {
+		xy := ud.Data.([]float64)
+		return &testPoint{xy[0], xy[1]}, nil
+	})
+
+	L := NewState()
+	defer L.Close()
+	setup(L)
+	ud := L.NewUserData()
+	ud.Value = &testPoint{1, 2}
+	L.SetMetatable(ud, L.GetTypeMetatable("point"))
+	L.SetGlobal("p", ud)
+	d := L.Dump(DumpOptions{GFunctions: reg})
+	dud := d.UserData[d.Tables[d.G.Global].Strdict["p"].Ptr]
+	errorIfNotEqual(t, "point", dud.Type)
+	errorIfNotEqual(t, "point", dud.TypeMetatable)
+
+	L2, err := LoadDump(d, LoadOptions{GFunctions: reg, UserDataTypes: types})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer L2.Close()
+	errorIfScriptFail(t, L2, `assert(p:x() == 1)`)
+	errorIfNotEqual(t, L2.GetTypeMetatable("point"), L2.GetGlobal("p").(*LUserData).Metatable)
+
+	v := L.DumpValue(ud)
+	L3 := NewState()
+	defer L3.Close()
+	if _, err := LoadValue(L3, v, LoadOptions{UserDataTypes: types}); err == nil || !strings.Contains(err.Error(), `type metatable "point" is not registered`) {
+		t.Errorf("missing type metatable must be reported, but got %v", err)
+	}
+	setup(L3)
+	lv, err := LoadValue(L3, v, LoadOptions{UserDataTypes: types})
+	if err != nil {
+		t.Fatal(err)
+	}
+	L3.SetGlobal("p", lv)
+	errorIfScriptFail(t, L3, `assert(p:x() == 1)`)
+}
+
+func TestDumpInspect(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+    local function step(n)
+      local doubled = n * 2
+      coroutine.yield(doubled)
+    end
+    worker = coroutine.create(function(name)
+      step(21)
+    end)
+    coroutine.resume(worker, "job")
+    `)
+	d := testDump(L)
+	threads := dump.Threads(d)
+	errorIfNotEqual(t, 2, len(threads))
+	errorIfNotEqual(t, "running", threads[0].Status)
+	worker := threads[1]
+	errorIfNotEqual(t, "suspended", worker.Status)
+	errorIfNotEqual(t, 2, len(worker.Frames))
+	errorIfNotEqual(t, "function <<string>:6>", worker.Frames[1].Func)
+	step := worker.Frames[0]
+	errorIfNotEqual(t, "<string>:4: function 'step'", fmt.Sprintf("%v:%v: %v", step.Source, step.Line, step.Func))
+	errorIfNotEqual(t, 2, len(step.Locals))
+	errorIfNotEqual(t, "doubled", step.Locals[1].Name)
+	errorIfNotEqual(t, float64(42), step.Locals[1].Value.Number)
+
+	var b bytes.Buffer
+	if err := dump.Inspect(&b, d, 3); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"  <string>:4: in function 'step'\n", "      doubled = 42\n", "  worker = thread: ", "largest tables\n"} {
+		if !strings.Contains(b.String(), s) {
+			t.Errorf("report must contain %q:\n%v", s, b.String())
+		}
+	}
+
+	// threads resuming each other in a tampered snapshot
+	errorIfScriptFail(t, L, `idle = coroutine.create(function() end)`)
+	d = testDump(L)
+	main, worker2 := d.G.CurrentThread, d.Tables[d.G.Global].Strdict["worker"].Ptr
+	d.States[main].Parent, d.States[worker2].Parent = worker2, main
+	threads = dump.Threads(d)
+	errorIfNotEqual(t, 3, len(threads))
+	for _, th := range threads[1:] {
+		if th.Ptr == worker2 {
+			errorIfNotEqual(t, "normal", th.Status)
+		} else {
+			errorIfNotEqual(t, "suspended", th.Status)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package lua
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// finalizers holds the userdata with a __gc metamethod that became
+// unreachable, until their state runs the metamethods. The Go finalizers of
+// the userdata add to it from the finalizer goroutine.
+type finalizers struct {
+	mu      sync.Mutex
+	queue   []*LUserData
+	pending int32 // len(queue), read by the VM without the lock
+	running bool  // only used by the state
+}
+
+func (f *finalizers) add(ud *LUserData) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queue = append(f.queue, ud)
+	atomic.StoreInt32(&f.pending, int32(len(f.queue)))
+}
+
+func (f *finalizers) take() []*LUserData {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	queue := f.queue
+	f.queue = nil
+	atomic.StoreInt32(&f.pending, 0)
+	return queue
+}
+
+// due reports whether finalizers are waiting to be run. f may be nil.
+func (f *finalizers) due() bool {
+	return f != nil && atomic.LoadInt32(&f.pending) > 0
+}
+
+// setFinalizer makes the state run the __gc metamethod of ud once the Go
+// object becomes unreachable, if its metatable has one. Userdata with any
+// metatable can not be finalized: Go never collects the objects of a cycle
+// with a finalizer, and metatables often reach their userdata.
+func (g *Global) setFinalizer(ud *LUserData) {
+	mt, ok := ud.Metatable.(*LTable)
+	if !ok || mt.RawGetString("__gc") == LNil {
+		return
+	}
+	g.addFinalizer(ud)
+}
+
+// addFinalizer makes the state look up the __gc metamethod of ud once the Go
+// object becomes unreachable. It is used for the metatables made by
+// newproxy, which get their __gc field after they are set.
+func (g *Global) addFinalizer(ud *LUserData) {
+	if ud.hasFinalizer {
+		return
+	}
+	if g.finalizers == nil {
+		g.finalizers = &finalizers{}
+	}
+	ud.hasFinalizer = true
+	runtime.SetFinalizer(ud, g.finalizers.add)
+}
+
+// finalizerSentinel is an object the Go finalizer goroutine reports on.
+type finalizerSentinel struct {
+	done chan struct{}
+}
+
+// awaitFinalizers runs the Go garbage collector and waits until the Go
+// finalizers of the userdata that were unreachable have queued them.
+func (g *Global) awaitFinalizers() {
+	if g.finalizers == nil {
+		runtime.GC()
+		return
+	}
+	// The finalizer goroutine runs the finalizers queued by a collection in
+	// one batch, in no particular order. A second sentinel, queued once the
+	// first one ran, only runs after the whole first batch.
+	for i := 0; i < 2; i++ {
+		done := make(chan struct{})
+		runtime.SetFinalizer(&finalizerSentinel{done: done}, func(s *finalizerSentinel) {
+			close(s.done)
+		})
+		runtime.GC()
+		<-done
+	}
+}
+
+// runFinalizers calls the __gc metamethods of the queued userdata, with the
+// userdata as argument. Errors raised by them are ignored. It is called at
+// safe points: after calls of Go functions, by collectgarbage and by Close.
+func (ls *LState) runFinalizers() {
+	f := ls.G.finalizers
+	if !f.due() || f.running {
+		return
+	}
+	f.running = true
+	defer func() { f.running = false }()
+	for _, ud := range f.take() {
+		if fn, ok := ls.metaOp1(ud, "__gc").(*LFunction); ok {
+			ls.Push(fn)
+			ls.Push(ud)
+			ls.PCall(1, 0, nil)
+		}
+	}
+}
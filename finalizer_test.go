@@ -0,0 +1,49 @@
+package lua
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestUserDataFinalizer(t *testing.T) {
+	L := NewState()
+	closed := 0
+	mt := L.NewTypeMetatable("handle")
+	L.SetField(mt, "__gc", L.NewFunction(func(L *LState) int {
+		L.CheckUserData(1)
+		closed++
+		return 0
+	}))
+	L.SetGlobal("newhandle", L.NewFunction(func(L *LState) int {
+		ud := L.NewUserData()
+		L.SetMetatable(ud, L.GetTypeMetatable("handle"))
+		L.Push(ud)
+		return 1
+	}))
+	errorIfScriptFail(t, L, `
+    for i = 1, 3 do newhandle() end
+    kept = newhandle()
+    dumped = newhandle()
+    local proxy = newproxy(true)
+    getmetatable(proxy).__gc = function()
+      proxyclosed = true
+      error("errors are ignored")
+    end
+    `)
+	testDump(L)
+	errorIfScriptFail(t, L, `
+    dumped = nil
+    collectgarbage()
+    assert(proxyclosed)
+    `)
+	errorIfNotEqual(t, 4, closed)
+
+	L.SetGlobal("kept", LNil)
+	for i := 0; i < 100 && !L.G.finalizers.due(); i++ {
+		runtime.GC()
+		time.Sleep(time.Millisecond)
+	}
+	L.Close()
+	errorIfNotEqual(t, 5, closed)
+}
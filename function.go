@@ -40,6 +40,7 @@ type FunctionProto struct {
 	DbgUpvalues        []string
 
 	stringConstants []string
+	hash            string // content hash, see protoHash
 }
 
 /* Upvalue {{{ */
@@ -0,0 +1,120 @@
+package lua
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"sort"
+
+	"github.com/gladkikhartem/gopher-lua/dump"
+)
+
+// GFunctionRegistry maps Go functions to stable names, so Dump can save
+// functions by name and LoadDump can restore them.
+//
+// Functions are identified by their code, so closures created by the same
+// function literal share a name. Their upvalues are saved separately.
+type GFunctionRegistry struct {
+	names map[uintptr]string
+	funcs map[string]LGFunction
+}
+
+// NewGFunctionRegistry returns a registry with all standard library
+// functions already registered. Library functions are named after the
+// library, such as "print" or "string.format".
+func NewGFunctionRegistry() *GFunctionRegistry {
+	r := &GFunctionRegistry{
+		names: make(map[uintptr]string),
+		funcs: make(map[string]LGFunction),
+	}
+	for _, lib := range luaLibs {
+		name := lib.libName
+		if name == BaseLibName {
+			name = "base"
+		}
+		r.Register("luaopen_"+name, lib.libFunc)
+	}
+	r.RegisterModule(BaseLibName, BaseFuncs)
+	r.Register("ipairs", baseIpairs)
+	r.Register("ipairs.aux", ipairsaux)
+	r.Register("pairs", basePairs)
+	r.Register("pairs.aux", pairsaux)
+	r.RegisterModule(LoadLibName, loFuncs)
+	r.Register("package.loaders.preload", loLoaderPreload)
+	r.Register("package.loaders.lua", loLoaderLua)
+	r.RegisterModule(TabLibName, tableFuncs)
+	r.RegisterModule(IoLibName, ioFuncs)
+	r.Register("io.lines.iter", ioLinesIter)
+	r.RegisterModule(IoLibName+".file", fileMethods)
+	r.Register("io.file.lines.iter", fileLinesIter)
+	r.RegisterModule(OsLibName, osFuncs)
+	r.RegisterModule(StringLibName, strFuncs)
+	r.Register("string.gmatch", strGmatch)
+	r.Register("string.gmatch.iter", strGmatchIter)
+	r.RegisterModule(MathLibName, mathFuncs)
+	r.RegisterModule(DebugLibName, debugFuncs)
+	r.RegisterModule(ChannelLibName, channelFuncs)
+	r.RegisterModule(ChannelLibName+".chan", channelMethods)
+	r.RegisterModule(CoroutineLibName, coFuncs)
+	r.Register("coroutine.wrap.aux", wrapaux)
+	return r
+}
+
+// Register registers a function under a given name. A function registered
+// under several names is dumped under the first one, but can be loaded by
+// any of them.
+func (r *GFunctionRegistry) Register(name string, fn LGFunction) {
+	r.funcs[name] = fn
+	pc := reflect.ValueOf(fn).Pointer()
+	if _, ok := r.names[pc]; !ok {
+		r.names[pc] = name
+	}
+}
+
+// RegisterModule registers all functions of a module as "module.fname".
+func (r *GFunctionRegistry) RegisterModule(module string, funcs map[string]LGFunction) {
+	for _, fname := range sortedFuncNames(funcs) {
+		name := fname
+		if module != "" {
+			name = module + "." + fname
+		}
+		r.Register(name, funcs[fname])
+	}
+}
+
+// Name returns the name a function was registered under.
+func (r *GFunctionRegistry) Name(fn LGFunction) (string, bool) {
+	name, ok := r.names[reflect.ValueOf(fn).Pointer()]
+	return name, ok
+}
+
+// Func returns a function registered under a given name.
+func (r *GFunctionRegistry) Func(name string) (LGFunction, bool) {
+	fn, ok := r.funcs[name]
+	return fn, ok
+}
+
+// dumpName returns a name for Dump. Unregistered functions get their Go
+// name prefixed with "?", so LoadDump can report what is missing.
+func (r *GFunctionRegistry) dumpName(fn LGFunction) dump.Ptr {
+	if name, ok := r.Name(fn); ok {
+		return dump.Ptr(name)
+	}
+	return dump.Ptr("?" + runtime.FuncForPC(reflect.ValueOf(fn).Pointer()).Name())
+}
+
+func (r *GFunctionRegistry) loadFunc(name dump.Ptr) (LGFunction, error) {
+	if fn, ok := r.Func(string(name)); ok {
+		return fn, nil
+	}
+	return nil, fmt.Errorf("gfunction %q is not registered", name)
+}
+
+func sortedFuncNames(funcs map[string]LGFunction) []string {
+	names := make([]string, 0, len(funcs))
+	for name := range funcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,136 @@
+package lua
+
+// HookMask selects the events a hook is called for, see LState.SetHook.
+type HookMask int
+
+const (
+	// MaskCall calls the hook when a function is called, with the event
+	// "call".
+	MaskCall HookMask = 1 << iota
+	// MaskReturn calls the hook when a function returns, with the event
+	// "return", or "tail return" for each function it replaced by tail
+	// calls.
+	MaskReturn
+	// MaskLine calls the hook when the VM starts a new line of code, or
+	// jumps back in the code, with the event "line".
+	MaskLine
+	// MaskCount calls the hook after every count instructions, with the
+	// event "count".
+	MaskCount
+)
+
+// LHook is called for the events of a hook. line is the current line for
+// "line" events and -1 for the others. The running function is at level 0
+// of L.GetStack. Hooks are not called while a hook runs.
+type LHook func(L *LState, event string, line int)
+
+// debugHook is the hook of a thread.
+type debugHook struct {
+	fn      LHook
+	mask    HookMask
+	count   int
+	counter int
+	running bool
+	luaFn   *LFunction // set by debug.sethook
+}
+
+// SetHook sets the hook of the thread, like lua_sethook. Threads created by
+// the thread get the same hook. A mask of 0 or a nil fn removes the hook.
+// Hooks are not saved in snapshots, Fork copies them.
+func (ls *LState) SetHook(mask HookMask, count int, fn LHook) {
+	if count <= 0 {
+		mask &^= MaskCount
+	}
+	if mask == 0 || fn == nil {
+		ls.hook = nil
+		ls.setMainLoop()
+		return
+	}
+	h := &debugHook{fn: fn, mask: mask, count: count, counter: count}
+	if ls.hook != nil {
+		h.running = ls.hook.running
+	}
+	ls.hook = h
+	// functions already running are not reported as called
+	for i := 0; i < ls.stack.Sp(); i++ {
+		cf := ls.stack.At(i)
+		cf.hookPc = cf.Pc
+	}
+	ls.setMainLoop()
+}
+
+// GetHook returns the mask, count and function of the hook of the thread.
+func (ls *LState) GetHook() (HookMask, int, LHook) {
+	if ls.hook == nil {
+		return 0, 0, nil
+	}
+	return ls.hook.mask, ls.hook.count, ls.hook.fn
+}
+
+// inherit returns the hook of a thread created by the thread of h. h may be
+// nil.
+func (h *debugHook) inherit() *debugHook {
+	if h == nil {
+		return nil
+	}
+	return &debugHook{fn: h.fn, mask: h.mask, count: h.count, counter: h.count, luaFn: h.luaFn}
+}
+
+func (h *debugHook) call(L *LState, event string, line int) {
+	h.running = true
+	defer func() { h.running = false }()
+	h.fn(L, event, line)
+}
+
+// step is called by the VM for every instruction of a Lua function, after
+// the Pc of cf was advanced past it.
+func (h *debugHook) step(L *LState, cf *callFrame, op int) {
+	if h.running {
+		return
+	}
+	pc := cf.Pc - 1
+	if cf.hookPc == 0 && pc == 0 && h.mask&MaskCall != 0 {
+		h.call(L, "call", -1)
+	}
+	if h.mask&MaskCount != 0 {
+		h.counter--
+		if h.counter == 0 {
+			h.counter = h.count
+			h.call(L, "count", -1)
+		}
+	}
+	if h.mask&MaskLine != 0 {
+		lines := cf.Fn.Proto.DbgSourcePositions
+		oldpc := cf.hookPc - 1
+		// the implicit return of a chunk has no line
+		if pc < len(lines) && lines[pc] > 0 && (oldpc < 0 || pc <= oldpc || oldpc >= len(lines) || lines[pc] != lines[oldpc]) {
+			h.call(L, "line", lines[pc])
+		}
+	}
+	cf.hookPc = pc + 1
+	switch op {
+	case OP_RETURN:
+		if h.mask&MaskReturn != 0 {
+			h.call(L, "return", -1)
+			for i := 0; i < cf.TailCall; i++ {
+				h.call(L, "tail return", -1)
+			}
+		}
+	case OP_TAILCALL:
+		// a called Lua function starts over in the frame
+		cf.hookPc = 0
+	}
+}
+
+// callG and returnG are called by the VM around calls of Go functions.
+func (h *debugHook) callG(L *LState) {
+	if !h.running && h.mask&MaskCall != 0 {
+		h.call(L, "call", -1)
+	}
+}
+
+func (h *debugHook) returnG(L *LState) {
+	if !h.running && h.mask&MaskReturn != 0 {
+		h.call(L, "return", -1)
+	}
+}
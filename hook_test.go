@@ -0,0 +1,91 @@
+package lua
+
+import (
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestSetHook(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	var lines []int
+	var events []string
+	L.SetHook(MaskLine|MaskCall|MaskReturn, 0, func(L *LState, event string, line int) {
+		if event == "line" {
+			lines = append(lines, line)
+			return
+		}
+		dbg, _ := L.GetStack(0)
+		L.GetInfo("n", dbg, LNil)
+		events = append(events, event+" "+dbg.Name)
+	})
+	errorIfScriptFail(t, L, `local function f(x)
+  return x + 1
+end
+local y = 0
+for i = 1, 2 do
+  y = f(y)
+end
+print(y)`)
+	L.SetHook(0, 0, nil)
+	errorIfFalse(t, reflect.DeepEqual(lines, []int{1, 4, 5, 6, 2, 5, 6, 2, 5, 8}), "unexpected lines %v", lines)
+	errorIfFalse(t, reflect.DeepEqual(events, []string{"call main chunk", "call f", "return f", "call f", "return f", "call print", "return print", "return main chunk"}), "unexpected events %v", events)
+
+	count := 0
+	L.SetHook(MaskCount, 10, func(L *LState, event string, line int) { count++ })
+	errorIfScriptFail(t, L, `for i = 1, 100 do end`)
+	L.SetHook(0, 0, nil)
+	errorIfFalse(t, count >= 10, "count hook called %v times", count)
+}
+
+func TestDebugSetHook(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+    local calls, lines = 0, 0
+    local function hook(event, line)
+      if event == "call" then calls = calls + 1 end
+      if event == "line" then lines = lines + 1 end
+    end
+    local function f() end
+    debug.sethook(hook, "cl")
+    f()
+    f()
+    local fn, mask, count = debug.gethook()
+    debug.sethook()
+    assert(fn == hook and mask == "cl" and count == 0)
+    assert(debug.gethook() == nil)
+    assert(calls == 4, tostring(calls)) -- f twice, debug.gethook and debug.sethook
+    assert(lines >= 3, tostring(lines))
+
+    local co = coroutine.create(function() f() end)
+    local called = 0
+    debug.sethook(co, function() called = called + 1 end, "c")
+    coroutine.resume(co)
+    assert(called >= 2, tostring(called))
+    `)
+	errorIfScriptNotFail(t, L, `
+    debug.sethook(function() error("in hook") end, "l")
+    local x = 1
+    `, "in hook")
+}
+
+func TestHookToggle(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.SetGlobal("depth", L.NewFunction(func(L *LState) int {
+		L.Push(LNumber(runtime.Callers(0, make([]uintptr, 1<<16))))
+		return 1
+	}))
+	// every toggle switches the main loop of the running chunk, the Go
+	// stack must not grow with them
+	errorIfScriptFail(t, L, `
+    local calls = 0
+    local function f() calls = calls + 1 end
+    local before = depth()
+    for i = 1, 1e5 do debug.sethook(f, "c"); debug.sethook() end
+    assert(calls == 1e5)
+    assert(depth() == before)
+    `)
+}
@@ -0,0 +1,143 @@
+package lua
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/gladkikhartem/gopher-lua/dump"
+)
+
+func TestIntegers(t *testing.T) {
+	L := NewState(Options{Integers: true, Lua53Operators: true})
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+    assert(math.type(1) == "integer" and math.type(1.0) == "float")
+    assert(math.type(0x10) == "integer" and math.type(1e2) == "float")
+    assert(math.type("1") == nil and math.type(nil) == nil)
+    assert(1 == 1.0 and 1 < 1.5 and 2 > 1.5 and 1 <= 1.0)
+
+    -- integers stay integers, except for / and ^
+    assert(math.type(3 + 4) == "integer" and math.type(3 * 4) == "integer")
+    assert(math.type(7 // 2) == "integer" and 7 // 2 == 3 and -7 // 2 == -4)
+    assert(math.type(7 % 3) == "integer" and -7 % 3 == 2 and 7 % -3 == -2)
+    assert(math.type(6 / 2) == "float" and math.type(2 ^ 2) == "float")
+    assert(math.type(1 + 1.0) == "float" and math.type(-(1)) == "integer")
+    assert(math.type(3 & 1.0) == "integer" and math.type(~0) == "integer")
+
+    -- integers are exact beyond 2^53 and wrap around on overflow
+    local big = 9007199254740993
+    assert(big ~= big - 1 and tostring(big) == "9007199254740993")
+    assert(big + 0.0 == 9007199254740992.0 and big ~= 9007199254740992.0)
+    assert(big > 9007199254740992.0)
+    assert(math.maxinteger + 1 == math.mininteger)
+    assert(math.mininteger == -9223372036854775808)
+    assert(math.maxinteger // -1 == -math.maxinteger)
+    assert(~math.mininteger == math.maxinteger and ~math.maxinteger == math.mininteger)
+    assert(math.type(~math.mininteger) == "integer" and ~-1 == 0)
+
+    local ok, msg = pcall(function(x) return x // 0 end, 1)
+    assert(not ok and string.find(msg, "n//0"), msg)
+    ok, msg = pcall(function(x) return x % 0 end, 1)
+    assert(not ok and string.find(msg, "n%%0"), msg)
+    assert(1 // 0.0 == 1 / 0)
+
+    assert(string.format("%d %5.1f %s", 42, 3, 7) == "42   3.0 7")
+    assert(string.format("%d", math.maxinteger) == "9223372036854775807")
+
+    assert(math.tointeger(3.0) == 3 and math.type(math.tointeger(3.0)) == "integer")
+    assert(math.tointeger(3.5) == nil and math.tointeger("x") == nil)
+    assert(math.type(math.floor(3.7)) == "integer" and math.floor(3.7) == 3)
+    assert(math.type(math.ceil(3.2)) == "integer" and math.ceil(3.2) == 4)
+    assert(math.type(math.floor(1e100)) == "float")
+    assert(math.type(math.abs(-3)) == "integer" and math.abs(-3) == 3)
+    assert(math.type(math.max(1, 2.5, 2)) == "float" and math.type(math.max(1, 2)) == "integer")
+    assert(math.type(tonumber("12")) == "integer" and math.type(tonumber("1.5")) == "float")
+    assert(math.type(#"abc") == "integer" and #{1, 2} == 2)
+
+    -- integers and floats with the same value are the same key
+    local t = {}
+    t[1] = "a"
+    t[2.0] = "b"
+    assert(t[1.0] == "a" and t[2] == "b" and #t == 2)
+    t[big] = "big"
+    assert(t[big] == "big" and t[big - 1] == nil)
+
+    local n = 0
+    for i = 1, 3 do
+      assert(math.type(i) == "integer")
+      n = n + i
+    end
+    assert(n == 6)
+    n = 0
+    for i = math.maxinteger - 2, math.maxinteger do n = n + 1 end
+    assert(n == 3)
+    n = 0
+    for i = math.mininteger, math.mininteger + 4, 2 do n = n + 1 end
+    assert(n == 3)
+    n = 0
+    for i = 3, 1, -1 do n = n * 10 + i end
+    assert(n == 321)
+    for i = 1, 0 do error("loop must not run") end
+    for i = 1, 0 / 0 do error("loop must not run") end
+    for i = 1, 2.5 do n = i end
+    assert(n == 2 and math.type(n) == "integer")
+    for i = 1.0, 2 do n = i end
+    assert(math.type(n) == "float")
+    ok, msg = pcall(function() for i = 1, 10, 0 do end end)
+    assert(not ok and string.find(msg, "step is zero"), msg)
+    `)
+
+	errorIfScriptFail(t, L, `x = 1 << 62`)
+	x := L.GetGlobal("x")
+	errorIfNotEqual(t, LInteger(1<<62), x)
+	L.Push(x)
+	errorIfNotEqual(t, int64(1<<62), L.CheckInt64(-1))
+	errorIfNotEqual(t, "4611686018427387904", L.ToString(-1))
+	L.Pop(1)
+}
+
+func TestIntegersDisabled(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+    assert(math.type(1) == "float" and math.type(#"abc") == "float")
+    assert(math.type(math.floor(1.5)) == "float")
+    assert(math.type(math.maxinteger) == "float" and math.type(math.mininteger) == "float")
+    assert(math.type(math.tointeger(2)) == "float" and math.tointeger(2.5) == nil)
+    assert(math.maxinteger == 2^63 and math.mininteger == -2^63)
+    assert(math.maxinteger + 1 == math.maxinteger and math.type(math.maxinteger + 1) == "float")
+    assert(math.mininteger - 1 == math.mininteger and math.type(-math.mininteger) == "float")
+    assert(math.maxinteger * 2 == 2^64 and math.maxinteger / 2 == 2^62)
+    assert(string.format("%.0f", math.mininteger) == "-9223372036854775808")
+    `)
+}
+
+func TestDumpIntegers(t *testing.T) {
+	L := NewState(Options{Integers: true, Lua53Operators: true})
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+    i, f = 9007199254740993, 2.0
+    t = {n = math.maxinteger}
+    function g() return 1 end
+    `)
+	var buf bytes.Buffer
+	if err := dump.Encode(&buf, testDump(L)); err != nil {
+		t.Fatal(err)
+	}
+	d, err := dump.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	L2, err := testLoad(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer L2.Close()
+	errorIfScriptFail(t, L2, `
+    assert(math.type(i) == "integer" and i == 9007199254740993)
+    assert(math.type(f) == "float" and f == 2)
+    assert(math.type(t.n) == "integer" and t.n == math.maxinteger)
+    assert(math.type(g()) == "integer")
+    assert(math.type(10) == "integer")
+    `)
+}
@@ -34,6 +34,7 @@ type lFile struct {
 	reader *bufio.Reader
 	stdout io.ReadCloser
 	closed bool
+	flag   int // os.OpenFile flags the file was opened with
 }
 
 type lFileType int
@@ -72,7 +73,7 @@ func newFile(L *LState, file *os.File, path string, flag int, perm os.FileMode,
 			return nil, err
 		}
 	}
-	lfile := &lFile{fp: file, pp: nil, writer: nil, reader: nil, stdout: nil, closed: false}
+	lfile := &lFile{fp: file, pp: nil, writer: nil, reader: nil, stdout: nil, closed: false, flag: flag}
 	ud.Value = lfile
 	if writable {
 		lfile.writer = file
@@ -112,7 +113,7 @@ func newProcess(L *LState, cmd string, writable, readable bool) (*LUserData, err
 }
 
 func (file *lFile) Type() lFileType {
-	if file.fp == nil {
+	if file.pp != nil {
 		return lFileProcess
 	}
 	return lFileFile
@@ -121,6 +122,9 @@ func (file *lFile) Type() lFileType {
 func (file *lFile) Name() string {
 	switch file.Type() {
 	case lFileFile:
+		if file.fp == nil { // closed file restored from a snapshot
+			return "closed file"
+		}
 		return fmt.Sprintf("file %s", file.fp.Name())
 	case lFileProcess:
 		return fmt.Sprintf("process %s", file.pp.Path)
@@ -331,9 +335,9 @@ func fileReadAux(L *LState, file *lFile, idx int) int {
 	var err error
 	top := L.GetTop()
 	for i := idx; i <= top; i++ {
-		switch lv := L.Get(i).(type) {
-		case LNumber:
-			size := int64(lv)
+		switch L.Get(i).(type) {
+		case LNumber, LInteger:
+			size := L.CheckInt64(i)
 			if size == 0 {
 				_, err = file.reader.ReadByte()
 				if err == io.EOF {
@@ -615,16 +619,11 @@ func ioLines(L *LState) int {
 
 var ioOpenOpions = []string{"r", "rb", "w", "wb", "a", "ab", "r+", "rb+", "w+", "wb+", "a+", "ab+"}
 
-func ioOpenFile(L *LState) int {
-	path := L.CheckString(1)
-	if L.GetTop() == 1 {
-		L.Push(LString("r"))
-	}
-	mode := os.O_RDONLY
-	perm := 0600
-	writable := true
-	readable := true
-	switch ioOpenOpions[L.CheckOption(2, ioOpenOpions)] {
+func ioOpenFlags(option string) (mode int, writable, readable bool) {
+	mode = os.O_RDONLY
+	writable = true
+	readable = true
+	switch option {
 	case "r", "rb":
 		mode = os.O_RDONLY
 		writable = false
@@ -640,6 +639,16 @@ func ioOpenFile(L *LState) int {
 	case "a+", "ab+":
 		mode = os.O_APPEND | os.O_RDWR | os.O_CREATE
 	}
+	return
+}
+
+func ioOpenFile(L *LState) int {
+	path := L.CheckString(1)
+	if L.GetTop() == 1 {
+		L.Push(LString("r"))
+	}
+	perm := 0600
+	mode, writable, readable := ioOpenFlags(ioOpenOpions[L.CheckOption(2, ioOpenOpions)])
 	file, err := newFile(L, nil, path, mode, os.FileMode(perm), writable, readable)
 	if err != nil {
 		L.Push(LNil)
@@ -713,6 +722,15 @@ func ioTmpFile(L *LState) int {
 	return 1
 }
 
+func (g *Global) isTempFile(file *os.File) bool {
+	for _, f := range g.tempFiles {
+		if f == file {
+			return true
+		}
+	}
+	return false
+}
+
 func ioOutput(L *LState) int {
 	if L.GetTop() == 0 {
 		L.Push(fileDefOut(L))
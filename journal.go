@@ -0,0 +1,187 @@
+package lua
+
+import (
+	"reflect"
+
+	"github.com/gladkikhartem/gopher-lua/dump"
+)
+
+// nondeterministicFuncs are the standard library functions whose results
+// are journaled.
+var nondeterministicFuncs = map[string]LGFunction{
+	"os.time":              osTime,
+	"os.clock":             osClock,
+	"os.date":              osDate,
+	"os.getenv":            osGetEnv,
+	"math.random":          mathRandom,
+	"io.read":              ioRead,
+	"io.file.read":         fileRead,
+	"channel.chan.receive": channelReceive,
+}
+
+// Journal records the results of nondeterministic calls made by a state, or
+// feeds recorded results back to replay a run exactly, see
+// LState.SetJournal.
+//
+// The results of os.time, os.clock, os.date, os.getenv, math.random,
+// io.read, file:read, channel receives and channel.select are journaled, as
+// well as those of the Go functions passed to NewJournal and NewReplay. A
+// replayed function is not called. Reference values in results are saved by
+// DumpValue and are replayed as copies, unless they are externals.
+// Calls of Go functions that yield are not journaled.
+type Journal struct {
+	replay bool
+	data   dump.Journal
+	pos    int // next entry to replay
+	names  map[uintptr]string
+
+	// dumpValue and loadValue are LState.DumpValue and LoadValue; direct
+	// calls would make an initialization cycle through the standard
+	// library tables
+	dumpValue func(L *LState, lv LValue, opts ...DumpOptions) dump.Data
+	loadValue func(L *LState, d dump.Data, opts ...LoadOptions) (LValue, error)
+}
+
+// NewJournal returns a journal that records. nondeterministic names the Go
+// functions journaled in addition to the standard ones.
+func NewJournal(nondeterministic map[string]LGFunction) *Journal {
+	j := &Journal{
+		names:     make(map[uintptr]string),
+		dumpValue: (*LState).DumpValue,
+		loadValue: LoadValue,
+	}
+	for _, funcs := range []map[string]LGFunction{nondeterministicFuncs, nondeterministic} {
+		for name, fn := range funcs {
+			j.names[reflect.ValueOf(fn).Pointer()] = name
+		}
+	}
+	return j
+}
+
+// NewReplay returns a journal that replays d. nondeterministic must name the
+// same functions as when d was recorded.
+func NewReplay(d dump.Journal, nondeterministic map[string]LGFunction) *Journal {
+	j := NewJournal(nondeterministic)
+	j.replay = true
+	j.data = d
+	return j
+}
+
+// Data returns the entries recorded so far.
+func (j *Journal) Data() dump.Journal {
+	return j.data
+}
+
+// Replayed reports whether all entries of a replay were fed back.
+func (j *Journal) Replayed() bool {
+	return j.pos == len(j.data.Entries)
+}
+
+// SetJournal makes the state record or replay nondeterministic calls with
+// j. nil stops journaling.
+func (ls *LState) SetJournal(j *Journal) {
+	ls.G.journal = j
+}
+
+// name returns the journal name of fn, or false if its calls are not
+// journaled. j may be nil.
+func (j *Journal) name(fn LGFunction) (string, bool) {
+	if j == nil {
+		return "", false
+	}
+	name, ok := j.names[reflect.ValueOf(fn).Pointer()]
+	return name, ok
+}
+
+// call calls fn, the Go function of the current frame of L, and records its
+// results, or replays them.
+func (j *Journal) call(L *LState, name string, fn LGFunction) int {
+	if j.replay {
+		results := j.next(L, name)
+		for _, lv := range results {
+			L.Push(lv)
+		}
+		return len(results)
+	}
+	n := fn(L)
+	if n < 0 {
+		return n
+	}
+	results := make([]LValue, n)
+	for i := range results {
+		results[i] = L.Get(-n + i)
+	}
+	j.record(L, name, results)
+	return n
+}
+
+// journaled returns the results of fn, recorded or replayed by the journal
+// of L if it has one. It is used by Go functions that are only partly
+// nondeterministic.
+func (ls *LState) journaled(name string, fn func() []LValue) []LValue {
+	j := ls.G.journal
+	if j == nil {
+		return fn()
+	}
+	if j.replay {
+		return j.next(ls, name)
+	}
+	results := fn()
+	j.record(ls, name, results)
+	return results
+}
+
+func (j *Journal) record(L *LState, name string, results []LValue) {
+	e := dump.JournalEntry{Name: name, Results: make([]dump.Value, len(results))}
+	for i, lv := range results {
+		switch v := lv.(type) {
+		case *LNilType, LBool, LNumber, LInteger, LString:
+			e.Results[i] = protoConstant(v)
+		default:
+			if e.Refs == nil {
+				e.Refs = make(map[int]*dump.Data)
+			}
+			d := j.dumpValue(L, lv)
+			e.Refs[i] = &d
+			e.Results[i] = dump.Value{Type: int(lv.Type())}
+		}
+	}
+	j.data.Entries = append(j.data.Entries, e)
+}
+
+func (j *Journal) next(L *LState, name string) []LValue {
+	if j.pos >= len(j.data.Entries) {
+		L.RaiseError("journal: no recorded results for a call of %v", name)
+	}
+	e := j.data.Entries[j.pos]
+	if e.Name != name {
+		L.RaiseError("journal: replay diverged, %v was called instead of %v", name, e.Name)
+	}
+	j.pos++
+	results := make([]LValue, len(e.Results))
+	for i, v := range e.Results {
+		if d, ok := e.Refs[i]; ok {
+			lv, err := j.loadValue(L, *d)
+			if err != nil {
+				L.RaiseError("journal: result %v of %v: %v", i+1, name, err)
+			}
+			results[i] = lv
+			continue
+		}
+		switch LValueType(v.Type) {
+		case LTBool:
+			results[i] = LBool(v.Bool)
+		case LTNumber:
+			if v.Integer {
+				results[i] = LInteger(v.Int)
+			} else {
+				results[i] = LNumber(v.Number)
+			}
+		case LTString:
+			results[i] = LString(v.String)
+		default:
+			results[i] = LNil
+		}
+	}
+	return results
+}
@@ -0,0 +1,133 @@
+package lua
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gladkikhartem/gopher-lua/dump"
+)
+
+const journalScript = `
+local ch = channel.make(2)
+ch:send({n = 7})
+ch:send("x")
+local _, t = ch:receive()
+local _, s = channel.select({"|<-", ch})
+result = table.concat({os.time(), math.random(1000000), os.date("*t").year,
+  os.clock(), tostring(os.getenv("HOME")), next(), t.n, s}, " ")
+`
+
+func TestJournalReplay(t *testing.T) {
+	calls := 0
+	funcs := map[string]LGFunction{"next": func(L *LState) int {
+		calls++
+		L.Push(LNumber(calls))
+		return 1
+	}}
+	L := NewState()
+	defer L.Close()
+	d := testDump(L)
+	L.SetGlobal("next", L.NewFunction(funcs["next"]))
+	j := NewJournal(funcs)
+	L.SetJournal(j)
+	errorIfScriptFail(t, L, journalScript)
+	recorded := L.GetGlobal("result").String()
+
+	b, err := json.Marshal(j.Data())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data dump.Journal
+	if err := json.Unmarshal(b, &data); err != nil {
+		t.Fatal(err)
+	}
+	L2, err := testLoad(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer L2.Close()
+	L2.SetGlobal("next", L2.NewFunction(funcs["next"]))
+	replay := NewReplay(data, funcs)
+	L2.SetJournal(replay)
+	errorIfScriptFail(t, L2, journalScript)
+	errorIfNotEqual(t, recorded, L2.GetGlobal("result").String())
+	errorIfNotEqual(t, 1, calls)
+	errorIfNotEqual(t, true, replay.Replayed())
+
+	L2.SetJournal(NewReplay(data, funcs))
+	errorIfScriptNotFail(t, L2, `os.clock()`, "replay diverged")
+}
+
+func TestJournalIntegersAndFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gopher-lua-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "input.txt")
+	if err := ioutil.WriteFile(path, []byte("recorded\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	funcs := map[string]LGFunction{"big": func(L *LState) int {
+		L.Push(LInteger(1<<62 + 1))
+		return 1
+	}}
+	script := `
+    local f = io.open(path)
+    line = f:read("*l")
+    f:close()
+    n = big()
+    `
+	run := func(j *Journal) *LState {
+		L := NewState(Options{Integers: true})
+		L.SetGlobal("path", LString(path))
+		L.SetGlobal("big", L.NewFunction(funcs["big"]))
+		L.SetJournal(j)
+		errorIfScriptFail(t, L, script)
+		return L
+	}
+	j := NewJournal(funcs)
+	L := run(j)
+	defer L.Close()
+	entries := j.Data().Entries
+	if last := entries[len(entries)-1]; len(last.Results) != 1 || !last.Results[0].Integer || len(last.Refs) != 0 {
+		t.Errorf("integer result must be journaled as a number, got %+v", entries)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("changed\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	replay := NewReplay(j.Data(), funcs)
+	L2 := run(replay)
+	defer L2.Close()
+	errorIfNotEqual(t, LString("recorded"), L2.GetGlobal("line"))
+	errorIfNotEqual(t, LInteger(1<<62+1), L2.GetGlobal("n"))
+	errorIfNotEqual(t, true, replay.Replayed())
+}
+
+func TestJournalLoadOptions(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.SetJournal(NewJournal(nil))
+	d := testDump(L)
+	j := NewJournal(nil)
+	L2, err := LoadDump(d, LoadOptions{Journal: j})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer L2.Close()
+	if L2.G.journal != j {
+		t.Error("loaded state must use the journal of the options")
+	}
+	L3, err := L.Fork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer L3.Close()
+	if L3.G.journal != nil {
+		t.Error("fork must not share the journal of the state")
+	}
+}
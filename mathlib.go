@@ -9,6 +9,13 @@ func OpenMath(L *LState) int {
 	mod := L.RegisterModule(MathLibName, mathFuncs).(*LTable)
 	mod.RawSetString("pi", LNumber(math.Pi))
 	mod.RawSetString("huge", LNumber(math.MaxFloat64))
+	if L.Options.Integers {
+		mod.RawSetString("maxinteger", LInteger(math.MaxInt64))
+		mod.RawSetString("mininteger", LInteger(math.MinInt64))
+	} else {
+		mod.RawSetString("maxinteger", LNumber(math.MaxInt64))
+		mod.RawSetString("mininteger", LNumber(math.MinInt64))
+	}
 	L.Push(mod)
 	return 1
 }
@@ -43,9 +50,18 @@ var mathFuncs = map[string]LGFunction{
 	"sqrt":       mathSqrt,
 	"tan":        mathTan,
 	"tanh":       mathTanh,
+	"tointeger":  mathToInteger,
+	"type":       mathType,
 }
 
 func mathAbs(L *LState) int {
+	if iv, ok := L.Get(1).(LInteger); ok {
+		if iv < 0 {
+			iv = -iv
+		}
+		L.Push(iv)
+		return 1
+	}
 	L.Push(LNumber(math.Abs(float64(L.CheckNumber(1)))))
 	return 1
 }
@@ -71,7 +87,11 @@ func mathAtan2(L *LState) int {
 }
 
 func mathCeil(L *LState) int {
-	L.Push(LNumber(math.Ceil(float64(L.CheckNumber(1)))))
+	if iv, ok := L.Get(1).(LInteger); ok {
+		L.Push(iv)
+		return 1
+	}
+	L.Push(integralValue(L, math.Ceil(float64(L.CheckNumber(1)))))
 	return 1
 }
 
@@ -96,10 +116,23 @@ func mathExp(L *LState) int {
 }
 
 func mathFloor(L *LState) int {
-	L.Push(LNumber(math.Floor(float64(L.CheckNumber(1)))))
+	if iv, ok := L.Get(1).(LInteger); ok {
+		L.Push(iv)
+		return 1
+	}
+	L.Push(integralValue(L, math.Floor(float64(L.CheckNumber(1)))))
 	return 1
 }
 
+// integralValue returns the integral float f as an integer if the state uses
+// integers and f fits into one.
+func integralValue(L *LState, f float64) LValue {
+	if L.Options.Integers && f >= -(1<<63) && f < 1<<63 {
+		return LInteger(f)
+	}
+	return LNumber(f)
+}
+
 func mathFmod(L *LState) int {
 	L.Push(LNumber(math.Mod(float64(L.CheckNumber(1)), float64(L.CheckNumber(2)))))
 	return 1
@@ -131,11 +164,12 @@ func mathMax(L *LState) int {
 	if L.GetTop() == 0 {
 		L.RaiseError("wrong number of arguments")
 	}
-	max := L.CheckNumber(1)
+	L.CheckNumber(1)
+	max := L.Get(1)
 	top := L.GetTop()
 	for i := 2; i <= top; i++ {
-		v := L.CheckNumber(i)
-		if v > max {
+		L.CheckNumber(i)
+		if v := L.Get(i); numberCompare(v, max) == 1 {
 			max = v
 		}
 	}
@@ -147,11 +181,12 @@ func mathMin(L *LState) int {
 	if L.GetTop() == 0 {
 		L.RaiseError("wrong number of arguments")
 	}
-	min := L.CheckNumber(1)
+	L.CheckNumber(1)
+	min := L.Get(1)
 	top := L.GetTop()
 	for i := 2; i <= top; i++ {
-		v := L.CheckNumber(i)
-		if v < min {
+		L.CheckNumber(i)
+		if v := L.Get(i); numberCompare(v, min) == -1 {
 			min = v
 		}
 	}
@@ -229,3 +264,26 @@ func mathTanh(L *LState) int {
 }
 
 //
+
+func mathToInteger(L *LState) int {
+	if iv, ok := luaToInteger(L.CheckAny(1)); !ok {
+		L.Push(LNil)
+	} else if L.Options.Integers {
+		L.Push(LInteger(iv))
+	} else {
+		L.Push(LNumber(iv))
+	}
+	return 1
+}
+
+func mathType(L *LState) int {
+	switch L.CheckAny(1).(type) {
+	case LInteger:
+		L.Push(LString("integer"))
+	case LNumber:
+		L.Push(LString("float"))
+	default:
+		L.Push(LNil)
+	}
+	return 1
+}
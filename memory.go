@@ -0,0 +1,353 @@
+package lua
+
+import (
+	"strings"
+	"sync/atomic"
+)
+
+// Approximate sizes in bytes of the objects a state allocates.
+const (
+	memTable     = 64 // an empty table
+	memSlot      = 16 // an array slot or a register, one LValue
+	memEntry     = 48 // a hash entry with its place in the iteration order
+	memString    = 16 // a string header, its bytes are counted as well
+	memUserData  = 48
+	memCallFrame = 80
+)
+
+// memAccount approximates the memory allocated by the threads of a state.
+// Tables, strings built by concatenation, table.concat and the string
+// library, userdata, and the registers and call stacks of threads are
+// counted. Strings are reserved before they are built, so a huge one fails
+// without being allocated. Freed objects are not noticed while the state
+// runs: the figure is corrected by collecting, which measures the reachable
+// objects and sweeps weak tables. The state collects when the memory has
+// doubled since the last collection or exceeds the limit, and on
+// collectgarbage.
+type memAccount struct {
+	used  int64 // atomic, tables shared with other goroutines count into it
+	limit int   // 0 means unlimited
+	next  int   // used at which the state collects, 0 before the first collection
+}
+
+// alloc counts n bytes. m may be nil, for tables that do not belong to a
+// state.
+func (m *memAccount) alloc(n int) {
+	if m != nil {
+		atomic.AddInt64(&m.used, int64(n))
+	}
+}
+
+// inUse returns the bytes counted.
+func (m *memAccount) inUse() int {
+	return int(atomic.LoadInt64(&m.used))
+}
+
+func (m *memAccount) allocString(s string) {
+	m.alloc(memString + len(s))
+}
+
+// checkMemory collects if the state has allocated enough since the last
+// collection, and raises a "not enough memory" error if it has exceeded its
+// memory limit. It is called by the VM after instructions and Go functions
+// that may allocate.
+func (ls *LState) checkMemory() {
+	if m := &ls.G.mem; m.next > 0 && m.inUse() > m.next {
+		ls.reserveMemory(0)
+	}
+}
+
+// reserveMemory counts n bytes that are about to be allocated. It raises a
+// "not enough memory" error instead if they would exceed the limit once the
+// unreachable objects are discounted.
+func (ls *LState) reserveMemory(n int) {
+	m := &ls.G.mem
+	if used := m.inUse(); (m.next > 0 && used+n > m.next) || (m.limit > 0 && used+n > m.limit) {
+		ls.collectMemory()
+		if m.limit > 0 && m.inUse()+n > m.limit {
+			ls.raiseError(0, "not enough memory")
+		}
+	}
+	m.alloc(n)
+}
+
+// collectMemory sweeps the weak tables of the state and sets the memory it
+// uses to the size of the objects still reachable from it.
+func (ls *LState) collectMemory() {
+	ls.countMemory(true)
+}
+
+// countMemory sets the memory used by the state to the size of the objects
+// reachable from it, see measureMemory.
+func (ls *LState) countMemory(collect bool) {
+	m := &ls.G.mem
+	used := ls.measureMemory(collect)
+	atomic.StoreInt64(&m.used, int64(used))
+	m.next = 2 * used
+	if m.limit > 0 && m.next > m.limit {
+		m.next = m.limit
+	}
+}
+
+// SetMemoryLimit limits the memory the state and its threads may allocate
+// to about n bytes, see Options.MemoryLimit. 0 removes the limit.
+func (ls *LState) SetMemoryLimit(n int) {
+	if n < 0 {
+		n = 0
+	}
+	m := &ls.G.mem
+	m.limit = n
+	if n > 0 && (m.next == 0 || m.next > n) {
+		m.next = n
+	}
+}
+
+// MemoryUsage returns the approximate number of bytes allocated by the state
+// and its threads, as reported by collectgarbage("count").
+func (ls *LState) MemoryUsage() int {
+	return ls.G.mem.inUse()
+}
+
+// newTable returns a new table accounted to the state.
+func (ls *LState) newTable(acap, hcap int) *LTable {
+	tb := newLTable(acap, hcap)
+	tb.mem = &ls.G.mem
+	tb.mem.alloc(memTable)
+	return tb
+}
+
+// threadMemory returns the size of the registers and call stack of ls.
+func (ls *LState) threadMemory() int {
+	n := 0
+	if ls.reg != nil {
+		n += memSlot * len(ls.reg.array)
+	}
+	if ls.stack != nil {
+		n += memCallFrame * len(ls.stack.array)
+	}
+	return n
+}
+
+// measureMemory returns the size of the objects reachable from the globals,
+// the registry and the threads of the state. If collect is set, entries of
+// weak tables whose weak keys or values are not reachable otherwise are
+// removed, and the dead parts of the stacks of the threads are cleared.
+//
+// Objects referenced only by Go values, such as the Value of userdata, are
+// not seen. Like in Lua, they must be kept in the registry to stay in weak
+// tables. Values buffered in channels can not be seen without receiving
+// them, so weak tables are not swept while a reachable channel holds values.
+func (ls *LState) measureMemory(collect bool) int {
+	w := &memWalk{seen: make(map[LValue]bool), bytes: make(map[memBytes]bool), collect: collect}
+	w.value(ls.G.Registry)
+	w.value(ls.G.Global)
+	for _, mt := range ls.G.builtinMts {
+		w.value(mt)
+	}
+	w.value(ls.G.MainThread)
+	w.value(ls.G.CurrentThread)
+	w.run()
+	if collect && !w.buffered {
+		for _, tb := range w.weak {
+			w.sweep(tb)
+		}
+	}
+	return w.size
+}
+
+type memWalk struct {
+	seen     map[LValue]bool
+	bytes    map[memBytes]bool // the bytes of strings counted
+	queue    []LValue
+	weak     []*LTable
+	size     int
+	collect  bool
+	buffered bool // a reached channel holds values
+}
+
+// memBytes identifies the bytes of a string.
+type memBytes struct {
+	data *byte
+	n    int
+}
+
+// weakMode returns the weakness of tb set by the __mode field of its
+// metatable.
+func weakMode(tb *LTable) (keys, values bool) {
+	mt, ok := tb.Metatable.(*LTable)
+	if !ok {
+		return false, false
+	}
+	mode, ok := mt.RawGetString("__mode").(LString)
+	if !ok {
+		return false, false
+	}
+	return strings.Contains(string(mode), "k"), strings.Contains(string(mode), "v")
+}
+
+// collectable reports whether lv can be removed from weak tables. Strings
+// are values, like in Lua.
+func collectable(lv LValue) bool {
+	switch lv.(type) {
+	case *LTable, *LFunction, *LUserData, *LState:
+		return true
+	}
+	return false
+}
+
+// ref visits a key or value of a table, weak references are not followed.
+func (w *memWalk) ref(lv LValue, weak bool) {
+	if weak && collectable(lv) {
+		return
+	}
+	w.value(lv)
+}
+
+// dead reports whether lv is a collectable object that was not reached.
+func (w *memWalk) dead(lv LValue) bool {
+	return collectable(lv) && !w.seen[lv]
+}
+
+// sweep removes the entries of the weak table tb with keys or values that
+// were not reached.
+func (w *memWalk) sweep(tb *LTable) {
+	weakKeys, weakValues := weakMode(tb)
+	if weakValues {
+		for i, v := range tb.array {
+			if w.dead(v) {
+				tb.array[i] = LNil
+			}
+		}
+		for k, v := range tb.strdict {
+			if w.dead(v) {
+				delete(tb.strdict, k)
+				w.size -= memEntry
+			}
+		}
+	}
+	for k, v := range tb.dict {
+		if (weakKeys && w.dead(k)) || (weakValues && w.dead(v)) {
+			delete(tb.dict, k)
+			w.size -= memEntry
+		}
+	}
+	// keys of removed entries are kept for next, like when nil is assigned,
+	// unless they are dead: they cannot be passed to next again
+	keys := tb.keys[:0]
+	for _, k := range tb.keys {
+		if w.dead(k) {
+			delete(tb.k2i, k)
+			continue
+		}
+		tb.k2i[k] = len(keys)
+		keys = append(keys, k)
+	}
+	for i := len(keys); i < len(tb.keys); i++ {
+		tb.keys[i] = nil
+	}
+	tb.keys = keys
+}
+
+func (w *memWalk) value(lv LValue) {
+	switch v := lv.(type) {
+	case LString:
+		// strings share their bytes when they are copied, like interned
+		// strings in Lua, so they are counted once
+		w.size += memString
+		if len(v) > 0 {
+			if b := (memBytes{&unsafeFastStringToReadOnlyBytes(string(v))[0], len(v)}); !w.bytes[b] {
+				w.bytes[b] = true
+				w.size += len(v)
+			}
+		}
+		return
+	case *LTable:
+		if v == nil {
+			return
+		}
+	case *LFunction:
+		if v == nil {
+			return
+		}
+	case *LUserData:
+		if v == nil {
+			return
+		}
+	case *LState:
+		if v == nil {
+			return
+		}
+	case LChannel:
+		if v == nil {
+			return
+		}
+	default:
+		return
+	}
+	if !w.seen[lv] {
+		w.seen[lv] = true
+		w.queue = append(w.queue, lv)
+	}
+}
+
+func (w *memWalk) run() {
+	for len(w.queue) > 0 {
+		lv := w.queue[len(w.queue)-1]
+		w.queue = w.queue[:len(w.queue)-1]
+		switch v := lv.(type) {
+		case *LTable:
+			w.size += memTable + memSlot*len(v.array) + memEntry*len(v.keys)
+			w.value(v.Metatable)
+			weakKeys, weakValues := weakMode(v)
+			if weakKeys || weakValues {
+				w.weak = append(w.weak, v)
+			}
+			for _, e := range v.array {
+				w.ref(e, weakValues)
+			}
+			for k, e := range v.strdict {
+				w.value(LString(k))
+				w.ref(e, weakValues)
+			}
+			for k, e := range v.dict {
+				w.ref(k, weakKeys)
+				w.ref(e, weakValues)
+			}
+		case *LFunction:
+			w.value(v.Env)
+			for _, uv := range v.Upvalues {
+				if uv != nil && uv.closed {
+					w.value(uv.value)
+				}
+			}
+		case *LUserData:
+			w.size += memUserData
+			w.value(v.Env)
+			w.value(v.Metatable)
+		case *LState:
+			w.size += v.threadMemory()
+			w.value(v.Env)
+			w.value(v.Parent)
+			if v.reg != nil {
+				for i := 0; i < v.reg.Top(); i++ {
+					w.value(v.reg.Get(i))
+				}
+				// like Lua, clear the dead part of the stack, so that stale
+				// values do not keep objects alive
+				for i := v.reg.Top(); w.collect && i < len(v.reg.array); i++ {
+					v.reg.array[i] = LNil
+				}
+			}
+			if v.stack != nil {
+				for i := 0; i < v.stack.Sp(); i++ {
+					w.value(v.stack.At(i).Fn)
+				}
+			}
+		case LChannel:
+			w.size += memSlot * cap(v)
+			if len(v) > 0 {
+				w.buffered = true
+			}
+		}
+	}
+}
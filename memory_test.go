@@ -0,0 +1,174 @@
+package lua
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+)
+
+func TestMemoryLimit(t *testing.T) {
+	L := NewState(Options{MemoryLimit: 4 << 20})
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+    local ok, msg = pcall(function()
+      local t = {}
+      for i = 1, 1e7 do t[i] = {} end
+    end)
+    assert(not ok and msg == "not enough memory", msg)
+    ok, msg = pcall(string.rep, "x", 1e9)
+    assert(not ok and msg == "not enough memory", msg)
+    s = "x"
+    ok, msg = pcall(function() while true do s = s .. s end end)
+    assert(not ok and msg == "not enough memory", msg)
+    `)
+
+	// the garbage of the failed calls is collected, so the state still runs
+	errorIfScriptFail(t, L, `
+    s = nil
+    collectgarbage()
+    local t = {}
+    for i = 1, 1000 do t[i] = "item" .. i end
+    assert(#t == 1000)
+    `)
+	if n := L.MemoryUsage(); n > 4<<20 {
+		t.Errorf("memory usage %v exceeds the limit", n)
+	}
+}
+
+func TestMemoryLibraryFunctions(t *testing.T) {
+	L := NewState(Options{MemoryLimit: 4 << 20})
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+    s = string.rep("x", 1e6)
+    t = {}
+    for i = 1, 100 do t[i] = s end
+    -- the copies of a string share its bytes
+    collectgarbage()
+    assert(collectgarbage("count") < 2048, collectgarbage("count"))
+    `)
+	// results are reserved before they are built, so the 100MB strings are
+	// never allocated
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	errorIfScriptFail(t, L, `
+    local ok, msg = pcall(table.concat, t)
+    assert(not ok and msg == "not enough memory", msg)
+    ok, msg = pcall(function() return s .. s .. s .. s .. s .. s .. s .. s .. s .. s end)
+    assert(not ok and msg == "not enough memory", msg)
+    ok, msg = pcall(string.gsub, s, "x+", "%0%0%0%0%0")
+    assert(not ok and msg == "not enough memory", msg)
+    `)
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > 50<<20 {
+		t.Errorf("%v bytes were allocated past the limit", n)
+	}
+}
+
+func TestMemoryRepOverflow(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+    local ok, msg = pcall(string.rep, "xx", 2^62)
+    assert(not ok and string.find(msg, "resulting string too large"), msg)
+    `)
+}
+
+func TestMemorySharedTables(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	before := L.MemoryUsage()
+	// tables of the state filled by other goroutines, e.g. sent by channels
+	const workers, n = 4, 10000
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		tb := L.NewTable()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < n; j++ {
+				tb.Append(LTrue)
+			}
+		}()
+	}
+	wg.Wait()
+	errorIfNotEqual(t, workers*(memTable+n*memSlot), L.MemoryUsage()-before)
+}
+
+func TestMemoryCount(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+    local before = collectgarbage("count")
+    big = {}
+    for i = 1, 10000 do big[i] = {i} end
+    local after = collectgarbage("count")
+    assert(after - before > 10000 * 64 / 1024, after - before)
+    big = nil
+    collectgarbage()
+    assert(collectgarbage("count") < after)
+    `)
+}
+
+func TestWeakTables(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+    local function count(t)
+      local n = 0
+      for _ in pairs(t) do n = n + 1 end
+      return n
+    end
+
+    local keys = setmetatable({}, {__mode = "k"})
+    local values = setmetatable({}, {__mode = "v"})
+    local both = setmetatable({}, {__mode = "kv"})
+    local kept = {}
+    for i = 1, 10 do
+      local obj = {}
+      keys[obj] = i
+      values[i] = obj
+      values["s" .. i] = function() return obj end
+      both[obj] = obj
+      if i <= 3 then kept[i] = obj end
+    end
+    values.str = "strings are not collected"
+    collectgarbage()
+    assert(count(keys) == 3, tostring(count(keys)))
+    assert(count(values) == 4, tostring(count(values)))
+    assert(count(both) == 3, tostring(count(both)))
+    for i, obj in ipairs(kept) do
+      assert(keys[obj] == i and values[i] == obj and both[obj] == obj)
+    end
+
+    -- values of weak keys are strong
+    local cache = setmetatable({}, {__mode = "k"})
+    cache[kept[1]] = {}
+    collectgarbage()
+    assert(next(cache[kept[1]]) == nil)
+    `)
+
+	// objects buffered in channels are reachable
+	errorIfScriptFail(t, L, `
+    local values = setmetatable({}, {__mode = "v"})
+    queue = channel.make(1)
+    local obj = {}
+    values[1] = obj
+    queue:send(obj)
+    obj = nil
+    collectgarbage()
+    local _, received = queue:receive()
+    assert(values[1] == received)
+    received = nil
+    collectgarbage()
+    assert(values[1] == nil)
+    `)
+
+	// without collectgarbage, weak tables are swept as the state allocates
+	errorIfScriptFail(t, L, `
+    local memo = setmetatable({}, {__mode = "k"})
+    for i = 1, 100000 do memo[{}] = i end
+    local n = 0
+    for _ in pairs(memo) do n = n + 1 end
+    assert(n < 100000, tostring(n))
+    `)
+}
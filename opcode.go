@@ -1,7 +1,11 @@
 package lua
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+
+	"github.com/gladkikhartem/gopher-lua/dump"
 )
 
 /*
@@ -96,8 +100,23 @@ const (
 	OP_VARARG /*     A B     R(A) R(A+1) ... R(A+B-1) = vararg            */
 
 	OP_NOP /* NOP */
+
+	// Opcodes added after Lua 5.1 are appended, so the code of older
+	// snapshots keeps its meaning.
+	OP_IDIV /*      A B C   R(A) := RK(B) // RK(C)                          */
+	OP_BAND /*      A B C   R(A) := RK(B) & RK(C)                           */
+	OP_BOR  /*      A B C   R(A) := RK(B) | RK(C)                           */
+	OP_BXOR /*      A B C   R(A) := RK(B) ~ RK(C)                           */
+	OP_SHL  /*      A B C   R(A) := RK(B) << RK(C)                          */
+	OP_SHR  /*      A B C   R(A) := RK(B) >> RK(C)                          */
+	OP_BNOT /*      A B     R(A) := ~R(B)                                   */
 )
-const opCodeMax = OP_NOP
+const opCodeMax = OP_BNOT
+
+// dump.Validate decodes instructions on its own, keep it in sync.
+var _ = [1]struct{}{}[dump.OpCodeMax-opCodeMax]
+var _ = [1]struct{}{}[dump.OpSetList-OP_SETLIST]
+var _ = [1]struct{}{}[dump.MaxRegisters-maxRegisters]
 
 type opArgMode int
 
@@ -125,49 +144,33 @@ type opProp struct {
 	Type     opType
 }
 
-var opProps = []opProp{
-	opProp{"MOVE", false, true, opArgModeR, opArgModeN, opTypeABC},
-	opProp{"MOVEN", false, true, opArgModeR, opArgModeN, opTypeABC},
-	opProp{"LOADK", false, true, opArgModeK, opArgModeN, opTypeABx},
-	opProp{"LOADBOOL", false, true, opArgModeU, opArgModeU, opTypeABC},
-	opProp{"LOADNIL", false, true, opArgModeR, opArgModeN, opTypeABC},
-	opProp{"GETUPVAL", false, true, opArgModeU, opArgModeN, opTypeABC},
-	opProp{"GETGLOBAL", false, true, opArgModeK, opArgModeN, opTypeABx},
-	opProp{"GETTABLE", false, true, opArgModeR, opArgModeK, opTypeABC},
-	opProp{"GETTABLEKS", false, true, opArgModeR, opArgModeK, opTypeABC},
-	opProp{"SETGLOBAL", false, false, opArgModeK, opArgModeN, opTypeABx},
-	opProp{"SETUPVAL", false, false, opArgModeU, opArgModeN, opTypeABC},
-	opProp{"SETTABLE", false, false, opArgModeK, opArgModeK, opTypeABC},
-	opProp{"SETTABLEKS", false, false, opArgModeK, opArgModeK, opTypeABC},
-	opProp{"NEWTABLE", false, true, opArgModeU, opArgModeU, opTypeABC},
-	opProp{"SELF", false, true, opArgModeR, opArgModeK, opTypeABC},
-	opProp{"ADD", false, true, opArgModeK, opArgModeK, opTypeABC},
-	opProp{"SUB", false, true, opArgModeK, opArgModeK, opTypeABC},
-	opProp{"MUL", false, true, opArgModeK, opArgModeK, opTypeABC},
-	opProp{"DIV", false, true, opArgModeK, opArgModeK, opTypeABC},
-	opProp{"MOD", false, true, opArgModeK, opArgModeK, opTypeABC},
-	opProp{"POW", false, true, opArgModeK, opArgModeK, opTypeABC},
-	opProp{"UNM", false, true, opArgModeR, opArgModeN, opTypeABC},
-	opProp{"NOT", false, true, opArgModeR, opArgModeN, opTypeABC},
-	opProp{"LEN", false, true, opArgModeR, opArgModeN, opTypeABC},
-	opProp{"CONCAT", false, true, opArgModeR, opArgModeR, opTypeABC},
-	opProp{"JMP", false, false, opArgModeR, opArgModeN, opTypeASbx},
-	opProp{"EQ", true, false, opArgModeK, opArgModeK, opTypeABC},
-	opProp{"LT", true, false, opArgModeK, opArgModeK, opTypeABC},
-	opProp{"LE", true, false, opArgModeK, opArgModeK, opTypeABC},
-	opProp{"TEST", true, true, opArgModeR, opArgModeU, opTypeABC},
-	opProp{"TESTSET", true, true, opArgModeR, opArgModeU, opTypeABC},
-	opProp{"CALL", false, true, opArgModeU, opArgModeU, opTypeABC},
-	opProp{"TAILCALL", false, true, opArgModeU, opArgModeU, opTypeABC},
-	opProp{"RETURN", false, false, opArgModeU, opArgModeN, opTypeABC},
-	opProp{"FORLOOP", false, true, opArgModeR, opArgModeN, opTypeASbx},
-	opProp{"FORPREP", false, true, opArgModeR, opArgModeN, opTypeASbx},
-	opProp{"TFORLOOP", true, false, opArgModeN, opArgModeU, opTypeABC},
-	opProp{"SETLIST", false, false, opArgModeU, opArgModeU, opTypeABC},
-	opProp{"CLOSE", false, false, opArgModeN, opArgModeN, opTypeABC},
-	opProp{"CLOSURE", false, true, opArgModeU, opArgModeN, opTypeABx},
-	opProp{"VARARG", false, true, opArgModeU, opArgModeN, opTypeABC},
-	opProp{"NOP", false, false, opArgModeR, opArgModeN, opTypeASbx},
+// opProps is built from dump.OpModes, the instruction table shared with
+// dump.Validate.
+var opProps = makeOpProps()
+
+func makeOpProps() []opProp {
+	props := make([]opProp, len(dump.OpModes))
+	for op, m := range dump.OpModes {
+		props[op] = opProp{m.Name, m.IsTest, m.SetRegA, opArgMode(m.ModeArgB), opArgMode(m.ModeArgC), opType(m.Type)}
+	}
+	return props
+}
+
+// OpCodeHash identifies the instruction set. Snapshots carry it, so code
+// compiled for another instruction set is never run. A migration that
+// upgrades the code of a snapshot sets dump.Data.OpCodeHash to it.
+var OpCodeHash = hashOpCodes(opProps)
+
+// olderOpCodeHashes identifies the instruction sets this one extends by
+// appending opcodes. Their code runs unchanged, so snapshots carrying them
+// are loaded without a migration.
+var olderOpCodeHashes = map[string]bool{
+	hashOpCodes(opProps[:OP_NOP+1]): true, // Lua 5.1
+}
+
+func hashOpCodes(props []opProp) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%v", props)))
+	return hex.EncodeToString(sum[:8])
 }
 
 func opGetOpCode(inst uint32) int {
@@ -246,6 +249,19 @@ func opCreateASbx(op int, a int, sbx int) uint32 {
 const opBitRk = 1 << (opSizeB - 1)
 const opMaxIndexRk = opBitRk - 1
 
+// opMaxRegister returns the highest register the operands of inst address,
+// or -1 if they address none.
+func opMaxRegister(inst uint32) int {
+	mode := dump.OpModes[opGetOpCode(inst)]
+	max := -1
+	for _, arg := range [...][2]int{{mode.A, opGetArgA(inst)}, {mode.B, opGetArgB(inst)}, {mode.C, opGetArgC(inst)}} {
+		if (arg[0] == dump.ArgR || arg[0] == dump.ArgRK && !opIsK(arg[1])) && arg[1] > max {
+			max = arg[1]
+		}
+	}
+	return max
+}
+
 func opIsK(value int) bool {
 	return bool((value & opBitRk) != 0)
 }
@@ -364,6 +380,20 @@ func opToString(inst uint32) string {
 		buf += fmt.Sprintf("; R(%v) := closure(KPROTO[%v] R(%v) ... R(%v+n))", arga, argbx, arga, arga)
 	case OP_VARARG:
 		buf += fmt.Sprintf(";  R(%v) R(%v+1) ... R(%v+%v-1) = vararg", arga, arga, arga, argb)
+	case OP_IDIV:
+		buf += fmt.Sprintf("; R(%v) := RK(%v) // RK(%v)", arga, argb, argc)
+	case OP_BAND:
+		buf += fmt.Sprintf("; R(%v) := RK(%v) & RK(%v)", arga, argb, argc)
+	case OP_BOR:
+		buf += fmt.Sprintf("; R(%v) := RK(%v) | RK(%v)", arga, argb, argc)
+	case OP_BXOR:
+		buf += fmt.Sprintf("; R(%v) := RK(%v) ~ RK(%v)", arga, argb, argc)
+	case OP_SHL:
+		buf += fmt.Sprintf("; R(%v) := RK(%v) << RK(%v)", arga, argb, argc)
+	case OP_SHR:
+		buf += fmt.Sprintf("; R(%v) := RK(%v) >> RK(%v)", arga, argb, argc)
+	case OP_BNOT:
+		buf += fmt.Sprintf("; R(%v) := ~R(%v)", arga, argb)
 	case OP_NOP:
 		/* nothing to do */
 	}
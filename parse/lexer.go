@@ -45,6 +45,8 @@ func isDigit(ch int) bool {
 type Scanner struct {
 	Pos    ast.Position
 	reader *bufio.Reader
+	lua53  bool // scan the operators of Lua 5.3
+	labels bool // scan the goto keyword and the labels of Lua 5.2
 }
 
 func NewScanner(reader io.Reader, source string) *Scanner {
@@ -282,7 +284,7 @@ finally:
 var reservedWords = map[string]int{
 	"and": TAnd, "break": TBreak, "do": TDo, "else": TElse, "elseif": TElseIf,
 	"end": TEnd, "false": TFalse, "for": TFor, "function": TFunction,
-	"if": TIf, "in": TIn, "local": TLocal, "nil": TNil, "not": TNot, "or": TOr,
+	"goto": TGoto, "if": TIf, "in": TIn, "local": TLocal, "nil": TNil, "not": TNot, "or": TOr,
 	"return": TReturn, "repeat": TRepeat, "then": TThen, "true": TTrue,
 	"until": TUntil, "while": TWhile}
 
@@ -316,7 +318,7 @@ redo:
 		if err != nil {
 			goto finally
 		}
-		if typ, ok := reservedWords[tok.Str]; ok {
+		if typ, ok := reservedWords[tok.Str]; ok && (typ != TGoto || sc.labels) {
 			tok.Type = typ
 		}
 	case isDecimal(ch):
@@ -365,14 +367,30 @@ redo:
 				tok.Type = TNeq
 				tok.Str = "~="
 				sc.Next()
+			} else if sc.lua53 {
+				tok.Type = ch
+				tok.Str = "~"
 			} else {
 				err = sc.Error("~", "Invalid '~' token")
 			}
+		case '/':
+			if sc.lua53 && sc.Peek() == '/' {
+				tok.Type = TIdiv
+				tok.Str = "//"
+				sc.Next()
+			} else {
+				tok.Type = ch
+				tok.Str = "/"
+			}
 		case '<':
 			if sc.Peek() == '=' {
 				tok.Type = TLte
 				tok.Str = "<="
 				sc.Next()
+			} else if sc.lua53 && sc.Peek() == '<' {
+				tok.Type = TShl
+				tok.Str = "<<"
+				sc.Next()
 			} else {
 				tok.Type = ch
 				tok.Str = string(ch)
@@ -382,6 +400,10 @@ redo:
 				tok.Type = TGte
 				tok.Str = ">="
 				sc.Next()
+			} else if sc.lua53 && sc.Peek() == '>' {
+				tok.Type = TShr
+				tok.Str = ">>"
+				sc.Next()
 			} else {
 				tok.Type = ch
 				tok.Str = string(ch)
@@ -406,7 +428,23 @@ redo:
 				tok.Type = '.'
 			}
 			tok.Str = buf.String()
-		case '+', '*', '/', '%', '^', '#', '(', ')', '{', '}', ']', ';', ':', ',':
+		case ':':
+			if sc.labels && sc.Peek() == ':' {
+				tok.Type = T2Colon
+				tok.Str = "::"
+				sc.Next()
+			} else {
+				tok.Type = ch
+				tok.Str = string(ch)
+			}
+		case '&', '|':
+			if !sc.lua53 {
+				writeChar(buf, ch)
+				err = sc.Error(buf.String(), "Invalid token")
+				goto finally
+			}
+			fallthrough
+		case '+', '*', '%', '^', '#', '(', ')', '{', '}', ']', ';', ',':
 			tok.Type = ch
 			tok.Str = string(ch)
 		default:
@@ -453,8 +491,27 @@ func (lx *Lexer) TokenError(tok ast.Token, message string) {
 	panic(lx.scanner.TokenError(tok, message))
 }
 
+// Options select the syntax accepted by ParseWithOptions.
+type Options struct {
+	// Lua53Operators accepts the bitwise operators &, |, binary and unary
+	// ~, << and >>, and the floor division // of Lua 5.3. Without it they
+	// are syntax errors, like in Lua 5.1.
+	Lua53Operators bool
+	// Goto accepts the goto statement and the labels of Lua 5.2. Without it
+	// goto is a name, like in Lua 5.1.
+	Goto bool
+}
+
+// Parse parses the Lua 5.1 syntax.
 func Parse(reader io.Reader, name string) (chunk []ast.Stmt, err error) {
-	lexer := &Lexer{NewScanner(reader, name), nil, false, ast.Token{Str: ""}, TNil}
+	return ParseWithOptions(reader, name, Options{})
+}
+
+func ParseWithOptions(reader io.Reader, name string, opts Options) (chunk []ast.Stmt, err error) {
+	scanner := NewScanner(reader, name)
+	scanner.lua53 = opts.Lua53Operators
+	scanner.labels = opts.Goto
+	lexer := &Lexer{scanner, nil, false, ast.Token{Str: ""}, TNil}
 	chunk = nil
 	defer func() {
 		if e := recover(); e != nil {
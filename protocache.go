@@ -0,0 +1,195 @@
+package lua
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/gladkikhartem/gopher-lua/dump"
+)
+
+// ProtoCache shares function prototypes between states loaded with it, so
+// the code of many snapshots is kept in memory once. Prototypes are never
+// modified after compilation, so sharing them is safe.
+// It is safe for concurrent use.
+type ProtoCache struct {
+	mu     sync.Mutex
+	protos map[string]*FunctionProto
+}
+
+func NewProtoCache() *ProtoCache {
+	return &ProtoCache{protos: make(map[string]*FunctionProto)}
+}
+
+func (c *ProtoCache) get(hash string) *FunctionProto {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.protos[hash]
+}
+
+// share returns the cached prototype with the hash of fp, fp itself is
+// cached if there is none. Prototypes without a hash are not shared.
+func (c *ProtoCache) share(fp *FunctionProto) *FunctionProto {
+	hash, err := protoHash(fp)
+	if err != nil {
+		return fp
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cached, ok := c.protos[hash]; ok {
+		return cached
+	}
+	c.protos[hash] = fp
+	return fp
+}
+
+// protoHash returns the content hash of fp, see dump.HashProto.
+func protoHash(fp *FunctionProto) (string, error) {
+	if fp.hash == "" {
+		p, err := storedProto(fp)
+		if err != nil {
+			return "", err
+		}
+		if fp.hash, err = dump.HashProto(p); err != nil {
+			return "", err
+		}
+	}
+	return fp.hash, nil
+}
+
+// storedProto converts fp to the self-contained form of a ProtoStore.
+func storedProto(fp *FunctionProto) (*dump.Proto, error) {
+	p := &dump.Proto{FunctionProto: dump.FunctionProto{
+		SourceName:         fp.SourceName,
+		LineDefined:        fp.LineDefined,
+		LastLineDefined:    fp.LastLineDefined,
+		NumUpvalues:        fp.NumUpvalues,
+		NumParameters:      fp.NumParameters,
+		IsVarArg:           fp.IsVarArg,
+		NumUsedRegisters:   fp.NumUsedRegisters,
+		Code:               fp.Code,
+		DbgSourcePositions: fp.DbgSourcePositions,
+		DbgUpvalues:        fp.DbgUpvalues,
+		StringConstants:    fp.stringConstants,
+	}}
+	p.Constants = make([]dump.Value, len(fp.Constants))
+	for i, v := range fp.Constants {
+		p.Constants[i] = protoConstant(v)
+	}
+	p.FunctionPrototypes = make([]dump.Ptr, len(fp.FunctionPrototypes))
+	for i, v := range fp.FunctionPrototypes {
+		hash, err := protoHash(v)
+		if err != nil {
+			return nil, err
+		}
+		p.FunctionPrototypes[i] = dump.Ptr(hash)
+	}
+	p.DbgCalls = make([]dump.DbgCall, len(fp.DbgCalls))
+	for i, v := range fp.DbgCalls {
+		p.DbgCalls[i] = dump.DbgCall{Pc: v.Pc, Name: v.Name}
+	}
+	p.Locals = make([]dump.DbgLocalInfo, len(fp.DbgLocals))
+	for i, v := range fp.DbgLocals {
+		p.Locals[i] = dump.DbgLocalInfo{Name: v.Name, StartPc: v.StartPc, EndPc: v.EndPc}
+	}
+	return p, nil
+}
+
+// protoConstant converts a constant of a prototype, constants are never
+// reference values.
+func protoConstant(lv LValue) dump.Value {
+	switch v := lv.(type) {
+	case LBool:
+		return dump.Value{Type: int(LTBool), Bool: bool(v)}
+	case LNumber:
+		return dump.Value{Type: int(LTNumber), Number: float64(v)}
+	case LInteger:
+		return dump.Value{Type: int(LTNumber), Integer: true, Int: int64(v)}
+	case LString:
+		return dump.Value{Type: int(LTString), String: string(v)}
+	default:
+		return dump.Value{Type: int(LTNil)}
+	}
+}
+
+// storeProto puts fp and its nested prototypes into the ProtoStore of the
+// dump. It reports false if any of them could not be stored.
+func (d *dumper) storeProto(fp *FunctionProto) bool {
+	hash, err := protoHash(fp)
+	if err != nil {
+		return false
+	}
+	if d.stored[hash] {
+		return true
+	}
+	for _, child := range fp.FunctionPrototypes {
+		if !d.storeProto(child) {
+			return false
+		}
+	}
+	p, err := storedProto(fp)
+	if err != nil {
+		return false
+	}
+	p.Hash = hash
+	if err := d.opts.Protos.Put(hash, p); err != nil {
+		return false
+	}
+	d.stored[hash] = true
+	return true
+}
+
+// loadStoredProto returns a prototype kept in the ProtoStore of the load.
+func (d *dumpLoader) loadStoredProto(hash string) (*FunctionProto, error) {
+	if fp := d.protos.get(hash); fp != nil {
+		return fp, nil
+	}
+	if d.opts.Protos == nil {
+		return nil, fmt.Errorf("proto %v is in a ProtoStore, but none is given", hash)
+	}
+	p, err := d.opts.Protos.Get(hash)
+	if err != nil {
+		return nil, err
+	}
+	fp := &FunctionProto{
+		SourceName:         p.SourceName,
+		LineDefined:        p.LineDefined,
+		LastLineDefined:    p.LastLineDefined,
+		NumUpvalues:        p.NumUpvalues,
+		NumParameters:      p.NumParameters,
+		IsVarArg:           p.IsVarArg,
+		NumUsedRegisters:   p.NumUsedRegisters,
+		Code:               p.Code,
+		DbgSourcePositions: p.DbgSourcePositions,
+		DbgUpvalues:        p.DbgUpvalues,
+		stringConstants:    p.StringConstants,
+	}
+	fp.Constants = make([]LValue, len(p.Constants))
+	for i, v := range p.Constants {
+		if v.Ptr != "" {
+			return nil, fmt.Errorf("proto %v has a reference constant", hash)
+		}
+		if fp.Constants[i], err = d.loadLValue(v); err != nil {
+			return nil, err
+		}
+	}
+	fp.FunctionPrototypes = make([]*FunctionProto, len(p.FunctionPrototypes))
+	for i, child := range p.FunctionPrototypes {
+		if fp.FunctionPrototypes[i], err = d.loadStoredProto(string(child)); err != nil {
+			return nil, err
+		}
+	}
+	fp.DbgCalls = make([]DbgCall, len(p.DbgCalls))
+	for i, v := range p.DbgCalls {
+		fp.DbgCalls[i] = DbgCall{Pc: v.Pc, Name: v.Name}
+	}
+	fp.DbgLocals = make([]*DbgLocalInfo, len(p.Locals))
+	for i, v := range p.Locals {
+		fp.DbgLocals[i] = &DbgLocalInfo{Name: v.Name, StartPc: v.StartPc, EndPc: v.EndPc}
+	}
+	if got, err := protoHash(fp); err != nil {
+		return nil, err
+	} else if got != hash {
+		return nil, fmt.Errorf("content of proto %v does not match its hash", hash)
+	}
+	return d.protos.share(fp), nil
+}
@@ -19,6 +19,8 @@ var gluaTests []string = []string{
 	"vm.lua",
 	"math.lua",
 	"strings.lua",
+	"goto.lua",
+	"bitwise.lua",
 }
 
 var luaTests []string = []string{
@@ -43,7 +45,7 @@ func testScriptCompile(t *testing.T, script string) {
 		t.Fatal(err)
 		return
 	}
-	chunk, err2 := parse.Parse(file, script)
+	chunk, err2 := parse.ParseWithOptions(file, script, parse.Options{Lua53Operators: true, Goto: true})
 	if err2 != nil {
 		t.Fatal(err2)
 		return
@@ -69,8 +71,10 @@ func testScriptDir(t *testing.T, tests []string, directory string) {
 			RegistrySize:        1024 * 20,
 			CallStackSize:       1024,
 			IncludeGoStackTrace: true,
+			Lua53Operators:      true,
+			Goto:                true,
+			MemoryLimit:         maxMemory << 20,
 		})
-		L.SetMx(maxMemory)
 		if err := L.DoFile(script); err != nil {
 			t.Error(err)
 		}
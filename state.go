@@ -60,6 +60,11 @@ const (
 	ApiErrorRun
 	ApiErrorError
 	ApiErrorPanic
+	// ApiErrorBudget is raised when the instruction budget is exhausted.
+	ApiErrorBudget
+	// ApiErrorPaused is returned by PCall and Continue when the state was
+	// paused by PauseOnInstructionLimit. Its call stack is kept.
+	ApiErrorPaused
 )
 
 /* }}} */
@@ -99,6 +104,38 @@ type Options struct {
 	SkipOpenLibs bool
 	// Tells whether a Go stacktrace should be included in a Lua stacktrace when panics occur.
 	IncludeGoStackTrace bool
+	// Checkpoint makes the VM take snapshots of the state while it runs.
+	Checkpoint *CheckpointPolicy
+	// InstructionLimit is the number of instructions the state and its
+	// threads may execute, 0 means unlimited. Then an ApiErrorBudget error
+	// is raised before every instruction. See SetInstructionBudget.
+	InstructionLimit int
+	// PauseOnInstructionLimit pauses the state instead of raising an error
+	// when the limit is reached: PCall returns an ApiErrorPaused error and
+	// keeps the call stack, so the state can be dumped, or resumed by
+	// Continue after a new budget is set. The state can be paused in pcall,
+	// xpcall and coroutines, but not in Lua code called by other Go
+	// functions, e.g. the comparator of table.sort, so it may exceed the
+	// limit. If it cannot be paused within 10000 more instructions, an
+	// ApiErrorBudget error is raised instead.
+	PauseOnInstructionLimit bool
+	// MemoryLimit is the approximate number of bytes the state and its
+	// threads may allocate, 0 means unlimited. When it is exceeded, a
+	// "not enough memory" error is raised that can be caught by pcall.
+	// See SetMemoryLimit.
+	MemoryLimit int
+	// Integers makes integer numerals in the code, and the results of
+	// tonumber, math.floor, math.ceil and the length operator for integer
+	// values, integers (LInteger) like in Lua 5.3. Arithmetic on integers
+	// keeps them integers, so they are exact beyond 2^53.
+	Integers bool
+	// Lua53Operators makes the compiler accept the bitwise operators and
+	// the floor division // of Lua 5.3. Without it they are syntax errors,
+	// like in Lua 5.1.
+	Lua53Operators bool
+	// Goto makes the compiler accept the goto statement and the labels of
+	// Lua 5.2. Without it goto is a name, like in Lua 5.1.
+	Goto bool
 }
 
 /* }}} */
@@ -131,6 +168,8 @@ type callFrame struct {
 	NArgs      int
 	NRet       int
 	TailCall   int
+
+	hookPc int // 1 + pc of the last instruction seen by the hook, 0 before the first
 }
 
 type callFrameStack struct {
@@ -296,13 +335,16 @@ func (rg *registry) SetNumber(reg int, val LNumber) {
 /* Global {{{ */
 
 func newGlobal() *Global {
-	return &Global{
+	G := &Global{
 		MainThread: nil,
 		Registry:   newLTable(0, 32),
 		Global:     newLTable(0, 64),
 		builtinMts: make(map[int]LValue),
 		tempFiles:  make([]*os.File, 0, 10),
 	}
+	G.Registry.mem = &G.mem
+	G.Global.mem = &G.mem
+	return G
 }
 
 /* }}} */
@@ -340,7 +382,9 @@ func newLState(options Options) *LState {
 		mainLoop:     mainLoop,
 		ctx:          nil,
 	}
+	ls.setMainLoop()
 	ls.Env = ls.G.Global
+	ls.G.mem.alloc(ls.threadMemory())
 	return ls
 }
 
@@ -735,7 +779,7 @@ func (ls *LState) initCallFrame(cf *callFrame) { // +inline-start
 			if CompatVarArg {
 				ls.reg.SetTop(cf.LocalBase + nargs + np + 1)
 				if (proto.IsVarArg & VarArgNeedsArg) != 0 {
-					argtb := newLTable(nvarargs, 0)
+					argtb := ls.newTable(nvarargs, 0)
 					for i := 0; i < nvarargs; i++ {
 						argtb.RawSetInt(i+1, ls.reg.Get(cf.LocalBase+np+i))
 					}
@@ -831,7 +875,7 @@ func (ls *LState) pushCallFrame(cf callFrame, fn LValue, meta bool) { // +inline
 				if CompatVarArg {
 					ls.reg.SetTop(cf.LocalBase + nargs + np + 1)
 					if (proto.IsVarArg & VarArgNeedsArg) != 0 {
-						argtb := newLTable(nvarargs, 0)
+						argtb := ls.newTable(nvarargs, 0)
 						for i := 0; i < nvarargs; i++ {
 							argtb.RawSetInt(i+1, ls.reg.Get(cf.LocalBase+np+i))
 						}
@@ -869,13 +913,12 @@ func (ls *LState) callR(nargs, nret, rbase int) {
 		Parent:     ls.currentFrame,
 		TailCall:   0,
 	}, lv, meta)
-
 	if ls.G.MainThread == nil {
 		ls.G.MainThread = ls
 		ls.G.CurrentThread = ls
-		ls.mainLoop(ls, nil)
+		runMainLoop(ls, nil)
 	} else {
-		ls.mainLoop(ls, ls.currentFrame)
+		runMainLoop(ls, ls.currentFrame)
 	}
 	if nret != MultRet {
 		ls.reg.SetTop(rbase + nret)
@@ -1028,14 +1071,23 @@ func NewState(opts ...Options) *LState {
 			opts[0].RegistrySize = RegistrySize
 		}
 		ls = newLState(opts[0])
+		if opts[0].Checkpoint != nil {
+			ls.G.checkpoints = newCheckpointer(opts[0].Checkpoint)
+		}
+		if opts[0].InstructionLimit > 0 {
+			ls.SetInstructionBudget(opts[0].InstructionLimit)
+		}
 		if !opts[0].SkipOpenLibs {
 			ls.OpenLibs()
 		}
+		ls.SetMemoryLimit(opts[0].MemoryLimit)
 	}
+	ls.collectMemory()
 	return ls
 }
 
 func (ls *LState) Close() {
+	ls.runFinalizers()
 	atomic.AddInt32(&ls.stop, 1)
 	for _, file := range ls.G.tempFiles {
 		// ignore errors in these operations
@@ -1197,11 +1249,11 @@ func (ls *LState) Remove(index int) {
 /* object allocation {{{ */
 
 func (ls *LState) NewTable() *LTable {
-	return newLTable(defaultArrayCap, defaultHashCap)
+	return ls.newTable(defaultArrayCap, defaultHashCap)
 }
 
 func (ls *LState) CreateTable(acap, hcap int) *LTable {
-	return newLTable(acap, hcap)
+	return ls.newTable(acap, hcap)
 }
 
 // NewThread returns a new LState that shares with the original state all global objects.
@@ -1210,15 +1262,18 @@ func (ls *LState) NewThread() (*LState, context.CancelFunc) {
 	thread := newLState(ls.Options)
 	thread.G = ls.G
 	thread.Env = ls.Env
+	ls.G.mem.alloc(thread.threadMemory())
+	thread.hook = ls.hook.inherit()
 	var f context.CancelFunc = nil
 	if ls.ctx != nil {
-		thread.mainLoop = mainLoopWithContext
 		thread.ctx, f = context.WithCancel(ls.ctx)
 	}
+	thread.setMainLoop()
 	return thread, f
 }
 
 func (ls *LState) NewUserData() *LUserData {
+	ls.G.mem.alloc(memUserData)
 	return &LUserData{
 		Env:       ls.currentEnv(),
 		Metatable: LNil,
@@ -1248,7 +1303,10 @@ func (ls *LState) ToBool(n int) bool {
 }
 
 func (ls *LState) ToInt(n int) int {
-	if lv, ok := ls.Get(n).(LNumber); ok {
+	switch lv := ls.Get(n).(type) {
+	case LNumber:
+		return int(lv)
+	case LInteger:
 		return int(lv)
 	}
 	if lv, ok := ls.Get(n).(LString); ok {
@@ -1260,7 +1318,10 @@ func (ls *LState) ToInt(n int) int {
 }
 
 func (ls *LState) ToInt64(n int) int64 {
-	if lv, ok := ls.Get(n).(LNumber); ok {
+	switch lv := ls.Get(n).(type) {
+	case LNumber:
+		return int64(lv)
+	case LInteger:
 		return int64(lv)
 	}
 	if lv, ok := ls.Get(n).(LString); ok {
@@ -1549,8 +1610,8 @@ func (ls *LState) ObjLen(v1 LValue) int {
 		ls.Push(v1)
 		ls.Call(1, 1)
 		ret := ls.reg.Pop()
-		if ret.Type() == LTNumber {
-			return int(ret.(LNumber))
+		if n, ok := ret.assertFloat64(); ok {
+			return int(n)
 		}
 	} else if v1.Type() == LTTable {
 		return v1.(*LTable).Len()
@@ -1597,11 +1658,11 @@ func (ls *LState) Register(name string, fn LGFunction) {
 /* load and function call operations {{{ */
 
 func (ls *LState) Load(reader io.Reader, name string) (*LFunction, error) {
-	chunk, err := parse.Parse(reader, name)
+	chunk, err := parse.ParseWithOptions(reader, name, parse.Options{Lua53Operators: ls.Options.Lua53Operators, Goto: ls.Options.Goto})
 	if err != nil {
 		return nil, newApiErrorE(ApiErrorSyntax, err)
 	}
-	proto, err := Compile(chunk, name)
+	proto, err := compile(chunk, name, ls.Options.Integers)
 	if err != nil {
 		return nil, newApiErrorE(ApiErrorSyntax, err)
 	}
@@ -1613,9 +1674,17 @@ func (ls *LState) Call(nargs, nret int) {
 }
 
 func (ls *LState) PCall(nargs, nret int, errfunc *LFunction) (err error) {
+	return ls.pcall(ls.stack.Sp(), ls.reg.Top()-nargs-1, errfunc, func() {
+		ls.Call(nargs, nret)
+	})
+}
+
+// pcall runs call, which calls the function at the register base above the
+// first sp frames of the call stack, and catches its errors like PCall. A
+// pause is passed on to the caller of the outermost call, so the frames of
+// pcall, xpcall and coroutine.resume are kept for Continue.
+func (ls *LState) pcall(sp, base int, errfunc *LFunction, call func()) (err error) {
 	err = nil
-	sp := ls.stack.Sp()
-	base := ls.reg.Top() - nargs - 1
 	oldpanic := ls.Panic
 	ls.Panic = panicWithoutTraceback
 	if errfunc != nil {
@@ -1625,6 +1694,13 @@ func (ls *LState) PCall(nargs, nret int, errfunc *LFunction) (err error) {
 		ls.Panic = oldpanic
 		ls.hasErrorFunc = false
 		rcv := recover()
+		if aerr, ok := rcv.(*ApiError); ok && aerr.Type == ApiErrorPaused {
+			if sp > 0 && resumable(ls.stack.At(sp-1).Fn) != nil {
+				panic(aerr) // paused in pcall or xpcall
+			}
+			err = aerr // the call stack is kept for Continue
+			return
+		}
 		if rcv != nil {
 			if _, ok := rcv.(*ApiError); !ok {
 				err = newApiErrorS(ApiErrorPanic, fmt.Sprint(rcv))
@@ -1672,7 +1748,7 @@ func (ls *LState) PCall(nargs, nret int, errfunc *LFunction) (err error) {
 		}
 	}()
 
-	ls.Call(nargs, nret)
+	call()
 
 	return
 }
@@ -1716,6 +1792,7 @@ func (ls *LState) SetMetatable(obj LValue, mt LValue) {
 		v.Metatable = mt
 	case *LUserData:
 		v.Metatable = mt
+		ls.G.setFinalizer(v)
 	default:
 		ls.G.builtinMts[int(obj.Type())] = mt
 	}
@@ -1778,7 +1855,7 @@ func (ls *LState) Resume(th *LState, fn *LFunction, args ...LValue) (ResumeState
 		}
 	}
 	top := ls.GetTop()
-	threadRun(th)
+	threadRun(th, false)
 	haserror := LVIsFalse(ls.Get(top + 1))
 	ret := make([]LValue, 0, ls.GetTop())
 	for idx := top + 2; idx <= ls.GetTop(); idx++ {
@@ -1822,6 +1899,9 @@ func (ls *LState) XMoveTo(other *LState, n int) {
 /* GopherLua original APIs {{{ */
 
 // Set maximum memory size. This function can only be called from the main thread.
+//
+// Deprecated: SetMx watches the memory of the whole process and exits it
+// when the limit is reached. Use Options.MemoryLimit or SetMemoryLimit.
 func (ls *LState) SetMx(mx int) {
 	if ls.Parent != nil {
 		ls.RaiseError("sub threads are not allowed to set a memory limit")
@@ -1842,8 +1922,8 @@ func (ls *LState) SetMx(mx int) {
 
 // SetContext set a context ctx to this LState. The provided ctx must be non-nil.
 func (ls *LState) SetContext(ctx context.Context) {
-	ls.mainLoop = mainLoopWithContext
 	ls.ctx = ctx
+	ls.setMainLoop()
 }
 
 // Context returns the LState's context. To change the context, use WithContext.
@@ -1854,11 +1934,25 @@ func (ls *LState) Context() context.Context {
 // RemoveContext removes the context associated with this LState and returns this context.
 func (ls *LState) RemoveContext() context.Context {
 	oldctx := ls.ctx
-	ls.mainLoop = mainLoop
 	ls.ctx = nil
+	ls.setMainLoop()
 	return oldctx
 }
 
+// setMainLoop selects the main loop that runs the hooks the state needs.
+func (ls *LState) setMainLoop() {
+	// a running loop continues in the new one after the call of the Go
+	// function that changed it, see loopKind and runMainLoop
+	switch {
+	case ls.Options.Checkpoint != nil || ls.G.budget != nil || ls.hook != nil:
+		ls.mainLoop, ls.loopKind = mainLoopWithHooks, 2
+	case ls.ctx != nil:
+		ls.mainLoop, ls.loopKind = mainLoopWithContext, 1
+	default:
+		ls.mainLoop, ls.loopKind = mainLoop, 0
+	}
+}
+
 // Converts the Lua value at the given acceptable index to the chan LValue.
 func (ls *LState) ToChannel(n int) chan LValue {
 	if lv, ok := ls.Get(n).(LChannel); ok {
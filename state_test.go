@@ -431,3 +431,61 @@ func TestPCallAfterFail(t *testing.T) {
 	err := L.PCall(0, 0, nil)
 	errorIfFalse(t, strings.Contains(err.Error(), "A New Error"), "error not propogated correctly")
 }
+
+func TestLua53Operators(t *testing.T) {
+	scripts := []string{`x = 7 // 2`, `x = 6 & 3`, `x = 6 | 3`, `x = 6 ~ 3`, `x = ~6`, `x = 1 << 4`, `x = 16 >> 4`}
+	L := NewState()
+	defer L.Close()
+	for _, script := range scripts {
+		errorIfScriptNotFail(t, L, script, "syntax error|Invalid")
+	}
+	errorIfScriptFail(t, L, `assert(7 / 2 == 3.5 and 1 < 2 and 2 > 1 and 1 ~= 2)`)
+
+	L2 := NewState(Options{Lua53Operators: true})
+	defer L2.Close()
+	for _, script := range scripts {
+		errorIfScriptFail(t, L2, script)
+	}
+	L3, err := testLoad(testDump(L2))
+	errorIfNotNil(t, err)
+	defer L3.Close()
+	errorIfFalse(t, L3.Options.Lua53Operators, "Lua53Operators must survive a snapshot")
+	errorIfScriptFail(t, L3, `assert(loadstring("return 7 // 2")() == 3)`)
+
+	// ~ on a float without an integer representation is not folded, it
+	// raises when it runs
+	errorIfScriptFail(t, L2, `
+	  local f = assert(loadstring("return ~1.5"))
+	  local ok, msg = pcall(f)
+	  assert(not ok and string.find(msg, "no integer representation"), msg)
+	  assert(~5.0 == -6 and ~"5" == -6 and ~0 == -1)`)
+	errorIfScriptNotFail(t, L2, `x = ~math.huge`, "no integer representation")
+}
+
+func TestGoto(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	// goto is a name in Lua 5.1
+	errorIfScriptFail(t, L, `
+	  local goto = 1
+	  goto = goto + 1
+	  local t = {goto = goto}
+	  function t.f(self) return self.goto end
+	  assert(t:f() == 2 and t["goto"] == 2)`)
+	errorIfScriptNotFail(t, L, `goto done; ::done::`, "parse error")
+
+	L2 := NewState(Options{Goto: true})
+	defer L2.Close()
+	errorIfScriptFail(t, L2, `
+	  local n = 0
+	  ::again::
+	  n = n + 1
+	  if n < 3 then goto again end
+	  assert(n == 3)`)
+	errorIfScriptNotFail(t, L2, `local goto = 1`, "syntax error")
+	L3, err := testLoad(testDump(L2))
+	errorIfNotNil(t, err)
+	defer L3.Close()
+	errorIfFalse(t, L3.Options.Goto, "Goto must survive a snapshot")
+	errorIfScriptFail(t, L3, `assert(loadstring("do goto x end ::x:: return 1")() == 1)`)
+}
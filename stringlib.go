@@ -2,6 +2,7 @@ package lua
 
 import (
 	"fmt"
+	"math"
 	"strings"
 
 	"github.com/yuin/gopher-lua/pm"
@@ -74,7 +75,8 @@ func strByte(L *LState) int {
 
 func strChar(L *LState) int {
 	top := L.GetTop()
-	bytes := make([]byte, L.GetTop())
+	L.reserveMemory(memString + top)
+	bytes := make([]byte, top)
 	for i := 1; i <= top; i++ {
 		bytes[i-1] = uint8(L.CheckInt(i))
 	}
@@ -141,7 +143,20 @@ func strFormat(L *LState) int {
 		args[i-2] = L.Get(i)
 	}
 	npat := strings.Count(str, "%") - strings.Count(str, "%%")
-	L.Push(LString(fmt.Sprintf(str, args[:intMin(npat, len(args))]...)))
+	// the copies of string arguments are reserved before formatting, the
+	// rest of the result is bounded by the format
+	n := memString + len(str)
+	for _, arg := range args {
+		if s, ok := arg.(LString); ok {
+			n += len(s)
+		}
+	}
+	L.reserveMemory(n)
+	s := fmt.Sprintf(str, args[:intMin(npat, len(args))]...)
+	if len(s)+memString > n {
+		L.G.mem.alloc(len(s) + memString - n)
+	}
+	L.Push(LString(s))
 	return 1
 }
 
@@ -200,7 +215,12 @@ func capturedString(L *LState, m *pm.MatchData, str string, idx int) string {
 
 }
 
-func strGsubDoReplace(str string, info []replaceInfo) string {
+func strGsubDoReplace(L *LState, str string, info []replaceInfo) string {
+	n := memString + len(str)
+	for _, replace := range info {
+		n += len(replace.String) - (replace.Indicies[1] - replace.Indicies[0])
+	}
+	L.reserveMemory(n)
 	offset := 0
 	buf := []byte(str)
 	for _, replace := range info {
@@ -241,7 +261,7 @@ func strGsubStr(L *LState, str string, repl string, matches []*pm.MatchData) str
 		infoList = append(infoList, replaceInfo{[]int{start, end}, sc.String()})
 	}
 
-	return strGsubDoReplace(str, infoList)
+	return strGsubDoReplace(L, str, infoList)
 }
 
 func strGsubTable(L *LState, str string, repl *LTable, matches []*pm.MatchData) string {
@@ -261,7 +281,7 @@ func strGsubTable(L *LState, str string, repl *LTable, matches []*pm.MatchData)
 			infoList = append(infoList, replaceInfo{[]int{match.Capture(0), match.Capture(1)}, LVAsString(value)})
 		}
 	}
-	return strGsubDoReplace(str, infoList)
+	return strGsubDoReplace(L, str, infoList)
 }
 
 func strGsubFunc(L *LState, str string, repl *LFunction, matches []*pm.MatchData) string {
@@ -289,7 +309,7 @@ func strGsubFunc(L *LState, str string, repl *LFunction, matches []*pm.MatchData
 			infoList = append(infoList, replaceInfo{[]int{start, end}, LVAsString(ret)})
 		}
 	}
-	return strGsubDoReplace(str, infoList)
+	return strGsubDoReplace(L, str, infoList)
 }
 
 type strMatchData struct {
@@ -346,6 +366,7 @@ func strLen(L *LState) int {
 
 func strLower(L *LState) int {
 	str := L.CheckString(1)
+	L.reserveMemory(memString + len(str))
 	L.Push(LString(strings.ToLower(str)))
 	return 1
 }
@@ -395,6 +416,12 @@ func strRep(L *LState) int {
 	if n < 0 {
 		L.Push(emptyLString)
 	} else {
+		// reserved before the string is built, so that a huge result fails
+		// with a Lua error
+		if len(str) > 0 && n > (math.MaxInt-memString)/len(str) {
+			L.RaiseError("resulting string too large")
+		}
+		L.reserveMemory(memString + len(str)*n)
 		L.Push(LString(strings.Repeat(str, n)))
 	}
 	return 1
@@ -402,6 +429,7 @@ func strRep(L *LState) int {
 
 func strReverse(L *LState) int {
 	str := L.CheckString(1)
+	L.reserveMemory(memString + len(str))
 	bts := []byte(str)
 	out := make([]byte, len(bts))
 	for i, j := 0, len(bts)-1; j >= 0; i, j = i+1, j-1 {
@@ -426,6 +454,7 @@ func strSub(L *LState) int {
 
 func strUpper(L *LState) int {
 	str := L.CheckString(1)
+	L.reserveMemory(memString + len(str))
 	L.Push(LString(strings.ToUpper(str)))
 	return 1
 }
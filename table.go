@@ -70,6 +70,7 @@ func (tb *LTable) Append(value LValue) {
 	if tb.array == nil {
 		tb.array = make([]LValue, 0, defaultArrayCap)
 	}
+	tb.mem.alloc(memSlot)
 	tb.array = append(tb.array, value)
 }
 
@@ -87,6 +88,7 @@ func (tb *LTable) Insert(i int, value LValue) {
 		return
 	}
 	i -= 1
+	tb.mem.alloc(memSlot)
 	tb.array = append(tb.array, LNil)
 	copy(tb.array[i+1:], tb.array[i:])
 	tb.array[i] = value
@@ -132,6 +134,7 @@ func (tb *LTable) Remove(pos int) LValue {
 // It is recommended to use `RawSetString` or `RawSetInt` for performance
 // if you already know the given LValue is a string or number.
 func (tb *LTable) RawSet(key LValue, value LValue) {
+	key = tableKey(key)
 	switch v := key.(type) {
 	case LNumber:
 		if isArrayKey(v) {
@@ -140,6 +143,9 @@ func (tb *LTable) RawSet(key LValue, value LValue) {
 			}
 			index := int(v) - 1
 			alen := len(tb.array)
+			if index >= alen {
+				tb.mem.alloc(memSlot * (index - alen + 1))
+			}
 			switch {
 			case index == alen:
 				tb.array = append(tb.array, value)
@@ -172,6 +178,9 @@ func (tb *LTable) RawSetInt(key int, value LValue) {
 	}
 	index := key - 1
 	alen := len(tb.array)
+	if index >= alen {
+		tb.mem.alloc(memSlot * (index - alen + 1))
+	}
 	switch {
 	case index == alen:
 		tb.array = append(tb.array, value)
@@ -202,6 +211,7 @@ func (tb *LTable) RawSetString(key string, value LValue) {
 		tb.strdict[key] = value
 		lkey := LString(key)
 		if _, ok := tb.k2i[lkey]; !ok {
+			tb.mem.alloc(memEntry)
 			tb.k2i[lkey] = len(tb.keys)
 			tb.keys = append(tb.keys, lkey)
 		}
@@ -210,6 +220,7 @@ func (tb *LTable) RawSetString(key string, value LValue) {
 
 // RawSetH sets a given LValue to a given index without the __newindex metamethod.
 func (tb *LTable) RawSetH(key LValue, value LValue) {
+	key = tableKey(key)
 	if s, ok := key.(LString); ok {
 		tb.RawSetString(string(s), value)
 		return
@@ -228,6 +239,7 @@ func (tb *LTable) RawSetH(key LValue, value LValue) {
 	} else {
 		tb.dict[key] = value
 		if _, ok := tb.k2i[key]; !ok {
+			tb.mem.alloc(memEntry)
 			tb.k2i[key] = len(tb.keys)
 			tb.keys = append(tb.keys, key)
 		}
@@ -236,6 +248,7 @@ func (tb *LTable) RawSetH(key LValue, value LValue) {
 
 // RawGet returns an LValue associated with a given key without __index metamethod.
 func (tb *LTable) RawGet(key LValue) LValue {
+	key = tableKey(key)
 	switch v := key.(type) {
 	case LNumber:
 		if isArrayKey(v) {
@@ -280,6 +293,7 @@ func (tb *LTable) RawGetInt(key int) LValue {
 
 // RawGet returns an LValue associated with a given key without __index metamethod.
 func (tb *LTable) RawGetH(key LValue) LValue {
+	key = tableKey(key)
 	if s, sok := key.(LString); sok {
 		if tb.strdict == nil {
 			return LNil
@@ -336,6 +350,7 @@ func (tb *LTable) ForEach(cb func(LValue, LValue)) {
 
 // This function is equivalent to lua_next ( http://www.lua.org/manual/5.1/manual.html#lua_next ).
 func (tb *LTable) Next(key LValue) (LValue, LValue) {
+	key = tableKey(key)
 	init := false
 	if key == LNil {
 		key = LNumber(0)
@@ -372,3 +387,15 @@ func (tb *LTable) Next(key LValue) (LValue, LValue) {
 	}
 	return LNil, LNil
 }
+
+// tableKey converts an integer key to a float, so that integers and floats
+// with the same value are the same key. Integers without an exact float
+// representation stay integers.
+func tableKey(key LValue) LValue {
+	if i, ok := key.(LInteger); ok {
+		if f := LNumber(i); f < 1<<63 && LInteger(f) == i {
+			return f
+		}
+	}
+	return key
+}
@@ -76,3 +76,9 @@ func errorIfGFuncNotFail(t *testing.T, L *LState, f LGFunction, pattern string)
 	}
 	t.Errorf("%v LGFunction should fail", positionString(1))
 }
+
+func errorIfNotApiError(t *testing.T, err error, typ ApiErrorType) {
+	if aerr, ok := err.(*ApiError); !ok || aerr.Type != typ {
+		t.Errorf("%v error of type %v expected, but got '%v'", positionString(1), typ, err)
+	}
+}
@@ -155,6 +155,51 @@ func parseNumber(number string) (LNumber, error) {
 	return value, nil
 }
 
+// parseInteger parses number like the integer numerals of Lua 5.3: decimal
+// numerals that fit into 64 bits, and hexadecimal numerals, that wrap around.
+func parseInteger(number string) (LInteger, bool) {
+	s := strings.Trim(number, " \t\n")
+	neg := false
+	if strings.HasPrefix(s, "-") {
+		neg = true
+		s = s[1:]
+	} else if strings.HasPrefix(s, "+") {
+		s = s[1:]
+	}
+	var n uint64
+	if len(s) > 2 && (s[:2] == "0x" || s[:2] == "0X") {
+		for _, c := range s[2:] {
+			d, err := strconv.ParseUint(string(c), 16, 8)
+			if err != nil {
+				return 0, false
+			}
+			n = n<<4 | d
+		}
+	} else {
+		v, err := strconv.ParseUint(s, 10, 64)
+		if err != nil || (!neg && v > 1<<63-1) || v > 1<<63 {
+			return 0, false
+		}
+		n = v
+	}
+	if neg {
+		n = -n
+	}
+	return LInteger(n), true
+}
+
+// parseLuaNumber parses number as an integer if it is an integer numeral and
+// integers is set, see Options.Integers.
+func parseLuaNumber(number string, integers bool) (LValue, error) {
+	if integers {
+		if v, ok := parseInteger(number); ok {
+			return v, nil
+		}
+	}
+	v, err := parseNumber(number)
+	return v, err
+}
+
 func popenArgs(arg string) (string, []string) {
 	cmd := "/bin/sh"
 	args := []string{"-c"}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strconv"
 )
 
 type LValueType int
@@ -47,7 +48,7 @@ func LVAsBool(v LValue) bool { return v != LNil && v != LFalse }
 // if the LValue is a string or number, otherwise an empty string.
 func LVAsString(v LValue) string {
 	switch sn := v.(type) {
-	case LString, LNumber:
+	case LString, LNumber, LInteger:
 		return sn.String()
 	default:
 		return ""
@@ -58,7 +59,7 @@ func LVAsString(v LValue) string {
 // otherwise false.
 func LVCanConvToString(v LValue) bool {
 	switch v.(type) {
-	case LString, LNumber:
+	case LString, LNumber, LInteger:
 		return true
 	default:
 		return false
@@ -70,6 +71,8 @@ func LVAsNumber(v LValue) LNumber {
 	switch lv := v.(type) {
 	case LNumber:
 		return lv
+	case LInteger:
+		return LNumber(lv)
 	case LString:
 		if num, err := parseNumber(string(lv)); err == nil {
 			return num
@@ -158,6 +161,33 @@ func (nm LNumber) Format(f fmt.State, c rune) {
 	}
 }
 
+// LInteger is a number with an integer representation, like the integers of
+// Lua 5.3. Integers and floats (LNumber) have the type "number" and equal
+// values compare equal and are the same table key. Arithmetic on two
+// integers results in an integer, except for / and ^, and wraps around on
+// overflow. See Options.Integers.
+type LInteger int64
+
+func (i LInteger) String() string                     { return strconv.FormatInt(int64(i), 10) }
+func (i LInteger) Type() LValueType                   { return LTNumber }
+func (i LInteger) assertFloat64() (float64, bool)     { return float64(i), true }
+func (i LInteger) assertString() (string, bool)       { return "", false }
+func (i LInteger) assertFunction() (*LFunction, bool) { return nil, false }
+
+// fmt.Formatter interface
+func (i LInteger) Format(f fmt.State, c rune) {
+	switch c {
+	case 'q', 's':
+		defaultFormat(i.String(), f, c)
+	case 'e', 'E', 'f', 'F', 'g', 'G':
+		defaultFormat(float64(i), f, c)
+	case 'i':
+		defaultFormat(int64(i), f, 'd')
+	default:
+		defaultFormat(int64(i), f, c)
+	}
+}
+
 type LTable struct {
 	Metatable LValue
 
@@ -166,6 +196,7 @@ type LTable struct {
 	strdict map[string]LValue
 	keys    []LValue
 	k2i     map[LValue]int
+	mem     *memAccount
 }
 
 func (tb *LTable) String() string                     { return fmt.Sprintf("table: %p", tb) }
@@ -198,6 +229,13 @@ type Global struct {
 	builtinMts map[int]LValue
 	tempFiles  []*os.File
 	gccount    int32
+	ids        *dumpIdentity
+
+	checkpoints *checkpointer
+	journal     *Journal
+	budget      *instructionBudget
+	mem         memAccount
+	finalizers  *finalizers
 }
 
 type LState struct {
@@ -216,8 +254,10 @@ type LState struct {
 	wrapped      bool
 	uvcache      *Upvalue
 	hasErrorFunc bool
-	mainLoop     func(*LState, *callFrame)
+	mainLoop     func(*LState, *callFrame) bool
 	ctx          context.Context
+	hook         *debugHook
+	loopKind     int
 }
 
 func (ls *LState) String() string                     { return fmt.Sprintf("thread: %p", ls) }
@@ -230,6 +270,8 @@ type LUserData struct {
 	Value     interface{}
 	Env       *LTable
 	Metatable LValue
+
+	hasFinalizer bool
 }
 
 func (ud *LUserData) String() string                     { return fmt.Sprintf("userdata: %p", ud) }
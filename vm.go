@@ -10,42 +10,50 @@ import (
 	"strings"
 )
 
-func mainLoop(L *LState, baseframe *callFrame) {
+// runMainLoop runs the main loop of L. The loops return true when a Go
+// function changed the loop the state needs, see setMainLoop, and the run
+// continues in the new loop, without nesting it in the old one.
+func runMainLoop(L *LState, baseframe *callFrame) {
+	for L.mainLoop(L, baseframe) {
+	}
+}
+
+func mainLoop(L *LState, baseframe *callFrame) bool {
 	var inst uint32
 	var cf *callFrame
 
 	if L.stack.IsEmpty() {
-		return
+		return false
 	}
 
 	L.currentFrame = L.stack.Last()
 	if L.currentFrame.Fn.IsG {
 		callGFunction(L, false)
-		return
+		return false
 	}
 
 	for {
 		cf = L.currentFrame
 		inst = cf.Fn.Proto.Code[cf.Pc]
 		cf.Pc++
-		if jumpTable[int(inst>>26)](L, inst, baseframe) == 1 {
-			return
+		if r := jumpTable[int(inst>>26)](L, inst, baseframe); r != 0 {
+			return r == 2
 		}
 	}
 }
 
-func mainLoopWithContext(L *LState, baseframe *callFrame) {
+func mainLoopWithContext(L *LState, baseframe *callFrame) bool {
 	var inst uint32
 	var cf *callFrame
 
 	if L.stack.IsEmpty() {
-		return
+		return false
 	}
 
 	L.currentFrame = L.stack.Last()
 	if L.currentFrame.Fn.IsG {
 		callGFunction(L, false)
-		return
+		return false
 	}
 
 	for {
@@ -55,12 +63,67 @@ func mainLoopWithContext(L *LState, baseframe *callFrame) {
 		select {
 		case <-L.ctx.Done():
 			L.RaiseError(L.ctx.Err().Error())
-			return
+			return false
 		default:
-			if jumpTable[int(inst>>26)](L, inst, baseframe) == 1 {
-				return
+			if r := jumpTable[int(inst>>26)](L, inst, baseframe); r != 0 {
+				return r == 2
+			}
+		}
+	}
+}
+
+// mainLoopWithHooks is mainLoop for states with a checkpoint policy, an
+// instruction budget or a debug hook, and a context.
+func mainLoopWithHooks(L *LState, baseframe *callFrame) bool {
+	var inst uint32
+	var cf *callFrame
+
+	if L.stack.IsEmpty() {
+		return false
+	}
+
+	L.currentFrame = L.stack.Last()
+	if L.currentFrame.Fn.IsG {
+		callGFunction(L, false)
+		return false
+	}
+
+	cp := L.G.checkpoints
+	for {
+		if cp != nil {
+			cp.step(L)
+		}
+		cf = L.currentFrame
+		inst = cf.Fn.Proto.Code[cf.Pc]
+		cf.Pc++
+		if b := L.G.budget; b != nil {
+			b.step(L, cf)
+		}
+		if L.ctx != nil {
+			select {
+			case <-L.ctx.Done():
+				L.RaiseError(L.ctx.Err().Error())
+				return false
+			default:
 			}
 		}
+		op := int(inst >> 26)
+		if h := L.hook; h != nil {
+			h.step(L, cf, op)
+		}
+		parent := L.Parent
+		if cp != nil && (op == OP_CALL || op == OP_TAILCALL) {
+			cp.call(L, inst)
+		}
+		if r := jumpTable[op](L, inst, baseframe); r != 0 {
+			if r == 2 {
+				return true
+			}
+			if cp != nil && parent != nil && L.Parent == nil && !L.Dead {
+				cp.yield()
+			}
+			return false
+		}
 	}
 }
 
@@ -120,7 +183,30 @@ func switchToParentThread(L *LState, nargs int, haserror bool, kill bool) {
 
 func callGFunction(L *LState, tailcall bool) bool {
 	frame := L.currentFrame
-	gfnret := frame.Fn.GFunction(L)
+	var gfnret int
+	hook := L.hook
+	if hook != nil {
+		hook.callG(L)
+	}
+	if name, ok := L.G.journal.name(frame.Fn.GFunction); ok {
+		gfnret = L.G.journal.call(L, name, frame.Fn.GFunction)
+	} else {
+		gfnret = frame.Fn.GFunction(L)
+	}
+	if hook != nil && gfnret >= 0 {
+		hook.returnG(L)
+	}
+	return returnGFunction(L, frame, tailcall, gfnret)
+}
+
+// returnGFunction returns the gfnret results of the Go function of frame, the
+// current frame, to its caller. It reports whether the thread switched to
+// its parent.
+func returnGFunction(L *LState, frame *callFrame, tailcall bool, gfnret int) bool {
+	L.checkMemory()
+	if L.G.finalizers.due() && gfnret >= 0 {
+		L.runFinalizers()
+	}
 	if tailcall {
 		L.stack.Remove(L.stack.Sp() - 2) // remove caller lua function frame
 		L.currentFrame = L.stack.Last()
@@ -163,13 +249,18 @@ func callGFunction(L *LState, tailcall bool) bool {
 	return false
 }
 
-func threadRun(L *LState) {
+// threadRun runs the thread L resumed by its parent. A thread paused by
+// PauseOnInstructionLimit is continued instead, see Continue.
+func threadRun(L *LState, continued bool) {
 	if L.stack.IsEmpty() {
 		return
 	}
 
 	defer func() {
 		if rcv := recover(); rcv != nil {
+			if v, ok := rcv.(*ApiError); ok && v.Type == ApiErrorPaused {
+				panic(rcv) // the thread is continued by Continue
+			}
 			var lv LValue
 			if v, ok := rcv.(*ApiError); ok {
 				lv = v.Object
@@ -178,6 +269,9 @@ func threadRun(L *LState) {
 			}
 			if parent := L.Parent; parent != nil {
 				if L.wrapped {
+					if v, ok := rcv.(*ApiError); ok && v.Type == ApiErrorBudget {
+						parent.raiseBudgetError() // keep its type through coroutine.wrap
+					}
 					L.Push(lv)
 					parent.Panic(L)
 				} else {
@@ -190,7 +284,12 @@ func threadRun(L *LState) {
 			}
 		}
 	}()
-	L.mainLoop(L, nil)
+	L.setMainLoop() // the hooks may have changed since the thread ran
+	if continued {
+		L.continueFrames(0)
+	} else {
+		runMainLoop(L, nil)
+	}
 }
 
 type instFunc func(*LState, uint32, *callFrame) int
@@ -321,6 +420,7 @@ func init() {
 			Bx := int(inst & 0x3ffff) //GETBX
 			//L.setField(cf.Fn.Env, cf.Fn.Proto.Constants[Bx], reg.Get(RA))
 			L.setFieldString(cf.Fn.Env, cf.Fn.Proto.stringConstants[Bx], reg.Get(RA))
+			L.checkMemory()
 			return 0
 		},
 		func(L *LState, inst uint32, baseframe *callFrame) int { //OP_SETUPVAL
@@ -342,6 +442,7 @@ func init() {
 			B := int(inst & 0x1ff)    //GETB
 			C := int(inst>>9) & 0x1ff //GETC
 			L.setField(reg.Get(RA), L.rkValue(B), L.rkValue(C))
+			L.checkMemory()
 			return 0
 		},
 		func(L *LState, inst uint32, baseframe *callFrame) int { //OP_SETTABLEKS
@@ -353,6 +454,7 @@ func init() {
 			B := int(inst & 0x1ff)    //GETB
 			C := int(inst>>9) & 0x1ff //GETC
 			L.setFieldString(reg.Get(RA), L.rkString(B), L.rkValue(C))
+			L.checkMemory()
 			return 0
 		},
 		func(L *LState, inst uint32, baseframe *callFrame) int { //OP_NEWTABLE
@@ -363,7 +465,8 @@ func init() {
 			RA := lbase + A
 			B := int(inst & 0x1ff)    //GETB
 			C := int(inst>>9) & 0x1ff //GETC
-			reg.Set(RA, newLTable(B, C))
+			reg.Set(RA, L.newTable(B, C))
+			L.checkMemory()
 			return 0
 		},
 		func(L *LState, inst uint32, baseframe *callFrame) int { //OP_SELF
@@ -395,6 +498,8 @@ func init() {
 			unaryv := L.rkValue(B)
 			if nm, ok := unaryv.(LNumber); ok {
 				reg.SetNumber(RA, -nm)
+			} else if iv, ok := unaryv.(LInteger); ok {
+				reg.Set(RA, -iv)
 			} else {
 				op := L.metaOp1(unaryv, "__unm")
 				if op.Type() == LTFunction {
@@ -437,7 +542,7 @@ func init() {
 			B := int(inst & 0x1ff) //GETB
 			switch lv := L.rkValue(B).(type) {
 			case LString:
-				reg.SetNumber(RA, LNumber(len(lv)))
+				L.setLength(RA, len(lv))
 			default:
 				op := L.metaOp1(lv, "__len")
 				if op.Type() == LTFunction {
@@ -446,12 +551,12 @@ func init() {
 					L.Call(1, 1)
 					ret := reg.Pop()
 					if ret.Type() == LTNumber {
-						reg.SetNumber(RA, ret.(LNumber))
+						reg.Set(RA, ret)
 					} else {
 						reg.SetNumber(RA, LNumber(0))
 					}
 				} else if lv.Type() == LTTable {
-					reg.SetNumber(RA, LNumber(lv.(*LTable).Len()))
+					L.setLength(RA, lv.(*LTable).Len())
 				} else {
 					L.RaiseError("__len undefined")
 				}
@@ -469,6 +574,7 @@ func init() {
 			RC := lbase + C
 			RB := lbase + B
 			reg.Set(RA, stringConcat(L, RC-RB+1, RC))
+			L.checkMemory()
 			return 0
 		},
 		func(L *LState, inst uint32, baseframe *callFrame) int { //OP_JMP
@@ -518,7 +624,12 @@ func init() {
 
 			if v1, ok1 := lhs.assertFloat64(); ok1 {
 				if v2, ok2 := rhs.assertFloat64(); ok2 {
-					ret = v1 <= v2
+					if isFloats(lhs, rhs) {
+						ret = v1 <= v2
+					} else {
+						c := numberCompare(lhs, rhs)
+						ret = c == -1 || c == 0
+					}
 				} else {
 					L.RaiseError("attempt to compare %v with %v", lhs.Type().String(), rhs.Type().String())
 				}
@@ -682,7 +793,7 @@ func init() {
 							if CompatVarArg {
 								ls.reg.SetTop(cf.LocalBase + nargs + np + 1)
 								if (proto.IsVarArg & VarArgNeedsArg) != 0 {
-									argtb := newLTable(nvarargs, 0)
+									argtb := ls.newTable(nvarargs, 0)
 									for i := 0; i < nvarargs; i++ {
 										argtb.RawSetInt(i+1, ls.reg.Get(cf.LocalBase+np+i))
 									}
@@ -701,8 +812,14 @@ func init() {
 				}
 				ls.currentFrame = newcf
 			}
-			if callable.IsG && callGFunction(L, false) {
-				return 1
+			if callable.IsG {
+				loop := L.loopKind
+				if callGFunction(L, false) {
+					return 1
+				}
+				if L.loopKind != loop {
+					return 2 // the Go function changed the main loop, see setMainLoop
+				}
 			}
 			return 0
 		},
@@ -751,6 +868,7 @@ func init() {
 			}
 			if callable.IsG {
 				luaframe := cf
+				loop := L.loopKind
 				L.pushCallFrame(callFrame{
 					Fn:         callable,
 					Pc:         0,
@@ -768,6 +886,9 @@ func init() {
 				if L.currentFrame == nil || L.currentFrame.Fn.IsG || luaframe == baseframe {
 					return 1
 				}
+				if L.loopKind != loop {
+					return 2
+				}
 			} else {
 				base := cf.Base
 				cf.Fn = callable
@@ -840,7 +961,7 @@ func init() {
 							if CompatVarArg {
 								ls.reg.SetTop(cf.LocalBase + nargs + np + 1)
 								if (proto.IsVarArg & VarArgNeedsArg) != 0 {
-									argtb := newLTable(nvarargs, 0)
+									argtb := ls.newTable(nvarargs, 0)
 									for i := 0; i < nvarargs; i++ {
 										argtb.RawSetInt(i+1, ls.reg.Get(cf.LocalBase+np+i))
 									}
@@ -1000,6 +1121,19 @@ func init() {
 			lbase := cf.LocalBase
 			A := int(inst>>18) & 0xff //GETA
 			RA := lbase + A
+			if idx, ok := reg.Get(RA).(LInteger); ok {
+				if count := uint64(reg.Get(RA + 1).(LInteger)); count > 0 {
+					idx += reg.Get(RA + 2).(LInteger)
+					reg.Set(RA, idx)
+					reg.Set(RA+1, LInteger(count-1))
+					reg.Set(RA+3, idx)
+					Sbx := int(inst&0x3ffff) - opMaxArgSbx //GETSBX
+					cf.Pc += Sbx
+				} else {
+					reg.SetTop(RA + 1)
+				}
+				return 0
+			}
 			if init, ok1 := reg.Get(RA).assertFloat64(); ok1 {
 				if limit, ok2 := reg.Get(RA + 1).assertFloat64(); ok2 {
 					if step, ok3 := reg.Get(RA + 2).assertFloat64(); ok3 {
@@ -1030,6 +1164,15 @@ func init() {
 			A := int(inst>>18) & 0xff //GETA
 			RA := lbase + A
 			Sbx := int(inst&0x3ffff) - opMaxArgSbx //GETSBX
+			if init, ok1 := reg.Get(RA).(LInteger); ok1 {
+				if step, ok2 := reg.Get(RA + 2).(LInteger); ok2 {
+					// the loop starts with its body, or is skipped
+					if !forPrepInteger(L, RA, init, step) {
+						cf.Pc += Sbx + 1
+					}
+					return 0
+				}
+			}
 			if init, ok1 := reg.Get(RA).assertFloat64(); ok1 {
 				if step, ok2 := reg.Get(RA + 2).assertFloat64(); ok2 {
 					reg.SetNumber(RA, LNumber(init-step))
@@ -1084,6 +1227,7 @@ func init() {
 			for i := 1; i <= nelem; i++ {
 				table.RawSetInt(offset+i, reg.Get(RA+i))
 			}
+			L.checkMemory()
 			return 0
 		},
 		func(L *LState, inst uint32, baseframe *callFrame) int { //OP_CLOSE
@@ -1174,10 +1318,102 @@ func init() {
 		func(L *LState, inst uint32, baseframe *callFrame) int { //OP_NOP
 			return 0
 		},
+		opArith, // OP_IDIV
+		opArith, // OP_BAND
+		opArith, // OP_BOR
+		opArith, // OP_BXOR
+		opArith, // OP_SHL
+		opArith, // OP_SHR
+		func(L *LState, inst uint32, baseframe *callFrame) int { //OP_BNOT
+			reg := L.reg
+			cf := L.currentFrame
+			lbase := cf.LocalBase
+			A := int(inst>>18) & 0xff //GETA
+			RA := lbase + A
+			B := int(inst & 0x1ff) //GETB
+			unaryv := L.rkValue(B)
+			if _, ok := unaryv.assertFloat64(); ok {
+				reg.Set(RA, numberArith(L, OP_BNOT, unaryv, unaryv))
+			} else {
+				op := L.metaOp1(unaryv, "__bnot")
+				if op.Type() == LTFunction {
+					reg.Push(op)
+					reg.Push(unaryv)
+					L.Call(1, 1)
+					reg.Set(RA, reg.Pop())
+				} else if str, ok1 := unaryv.(LString); ok1 {
+					if num, err := parseNumber(string(str)); err == nil {
+						reg.Set(RA, numberArith(L, OP_BNOT, num, num))
+					} else {
+						L.RaiseError("__bnot undefined")
+					}
+				} else {
+					L.RaiseError("__bnot undefined")
+				}
+			}
+			return 0
+		},
+	}
+}
+
+// forPrepInteger prepares a numeric for loop with integer init and step. Like
+// in Lua 5.4, R(A+1) is set to the number of iterations after the first, so
+// that the loop variable never overflows. It returns false if the loop does
+// not run at all.
+func forPrepInteger(L *LState, RA int, init, step LInteger) bool {
+	reg := L.reg
+	if step == 0 {
+		L.RaiseError("for statement step is zero")
+	}
+	var limit LInteger
+	switch lv := reg.Get(RA + 1).(type) {
+	case LInteger:
+		limit = lv
+	case LNumber:
+		f := float64(lv)
+		if step > 0 {
+			f = math.Floor(f)
+		} else {
+			f = math.Ceil(f)
+		}
+		switch {
+		case math.IsNaN(f):
+			return false
+		case f >= 1<<63:
+			if step < 0 {
+				return false
+			}
+			limit = math.MaxInt64
+		case f < -(1 << 63):
+			if step > 0 {
+				return false
+			}
+			limit = math.MinInt64
+		default:
+			limit = LInteger(f)
+		}
+	default:
+		L.RaiseError("for statement limit must be a number")
+	}
+	var count uint64
+	if step > 0 {
+		if init > limit {
+			return false
+		}
+		count = (uint64(limit) - uint64(init)) / uint64(step)
+	} else {
+		if init < limit {
+			return false
+		}
+		count = (uint64(init) - uint64(limit)) / (uint64(-(step + 1)) + 1)
 	}
+	reg.Set(RA, init)
+	reg.Set(RA+1, LInteger(count))
+	reg.Set(RA+3, init)
+	return true
 }
 
-func opArith(L *LState, inst uint32, baseframe *callFrame) int { //OP_ADD, OP_SUB, OP_MUL, OP_DIV, OP_MOD, OP_POW
+func opArith(L *LState, inst uint32, baseframe *callFrame) int { //OP_ADD, OP_SUB, OP_MUL, OP_DIV, OP_MOD, OP_POW, OP_IDIV, OP_BAND, OP_BOR, OP_BXOR, OP_SHL, OP_SHR
 	reg := L.reg
 	cf := L.currentFrame
 	lbase := cf.LocalBase
@@ -1188,16 +1424,37 @@ func opArith(L *LState, inst uint32, baseframe *callFrame) int { //OP_ADD, OP_SU
 	C := int(inst>>9) & 0x1ff //GETC
 	lhs := L.rkValue(B)
 	rhs := L.rkValue(C)
-	v1, ok1 := lhs.assertFloat64()
-	v2, ok2 := rhs.assertFloat64()
+	// optimization for floats
+	if v1, ok1 := lhs.(LNumber); ok1 {
+		if v2, ok2 := rhs.(LNumber); ok2 && !isBitwiseOp(opcode) {
+			reg.SetNumber(RA, floatArith(opcode, v1, v2))
+			return 0
+		}
+	}
+	_, ok1 := lhs.assertFloat64()
+	_, ok2 := rhs.assertFloat64()
 	if ok1 && ok2 {
-		reg.SetNumber(RA, numberArith(L, opcode, LNumber(v1), LNumber(v2)))
+		reg.Set(RA, numberArith(L, opcode, lhs, rhs))
 	} else {
 		reg.Set(RA, objectArith(L, opcode, lhs, rhs))
 	}
 	return 0
 }
 
+// setLength sets the register RA to the length n, an integer if the state
+// uses integers.
+func (ls *LState) setLength(RA int, n int) {
+	if ls.Options.Integers {
+		ls.reg.Set(RA, LInteger(n))
+	} else {
+		ls.reg.SetNumber(RA, LNumber(n))
+	}
+}
+
+func isBitwiseOp(opcode int) bool {
+	return opcode >= OP_BAND && opcode <= OP_BNOT
+}
+
 func luaModulo(lhs, rhs LNumber) LNumber {
 	flhs := float64(lhs)
 	frhs := float64(rhs)
@@ -1208,7 +1465,128 @@ func luaModulo(lhs, rhs LNumber) LNumber {
 	return LNumber(v)
 }
 
-func numberArith(L *LState, opcode int, lhs, rhs LNumber) LNumber {
+// luaToInteger converts a number with an exact integer representation to an
+// integer, like the operands of bitwise operators.
+func luaToInteger(lv LValue) (int64, bool) {
+	switch n := lv.(type) {
+	case LInteger:
+		return int64(n), true
+	case LNumber:
+		f := float64(n)
+		if math.Floor(f) != f || f < -(1<<63) || f >= 1<<63 {
+			return 0, false
+		}
+		return int64(f), true
+	}
+	return 0, false
+}
+
+// luaShiftLeft shifts x by n bits to the left, or to the right if n is
+// negative. The shifts are logical, bits shifted out are lost.
+func luaShiftLeft(x, n int64) int64 {
+	switch {
+	case n <= -64 || n >= 64:
+		return 0
+	case n >= 0:
+		return int64(uint64(x) << uint(n))
+	default:
+		return int64(uint64(x) >> uint(-n))
+	}
+}
+
+// luaBitwise performs the bitwise operation of opcode on x and y. The unary
+// OP_BNOT ignores y.
+func luaBitwise(opcode int, x, y int64) int64 {
+	switch opcode {
+	case OP_BAND:
+		x &= y
+	case OP_BOR:
+		x |= y
+	case OP_BXOR:
+		x ^= y
+	case OP_SHL:
+		x = luaShiftLeft(x, y)
+	case OP_SHR:
+		x = luaShiftLeft(x, -y)
+	case OP_BNOT:
+		x = ^x
+	}
+	return x
+}
+
+// numberArith performs the arithmetic operation of opcode on the numbers lhs
+// and rhs.
+func numberArith(L *LState, opcode int, lhs, rhs LValue) LValue {
+	v, err := arith(opcode, lhs, rhs)
+	if err != "" {
+		L.RaiseError(err)
+	}
+	return v
+}
+
+// arith performs the arithmetic operation of opcode on the numbers lhs and
+// rhs, or returns the message of the error it raises. Operations on two
+// integers result in integers, except for / and ^, and bitwise operations
+// result in integers if either operand is one. Other operations are
+// performed on floats. Like Lua, unary operations take their operand as
+// both lhs and rhs.
+func arith(opcode int, lhs, rhs LValue) (LValue, string) {
+	x, xint := lhs.(LInteger)
+	y, yint := rhs.(LInteger)
+	if isBitwiseOp(opcode) {
+		v1, ok1 := luaToInteger(lhs)
+		v2, ok2 := luaToInteger(rhs)
+		if !ok1 || !ok2 {
+			return LNil, "number has no integer representation"
+		}
+		if xint || yint {
+			return LInteger(luaBitwise(opcode, v1, v2)), ""
+		}
+		return LNumber(luaBitwise(opcode, v1, v2)), ""
+	}
+	if xint && yint {
+		return integerArith(opcode, x, y)
+	}
+	v1, _ := lhs.assertFloat64()
+	v2, _ := rhs.assertFloat64()
+	return floatArith(opcode, LNumber(v1), LNumber(v2)), ""
+}
+
+func integerArith(opcode int, x, y LInteger) (LValue, string) {
+	switch opcode {
+	case OP_ADD:
+		return x + y, ""
+	case OP_SUB:
+		return x - y, ""
+	case OP_MUL:
+		return x * y, ""
+	case OP_DIV:
+		return LNumber(x) / LNumber(y), ""
+	case OP_MOD:
+		if y == 0 {
+			return LNil, "attempt to perform 'n%0'"
+		}
+		r := x % y
+		if r != 0 && (r^y) < 0 {
+			r += y
+		}
+		return r, ""
+	case OP_POW:
+		return LNumber(math.Pow(float64(x), float64(y))), ""
+	case OP_IDIV:
+		if y == 0 {
+			return LNil, "attempt to perform 'n//0'"
+		}
+		q := x / y
+		if x%y != 0 && (x^y) < 0 {
+			q--
+		}
+		return q, ""
+	}
+	panic("should not reach here")
+}
+
+func floatArith(opcode int, lhs, rhs LNumber) LNumber {
 	switch opcode {
 	case OP_ADD:
 		return lhs + rhs
@@ -1224,9 +1602,10 @@ func numberArith(L *LState, opcode int, lhs, rhs LNumber) LNumber {
 		flhs := float64(lhs)
 		frhs := float64(rhs)
 		return LNumber(math.Pow(flhs, frhs))
+	case OP_IDIV:
+		return LNumber(math.Floor(float64(lhs / rhs)))
 	}
 	panic("should not reach here")
-	return LNumber(0)
 }
 
 func objectArith(L *LState, opcode int, lhs, rhs LValue) LValue {
@@ -1244,6 +1623,18 @@ func objectArith(L *LState, opcode int, lhs, rhs LValue) LValue {
 		event = "__mod"
 	case OP_POW:
 		event = "__pow"
+	case OP_IDIV:
+		event = "__idiv"
+	case OP_BAND:
+		event = "__band"
+	case OP_BOR:
+		event = "__bor"
+	case OP_BXOR:
+		event = "__bxor"
+	case OP_SHL:
+		event = "__shl"
+	case OP_SHR:
+		event = "__shr"
 	}
 	op := L.metaOp2(lhs, rhs, event)
 	if op.Type() == LTFunction {
@@ -1263,9 +1654,9 @@ func objectArith(L *LState, opcode int, lhs, rhs LValue) LValue {
 			rhs = rnum
 		}
 	}
-	if v1, ok1 := lhs.assertFloat64(); ok1 {
-		if v2, ok2 := rhs.assertFloat64(); ok2 {
-			return numberArith(L, opcode, LNumber(v1), LNumber(v2))
+	if _, ok1 := lhs.assertFloat64(); ok1 {
+		if _, ok2 := rhs.assertFloat64(); ok2 {
+			return numberArith(L, opcode, lhs, rhs)
 		}
 	}
 	L.RaiseError(fmt.Sprintf("cannot perform %v operation between %v and %v",
@@ -1305,6 +1696,13 @@ func stringConcat(L *LState, total, last int) LValue {
 				i--
 				total--
 			}
+			// reserved before the string is built, so that a huge result
+			// fails without being allocated
+			n := memString
+			for _, s := range buf {
+				n += len(s)
+			}
+			L.reserveMemory(n)
 			rhs = LString(strings.Join(buf, ""))
 		}
 	}
@@ -1315,7 +1713,10 @@ func lessThan(L *LState, lhs, rhs LValue) bool {
 	// optimization for numbers
 	if v1, ok1 := lhs.assertFloat64(); ok1 {
 		if v2, ok2 := rhs.assertFloat64(); ok2 {
-			return v1 < v2
+			if isFloats(lhs, rhs) {
+				return v1 < v2
+			}
+			return numberCompare(lhs, rhs) < 0
 		}
 		L.RaiseError("attempt to compare %v with %v", lhs.Type().String(), rhs.Type().String())
 	}
@@ -1345,7 +1746,11 @@ func equals(L *LState, lhs, rhs LValue, raw bool) bool {
 	case LTNumber:
 		v1, _ := lhs.assertFloat64()
 		v2, _ := rhs.assertFloat64()
-		ret = v1 == v2
+		if isFloats(lhs, rhs) {
+			ret = v1 == v2
+		} else {
+			ret = numberCompare(lhs, rhs) == 0
+		}
 	case LTBool:
 		ret = bool(lhs.(LBool)) == bool(rhs.(LBool))
 	case LTString:
@@ -1367,6 +1772,76 @@ func equals(L *LState, lhs, rhs LValue, raw bool) bool {
 	return ret
 }
 
+// isFloats reports whether neither of the numbers lhs and rhs is an integer.
+func isFloats(lhs, rhs LValue) bool {
+	_, xint := lhs.(LInteger)
+	_, yint := rhs.(LInteger)
+	return !xint && !yint
+}
+
+// numberCompare compares the numbers lhs and rhs exactly, also integers that
+// have no exact float representation. It returns -1, 0 or 1 if lhs is less
+// than, equal to or greater than rhs, and 2 if either is NaN.
+func numberCompare(lhs, rhs LValue) int {
+	x, xint := lhs.(LInteger)
+	y, yint := rhs.(LInteger)
+	switch {
+	case xint && yint:
+		return compareInt64(int64(x), int64(y))
+	case xint:
+		f, _ := rhs.assertFloat64()
+		return intFloatCompare(int64(x), f)
+	case yint:
+		f, _ := lhs.assertFloat64()
+		if c := intFloatCompare(int64(y), f); c != 2 {
+			return -c
+		}
+		return 2
+	}
+	f1, _ := lhs.assertFloat64()
+	f2, _ := rhs.assertFloat64()
+	switch {
+	case f1 < f2:
+		return -1
+	case f1 > f2:
+		return 1
+	case f1 == f2:
+		return 0
+	}
+	return 2
+}
+
+func compareInt64(x, y int64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// intFloatCompare compares the integer i with the float f, see numberCompare.
+func intFloatCompare(i int64, f float64) int {
+	switch {
+	case math.IsNaN(f):
+		return 2
+	case f >= 1<<63:
+		return -1
+	case f < -(1 << 63):
+		return 1
+	}
+	// f is in the range of integers, compare with its integral part
+	fi := math.Floor(f)
+	if c := compareInt64(i, int64(fi)); c != 0 {
+		return c
+	}
+	if fi < f {
+		return -1
+	}
+	return 0
+}
+
 func objectRationalWithError(L *LState, lhs, rhs LValue, event string) bool {
 	switch objectRational(L, lhs, rhs, event) {
 	case 1: